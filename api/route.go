@@ -1,25 +1,42 @@
 package api
 
 import (
+	"crypto/subtle"
 	"encoding/json"
+	"fileClick/config"
 	"fileClick/service"
 	"fileClick/system"
 	"net/http"
+	"os"
 )
 
-func InitRouter() *http.Server {
+func InitRouter(addr string) *http.Server {
 	mux := http.NewServeMux()
-	mux.HandleFunc("/click", methodGuard(http.MethodPut, service.Click))
+	mux.HandleFunc("/click", methodGuard(http.MethodPut, writeGuard(service.Click)))
+	mux.HandleFunc("/clicks", methodGuard(http.MethodPost, writeGuard(service.ClickBatch)))
 	mux.HandleFunc("/topN", methodGuard(http.MethodGet, service.GetTopN))
 	mux.HandleFunc("/topAll", methodGuard(http.MethodGet, service.GetTopAll))
+	mux.HandleFunc("/rank", methodGuard(http.MethodGet, service.GetRank))
+	mux.HandleFunc("/trending", methodGuard(http.MethodGet, service.GetTrending))
+	mux.HandleFunc("/walStats", methodGuard(http.MethodGet, service.GetWalStats))
+	mux.HandleFunc("/status", methodGuard(http.MethodGet, service.GetStatus))
 
-	mux.HandleFunc("/upload", methodGuard(http.MethodPost, service.UploadFile))
+	mux.HandleFunc("/upload", methodGuard(http.MethodPost, writeGuard(service.UploadFile)))
 	mux.HandleFunc("/download", methodGuard(http.MethodGet, service.DownloadFile))
-	mux.HandleFunc("/delete", methodGuard(http.MethodDelete, service.DeleteFile))
+	mux.HandleFunc("/delete", methodGuard(http.MethodDelete, writeGuard(service.DeleteFile)))
 	mux.HandleFunc("/all", methodGuard(http.MethodGet, service.GetAllFile))
+	mux.HandleFunc("/files", methodGuard(http.MethodGet, service.SearchFiles))
+	mux.HandleFunc("/files/", methodGuard(http.MethodGet, service.GetFile))
+
+	mux.HandleFunc("/admin/maintenance", methodGuard(http.MethodPost, adminGuard(service.AdminMaintenance)))
+	mux.HandleFunc("/admin/snapshot", methodGuard(http.MethodPost, adminGuard(service.AdminSnapshot)))
+	mux.HandleFunc("/admin/backup", methodGuard(http.MethodGet, adminGuard(service.AdminBackup)))
+	mux.HandleFunc("/admin/restore", methodGuard(http.MethodPost, adminGuard(service.AdminRestore)))
+	mux.HandleFunc("/replication/stream", methodGuard(http.MethodGet, adminGuard(service.ReplicationStream)))
+	mux.HandleFunc("/replication/file", methodGuard(http.MethodGet, adminGuard(service.ReplicationFile)))
 
 	srv := &http.Server{
-		Addr:    ":8080",
+		Addr:    addr,
 		Handler: mux,
 	}
 	return srv
@@ -51,3 +68,37 @@ func methodGuard(allowedMethod string, handler http.HandlerFunc) http.HandlerFun
 			system.ResSuccess("Method not allowed. Allowed methods " + allowedMethod))
 	}
 }
+
+// adminGuard 校验管理接口的令牌，令牌从环境变量读取，未设置时拒绝全部管理请求
+func adminGuard(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := os.Getenv(config.AdminTokenEnv)
+		auth := r.Header.Get("Authorization")
+		if token == "" || subtle.ConstantTimeCompare([]byte(auth), []byte("Bearer "+token)) != 1 {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusUnauthorized)
+			_ = json.NewEncoder(w).Encode(system.ResFailed("未授权"))
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// writeGuard 维护模式下及从节点拒绝写入请求
+func writeGuard(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if service.InMaintenance() {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_ = json.NewEncoder(w).Encode(system.ResFailed("维护模式，暂停写入"))
+			return
+		}
+		if system.RankEngine().Following() {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusForbidden)
+			_ = json.NewEncoder(w).Encode(system.ResFailed("只读从节点，不接受写入"))
+			return
+		}
+		handler(w, r)
+	}
+}
@@ -0,0 +1,542 @@
+// fileclick-tool 离线检查和修复WAL与RDB文件，无需启动服务
+//
+// 用法:
+//
+//	fileclick-tool wal dump [-dir 目录] [段文件...]
+//	fileclick-tool wal verify [-dir 目录] [段文件...]
+//	fileclick-tool wal truncate-corrupt [-dir 目录] [段文件...]
+//	fileclick-tool rdb dump [-dir 目录] [--json] [RDB文件]
+//	fileclick-tool rdb verify [-dir 目录] [RDB文件...]
+//	fileclick-tool rdb diff a.rdb b.rdb
+//	fileclick-tool rdb compact [-dir 目录]
+//	fileclick-tool backup restore 备份文件
+//	fileclick-tool key gen [-id 密钥ID]
+//	fileclick-tool key rekey [-wal 目录] [-rdb 目录]
+//
+// 未指定文件时处理目录中的全部段文件；rdb dump 默认读取最新的基准快照并合并其增量快照。
+// rdb compact 将增量快照合并为新的基准快照，只能在服务停止时执行。
+// backup restore 在服务的工作目录中执行，用 /admin/backup 导出的备份替换数据文件，只能在服务停止时执行。
+// 设置了 FILECLICK_KEY_FILE 时使用其中的密钥读写加密的文件。key gen 输出一行可追加到密钥文件的新密钥；
+// key rekey 用密钥文件中最后一个密钥重新加密全部段文件和快照，轮换密钥后旧密钥不再需要，只能在服务停止时执行。
+// 发现损坏或差异时退出码为1，参数错误时为2。
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fileClick/config"
+	"fileClick/system"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+func main() {
+	if len(os.Args) < 3 {
+		usage()
+	}
+	if path := os.Getenv(config.KeyFileEnv); path != "" {
+		keyring, err := system.LoadKeyring(path)
+		if err != nil {
+			fatal(err)
+		}
+		system.UseKeyring(keyring)
+	}
+	var code int
+	switch os.Args[1] + " " + os.Args[2] {
+	case "wal dump":
+		code = walDump(os.Args[3:])
+	case "wal verify":
+		code = walVerify(os.Args[3:])
+	case "wal truncate-corrupt":
+		code = walTruncate(os.Args[3:])
+	case "rdb dump":
+		code = rdbDump(os.Args[3:])
+	case "rdb verify":
+		code = rdbVerify(os.Args[3:])
+	case "rdb diff":
+		code = rdbDiff(os.Args[3:])
+	case "rdb compact":
+		code = rdbCompact(os.Args[3:])
+	case "backup restore":
+		code = backupRestore(os.Args[3:])
+	case "key gen":
+		code = keyGen(os.Args[3:])
+	case "key rekey":
+		code = keyRekey(os.Args[3:])
+	default:
+		usage()
+	}
+	os.Exit(code)
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, `usage:
+  fileclick-tool wal dump [-dir dir] [segment...]
+  fileclick-tool wal verify [-dir dir] [segment...]
+  fileclick-tool wal truncate-corrupt [-dir dir] [segment...]
+  fileclick-tool rdb dump [-dir dir] [--json] [file]
+  fileclick-tool rdb verify [-dir dir] [file...]
+  fileclick-tool rdb diff a.rdb b.rdb
+  fileclick-tool rdb compact [-dir dir]
+  fileclick-tool backup restore archive
+  fileclick-tool key gen [-id id]
+  fileclick-tool key rekey [-wal dir] [-rdb dir]`)
+	os.Exit(2)
+}
+
+// walSegments 解析参数，返回指定的段文件或目录中的全部段文件
+func walSegments(name string, args []string) []string {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	dir := fs.String("dir", config.WalPath, "WAL目录")
+	_ = fs.Parse(args)
+	if fs.NArg() > 0 {
+		return fs.Args()
+	}
+	segments, err := system.ListWalSegments(*dir)
+	if err != nil {
+		fatal(err)
+	}
+	paths := make([]string, len(segments))
+	for i, seg := range segments {
+		paths[i] = seg.Path
+	}
+	return paths
+}
+
+// walDump 输出段文件中的每条记录
+func walDump(args []string) int {
+	code := 0
+	for _, path := range walSegments("wal dump", args) {
+		res, err := system.ScanWalSegment(path, func(offset int64, rec *system.WalRecord) error {
+			board := rec.Board
+			if board == "" {
+				board = config.DefaultBoard
+			}
+			fmt.Printf("%s@%d lsn=%d op=%s board=%s file=%d ts=%d type=%s count=%d visitor=%x\n",
+				filepath.Base(path), offset, rec.Lsn, rec.Op, board, rec.FileId, rec.Ts, rec.Type, rec.Count, rec.Visitor)
+			return nil
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+			code = 1
+			continue
+		}
+		if res.Err != nil {
+			fmt.Printf("%s@%d !! %v\n", filepath.Base(path), res.ValidSize, res.Err)
+			code = 1
+		}
+	}
+	return code
+}
+
+// walVerify 校验段文件，输出损坏的段文件和偏移
+func walVerify(args []string) int {
+	code := 0
+	for _, path := range walSegments("wal verify", args) {
+		var lastLsn uint64
+		var lsnErr error
+		res, err := system.ScanWalSegment(path, func(offset int64, rec *system.WalRecord) error {
+			// 版本3起同一段文件内LSN严格递增
+			if rec.Lsn != 0 && rec.Lsn <= lastLsn && lsnErr == nil {
+				lsnErr = fmt.Errorf("lsn %d not increasing at offset %d", rec.Lsn, offset)
+			}
+			lastLsn = rec.Lsn
+			return nil
+		})
+		switch {
+		case err != nil:
+			fmt.Printf("ERROR     %s: %v\n", path, err)
+			code = 1
+		case errors.Is(res.Err, system.ErrWalTruncated):
+			fmt.Printf("TRUNCATED %s: version=%d records=%d offset=%d, %d bytes incomplete\n",
+				path, res.Version, res.Records, res.ValidSize, res.Size-res.ValidSize)
+			code = 1
+		case res.Err != nil:
+			fmt.Printf("CORRUPT   %s: version=%d records=%d offset=%d: %v, %d bytes unreadable\n",
+				path, res.Version, res.Records, res.ValidSize, res.Err, res.Size-res.ValidSize)
+			code = 1
+		case lsnErr != nil:
+			fmt.Printf("CORRUPT   %s: %v\n", path, lsnErr)
+			code = 1
+		default:
+			fmt.Printf("OK        %s: version=%d baseLsn=%d keyId=%d records=%d size=%d\n",
+				path, res.Version, res.BaseLsn, res.KeyId, res.Records, res.Size)
+		}
+	}
+	return code
+}
+
+// walTruncate 将损坏的段文件截断到最后一条完整记录之后，原文件备份为 .corrupt
+func walTruncate(args []string) int {
+	code := 0
+	for _, path := range walSegments("wal truncate-corrupt", args) {
+		res, err := system.ScanWalSegment(path, nil)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+			code = 1
+			continue
+		}
+		if res.Err == nil {
+			continue
+		}
+		if err := copyFile(path, path+".corrupt"); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: backup failed: %v\n", path, err)
+			code = 1
+			continue
+		}
+		n, err := system.TruncateWalSegment(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+			code = 1
+			continue
+		}
+		fmt.Printf("truncated %s at offset %d (%v), dropped %d bytes, backup %s.corrupt\n",
+			path, res.ValidSize, res.Err, n, path)
+	}
+	return code
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		_ = out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		_ = out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// rdbFiles 列出目录中的全部基准快照和增量快照
+func rdbFiles(dir string) []string {
+	matches, _ := filepath.Glob(filepath.Join(dir, "*.rdb"))
+	sort.Strings(matches)
+	return matches
+}
+
+// rdbDump 输出快照内容
+func rdbDump(args []string) int {
+	fs := flag.NewFlagSet("rdb dump", flag.ExitOnError)
+	dir := fs.String("dir", config.RdbPath, "RDB目录")
+	asJSON := fs.Bool("json", false, "以JSON格式输出")
+	_ = fs.Parse(args)
+
+	var ld *system.RdbLoadResult
+	var err error
+	if path := fs.Arg(0); path != "" {
+		ld, err = system.ReadRdbFile(path)
+	} else {
+		ld, err = system.NewRDBWithDir(*dir).LoadLatest()
+		if err == nil && ld.Path == "" {
+			err = fmt.Errorf("no rdb file in %s", *dir)
+		}
+	}
+	if err != nil {
+		fatal(err)
+	}
+
+	view := newRdbView(ld)
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(view)
+		return 0
+	}
+	fmt.Printf("file: %s\nformat: RDB%d\nkeyId: %d\ndeltas: %d\nsnapshotTs: %d (%s)\nlsns: %v\n", view.Path, view.Format,
+		view.KeyId, len(view.Deltas), view.SnapshotTs, time.Unix(view.SnapshotTs, 0).Format(time.RFC3339), view.Lsns)
+	for _, board := range view.Boards {
+		fmt.Printf("board %s: %d files, %d window, %d trending\n",
+			board.Name, len(board.Files), len(board.Windows), len(board.Trending))
+		for i, f := range board.Files {
+			fmt.Printf("  #%d id=%d name=%s count=%d unique=%d", i+1, f.Id, f.FileName, f.Count, f.Unique)
+			if meta := board.Meta[f.Id]; meta != nil {
+				fmt.Printf(" size=%d uploadTs=%d sha256=%s", meta.Size, meta.UploadTs, meta.Sha256)
+			}
+			fmt.Println()
+		}
+	}
+	return 0
+}
+
+// rdbView 快照的可读视图，访客草图只输出估计值
+type rdbView struct {
+	Path       string          `json:"path"`
+	Format     int             `json:"format"`
+	KeyId      uint32          `json:"keyId,omitempty"`
+	Deltas     []string        `json:"deltas,omitempty"`
+	SnapshotTs int64           `json:"snapshotTs"`
+	Lsns       []uint64        `json:"lsns"`
+	Boards     []*rdbBoardView `json:"boards"`
+}
+
+type rdbBoardView struct {
+	Name     string                         `json:"name"`
+	Files    []*system.File                 `json:"files"`
+	Windows  []*system.WindowEntry          `json:"windows"`
+	Trending []*system.TrendingEntry        `json:"trending"`
+	Meta     map[uint64]*system.RdbFileMeta `json:"meta,omitempty"`
+	Deleted  []uint64                       `json:"deleted,omitempty"`
+}
+
+func newRdbView(ld *system.RdbLoadResult) *rdbView {
+	view := &rdbView{Path: ld.Path, Format: ld.Format, KeyId: ld.KeyId, Deltas: ld.Deltas, SnapshotTs: ld.SnapshotTs, Lsns: ld.Lsns}
+	for _, board := range ld.Boards {
+		unique := make(map[uint64]uint64, len(board.Unique))
+		for _, entry := range board.Unique {
+			unique[entry.Id] = entry.Estimate()
+		}
+		events := make(map[uint64]*system.EventCounts, len(board.Events))
+		for _, entry := range board.Events {
+			counts := entry.Counts
+			events[entry.Id] = &counts
+		}
+		files := make([]*system.File, len(board.Files))
+		for i, f := range board.Files {
+			file := *f
+			file.Unique = unique[f.Id]
+			file.Events = events[f.Id]
+			files[i] = &file
+		}
+		view.Boards = append(view.Boards, &rdbBoardView{
+			Name:     board.Name,
+			Files:    files,
+			Windows:  board.Windows,
+			Trending: board.Trending,
+			Meta:     board.Meta,
+			Deleted:  board.Deleted,
+		})
+	}
+	return view
+}
+
+// rdbVerify 校验快照的CRC和格式
+func rdbVerify(args []string) int {
+	fs := flag.NewFlagSet("rdb verify", flag.ExitOnError)
+	dir := fs.String("dir", config.RdbPath, "RDB目录")
+	_ = fs.Parse(args)
+
+	files := fs.Args()
+	if len(files) == 0 {
+		files = rdbFiles(*dir)
+	}
+	code := 0
+	for _, path := range files {
+		ld, err := system.ReadRdbFile(path)
+		if errors.Is(err, system.ErrKeyNotFound) {
+			fmt.Printf("ERROR   %s: %v\n", path, err)
+			code = 1
+			continue
+		}
+		if err != nil {
+			fmt.Printf("CORRUPT %s: %v\n", path, err)
+			code = 1
+			continue
+		}
+		n := 0
+		for _, board := range ld.Boards {
+			n += len(board.Files)
+		}
+		fmt.Printf("OK      %s: format=RDB%d keyId=%d snapshotTs=%d boards=%d files=%d lsns=%v\n", path, ld.Format, ld.KeyId, ld.SnapshotTs, len(ld.Boards), n, ld.Lsns)
+	}
+	return code
+}
+
+// rdbDiff 比较两个快照中各排行榜的文件和分值
+func rdbDiff(args []string) int {
+	if len(args) != 2 {
+		usage()
+	}
+	a, err := system.ReadRdbFile(args[0])
+	if err != nil {
+		fatal(err)
+	}
+	b, err := system.ReadRdbFile(args[1])
+	if err != nil {
+		fatal(err)
+	}
+
+	diffs := 0
+	if fmt.Sprint(a.Lsns) != fmt.Sprint(b.Lsns) {
+		fmt.Printf("lsns: %v -> %v\n", a.Lsns, b.Lsns)
+		diffs++
+	}
+	boardsA, boardsB := boardFiles(a), boardFiles(b)
+	for _, name := range unionKeys(boardsA, boardsB) {
+		filesA, inA := boardsA[name]
+		filesB, inB := boardsB[name]
+		if !inA || !inB {
+			only := args[0]
+			if inB {
+				only = args[1]
+			}
+			fmt.Printf("board %s: only in %s\n", name, only)
+			diffs++
+			continue
+		}
+		ids := make([]uint64, 0, len(filesA)+len(filesB))
+		for id := range filesA {
+			ids = append(ids, id)
+		}
+		for id := range filesB {
+			if _, exists := filesA[id]; !exists {
+				ids = append(ids, id)
+			}
+		}
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+		for _, id := range ids {
+			fa, fb := filesA[id], filesB[id]
+			switch {
+			case fb == nil:
+				fmt.Printf("board %s: - file %d (%s) count=%d\n", name, id, fa.FileName, fa.Count)
+			case fa == nil:
+				fmt.Printf("board %s: + file %d (%s) count=%d\n", name, id, fb.FileName, fb.Count)
+			case fa.Count != fb.Count:
+				fmt.Printf("board %s: ~ file %d (%s) count %d -> %d\n", name, id, fa.FileName, fa.Count, fb.Count)
+			default:
+				continue
+			}
+			diffs++
+		}
+	}
+	if diffs > 0 {
+		return 1
+	}
+	return 0
+}
+
+// rdbCompact 将最新的基准快照及其增量快照合并为新的基准快照
+func rdbCompact(args []string) int {
+	fs := flag.NewFlagSet("rdb compact", flag.ExitOnError)
+	dir := fs.String("dir", config.RdbPath, "RDB目录")
+	_ = fs.Parse(args)
+
+	path, err := system.NewRDBWithDir(*dir).Compact()
+	if err != nil {
+		fatal(err)
+	}
+	fmt.Printf("base: %s\n", path)
+	return 0
+}
+
+// backupRestore 用备份替换当前目录下的数据文件，原数据文件移动到恢复目录
+func backupRestore(args []string) int {
+	if len(args) != 1 {
+		usage()
+	}
+	f, err := os.Open(args[0])
+	if err != nil {
+		fatal(err)
+	}
+	defer f.Close()
+
+	old, err := system.RestoreFiles(f)
+	if err != nil {
+		fatal(err)
+	}
+	fmt.Printf("restored, previous data: %s\n", old)
+	return 0
+}
+
+// keyGen 生成随机的AES-256密钥，输出密钥文件中的一行
+func keyGen(args []string) int {
+	fs := flag.NewFlagSet("key gen", flag.ExitOnError)
+	id := fs.Uint("id", 1, "密钥ID，轮换时使用比现有密钥更大的ID")
+	_ = fs.Parse(args)
+	if *id == 0 || *id > math.MaxUint32 {
+		usage()
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		fatal(err)
+	}
+	fmt.Printf("%d %s\n", *id, hex.EncodeToString(key))
+	return 0
+}
+
+// keyRekey 用当前密钥重新加密全部段文件和快照，损坏的段文件需先用 wal truncate-corrupt 修复
+func keyRekey(args []string) int {
+	fs := flag.NewFlagSet("key rekey", flag.ExitOnError)
+	walDir := fs.String("wal", config.WalPath, "WAL目录")
+	rdbDir := fs.String("rdb", config.RdbPath, "RDB目录")
+	_ = fs.Parse(args)
+	if os.Getenv(config.KeyFileEnv) == "" {
+		fatal(fmt.Errorf("%s not set", config.KeyFileEnv))
+	}
+
+	segments, err := system.ListWalSegments(*walDir)
+	if err != nil {
+		fatal(err)
+	}
+	code := 0
+	for _, seg := range segments {
+		code |= rekeyOne(seg.Path, system.RekeyWalSegment)
+	}
+	for _, path := range rdbFiles(*rdbDir) {
+		code |= rekeyOne(path, system.RekeyRdbFile)
+	}
+	return code
+}
+
+func rekeyOne(path string, rekey func(path string) (bool, error)) int {
+	changed, err := rekey(path)
+	switch {
+	case err != nil:
+		fmt.Printf("ERROR     %s: %v\n", path, err)
+		return 1
+	case changed:
+		fmt.Printf("REKEYED   %s\n", path)
+	default:
+		fmt.Printf("UNCHANGED %s\n", path)
+	}
+	return 0
+}
+
+// boardFiles 按排行榜名称和文件ID索引快照中的文件
+func boardFiles(ld *system.RdbLoadResult) map[string]map[uint64]*system.File {
+	boards := make(map[string]map[uint64]*system.File, len(ld.Boards))
+	for _, board := range ld.Boards {
+		files := make(map[uint64]*system.File, len(board.Files))
+		for _, f := range board.Files {
+			files[f.Id] = f
+		}
+		boards[board.Name] = files
+	}
+	return boards
+}
+
+func unionKeys(a, b map[string]map[uint64]*system.File) []string {
+	keys := make([]string, 0, len(a)+len(b))
+	for k := range a {
+		keys = append(keys, k)
+	}
+	for k := range b {
+		if _, exists := a[k]; !exists {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
+}
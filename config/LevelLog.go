@@ -15,34 +15,32 @@ const (
 	LevelError = "ERROR"
 )
 
-// 初始化不同的日志输出器，输出到文件
+// 初始化不同的日志输出器，Init之前输出到标准错误，之后输出到文件
 var (
-	// 调试日志：输出到文件
-	debugLog *log.Logger
-	// 信息日志：输出到文件
-	infoLog *log.Logger
-	// 警告日志：输出到文件
-	warnLog *log.Logger
-	// 错误日志：输出到文件
-	errorLog *log.Logger
+	// 调试日志
+	debugLog = log.New(os.Stderr, LevelDebug+" ", log.Ldate|log.Ltime|log.Lshortfile)
+	// 信息日志
+	infoLog = log.New(os.Stderr, LevelInfo+" ", log.Ldate|log.Ltime|log.Lshortfile)
+	// 警告日志
+	warnLog = log.New(os.Stderr, LevelWarn+" ", log.Ldate|log.Ltime|log.Lshortfile)
+	// 错误日志
+	errorLog = log.New(os.Stderr, LevelError+" ", log.Ldate|log.Ltime|log.Lshortfile)
 )
 
-func init() {
+// initLog 创建或追加写入日志文件，之后的日志都输出到该文件
+func initLog() error {
 	err := os.MkdirAll(LogPath, os.ModePerm)
 	if err != nil {
-		panic("mkdir failed")
+		return err
 	}
-	// 创建或追加写入日志文件
 	file, err := os.OpenFile(LogPath+"app.log", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
 	if err != nil {
-		log.Fatal("Failed to open log file:", err)
+		return err
 	}
-
-	// 初始化不同的日志记录器，启用调用者信息
-	debugLog = log.New(file, LevelDebug+" ", log.Ldate|log.Ltime|log.Lshortfile)
-	infoLog = log.New(file, LevelInfo+" ", log.Ldate|log.Ltime|log.Lshortfile)
-	warnLog = log.New(file, LevelWarn+" ", log.Ldate|log.Ltime|log.Lshortfile)
-	errorLog = log.New(file, LevelError+" ", log.Ldate|log.Ltime|log.Lshortfile)
+	for _, l := range []*log.Logger{debugLog, infoLog, warnLog, errorLog} {
+		l.SetOutput(file)
+	}
+	return nil
 }
 
 // getCallerInfo 获取调用者信息
@@ -13,24 +13,100 @@ const (
 	RdbPath       = "data/system/rdb/"
 	RdbShotEvery  = time.Minute * 5
 	FilePath      = "data/files/"
-	FileInfoPath  = "data/fileInfo.json"
+	FileInfoPath  = "data/fileInfo.json" // 旧版本的文件信息，启动时迁移到 MetaPath
+	MetaPath      = "data/meta/"
 	FileMaxSize   = 32 << 20
 	LogPath       = "data/logs/"
 	FileEventMax  = 10000
+	// RdbCompress 快照中各命名空间的数据块是否使用flate压缩
+	RdbCompress = true
+	// RdbDeltaMax 两次基准快照之间最多保存的增量快照数，达到后合并为新的基准快照，0表示只保存全量快照
+	RdbDeltaMax = 12
+	// RdbHistoryRetention 基准快照及其之后的WAL的保留时长，保留期内可按时间点查询排行榜，0表示只保留 RdbMaxFileNum 个快照
+	// 保留期内的WAL不会被清理，会随点击量持续增长，需要时再开启
+	RdbHistoryRetention = time.Duration(0)
+	// HistoryRebuildMax 同时重建的历史排行榜数，每次重建都要加载快照并回放WAL
+	HistoryRebuildMax = 2
+	// AdminTokenEnv 管理接口令牌的环境变量，请求头需带 Authorization: Bearer <令牌>，未设置时管理接口不可用
+	AdminTokenEnv = "FILECLICK_ADMIN_TOKEN"
+	// MetaCompactMin 文件信息日志中失效记录超过该数量且多于有效记录时压缩
+	MetaCompactMin = 1000
+	// KeyFileEnv 密钥文件路径的环境变量，设置后新写入的WAL段文件和快照使用文件中最后一个密钥加密
+	KeyFileEnv = "FILECLICK_KEY_FILE"
+	// RestorePath 恢复备份时暂存解压的文件并保存被替换的原数据文件
+	RestorePath = "data/restore/"
+	// ReplBuffer 每个复制流缓冲的WAL记录数，从节点消费过慢导致缓冲区满时断开，重连后全量同步
+	ReplBuffer = 100000
+	// ReplHeartbeat 复制流心跳间隔，心跳中带有主节点各WAL线程的LSN，用于计算复制延迟
+	ReplHeartbeat = time.Second
+	// ReplTimeout 从节点超过该时间没有收到复制流的数据时断开重连
+	ReplTimeout = time.Second * 10
+	// ReplFileQueue 从节点待拉取文件内容的队列长度，队列满时跳过，下次全量同步时重新加入
+	ReplFileQueue = 10000
+	// ReplRetryInterval 从节点复制流断开后的重连间隔
+	ReplRetryInterval = time.Second
+	// ClickBatchMax 单次批量上报的最大点击条数
+	ClickBatchMax = 1000
+	// ClickCountMax 批量上报中单条点击的最大次数
+	ClickCountMax = 1000000
+	// ClickTsSkew 批量上报中点击时间戳最多晚于当前时间的时长
+	ClickTsSkew = time.Minute
+	// DefaultBoard 未指定命名空间时使用的排行榜
+	DefaultBoard = "default"
+	// MaxBoards 排行榜数量上限，每个排行榜有独立的写入协程和事件队列，超过上限后不再接受新命名空间的写入
+	MaxBoards = 64
+	// TrendingHalfLife 热度排行榜中点击权重的半衰期
+	TrendingHalfLife = time.Hour * 6
+	// RankingType 排行榜数据结构: skiplist（跳表）或 lru（双向链表）
+	// 排名和分页查询依赖跳表，选择lru时每个排行榜另外维护一个跳表索引，每次点击更新两份结构
+	RankingType = RankingSkipList
+	// RankPageLimit 排行榜分页默认条数
+	RankPageLimit = 100
+	// RankPageMaxLimit 排行榜分页最大条数
+	RankPageMaxLimit = 1000
+	// FilePageLimit 文件查询分页默认条数
+	FilePageLimit = 50
+	// FilePageMaxLimit 文件查询分页最大条数
+	FilePageMaxLimit = 1000
+	// FileSearchWindow 文件查询按名称以外的方式排序时offset+limit的上限，查询只保留这么多个候选
+	FileSearchWindow = 10000
+	// WalFsync WAL刷盘策略: always（每次写入刷盘）、batch（组提交）或 everysec（每秒刷盘）
+	WalFsync = WalFsyncAlways
+	// WalBatchRecords batch策略下累计多少条记录刷盘一次
+	WalBatchRecords = 256
+	// WalBatchInterval batch策略下未刷盘记录的最长等待时间
+	WalBatchInterval = time.Millisecond * 5
 )
 
-func init() {
-	var err error
-	err = os.MkdirAll(WalPath, os.ModePerm)
-	if err != nil {
-		panic("mkdir failed")
-	}
-	err = os.MkdirAll(RdbPath, os.ModePerm)
-	if err != nil {
-		panic("mkdir failed")
-	}
-	err = os.MkdirAll(FilePath, os.ModePerm)
-	if err != nil {
-		panic("mkdir failed")
+// EventWeights 各类型事件计入排行榜分值的权重
+var EventWeights = map[string]uint64{
+	"click":    1,
+	"view":     1,
+	"download": 3,
+	"like":     5,
+	"share":    8,
+}
+
+// 排行榜数据结构类型
+const (
+	RankingLRU      = "lru"
+	RankingSkipList = "skiplist"
+)
+
+// WAL刷盘策略
+const (
+	WalFsyncAlways   = "always"
+	WalFsyncBatch    = "batch"
+	WalFsyncEverySec = "everysec"
+)
+
+// Init 创建服务使用的数据目录并将日志写入日志文件，只由服务启动时调用，
+// 离线工具和测试引用本包时不会在当前目录下创建数据文件
+func Init() error {
+	for _, dir := range []string{WalPath, RdbPath, FilePath} {
+		if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+			return err
+		}
 	}
+	return initLog()
 }
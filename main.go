@@ -6,31 +6,60 @@ import (
 	"fileClick/api"
 	"fileClick/config"
 	"fileClick/system"
+	"flag"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 )
 
 func main() {
-	// 1. 初始化 Engine
-	var err error
-	system.RankEngine, err = system.NewEngine()
+	addr := flag.String("addr", ":8080", "HTTP监听地址")
+	follow := flag.String("follow", "", "主节点地址（如 http://primary:8080），指定后作为只读从节点复制主节点的数据")
+	flag.Parse()
+
+	// 0. 创建数据目录和日志文件
+	if err := config.Init(); err != nil {
+		config.Error("init data dir failed: " + err.Error())
+		os.Exit(1)
+	}
+
+	// 1. 加载密钥并初始化 Engine
+	if path := os.Getenv(config.KeyFileEnv); path != "" {
+		keyring, err := system.LoadKeyring(path)
+		if err != nil {
+			config.Error("load key file failed: " + err.Error())
+			os.Exit(1)
+		}
+		system.UseKeyring(keyring)
+		config.Info("WAL和快照已启用加密")
+	}
+	engine, err := system.NewEngine()
 	if err != nil {
 		config.Error("init engine failed: %v", err)
+		os.Exit(1)
 	}
+	system.SetRankEngine(engine)
 
-	// 2. 数据恢复
-	if err := system.RankEngine.Recover(); err != nil {
+	// 2. 数据恢复，缺少密钥时退出，避免之后的快照覆盖无法读取的数据
+	if err := system.RankEngine().Recover(); err != nil {
 		config.Error("recover failed: %v", err)
+		if errors.Is(err, system.ErrKeyNotFound) {
+			os.Exit(1)
+		}
 	}
 
-	// 3.启动后台调度器
-	system.RankEngine.StartScheduler()
+	// 3.启动后台调度器，从节点同时开始复制主节点的数据
+	system.RankEngine().StartScheduler()
+	if *follow != "" {
+		system.RankEngine().Follow(strings.TrimSuffix(*follow, "/"), os.Getenv(config.AdminTokenEnv))
+		config.Info("作为从节点复制: " + *follow)
+	}
 
 	// 4.配置HTTP路由
-	webSever := api.InitRouter()
+	webSever := api.InitRouter(*addr)
 
 	// 5. 优雅退出
 	go func() {
@@ -39,7 +68,7 @@ func main() {
 		<-stop
 		config.Info("Shutting down HTTP server...")
 		// 停止 Engine
-		system.RankEngine.Stop()
+		system.RankEngine().Stop()
 		config.Info("Engine stopped")
 
 		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
@@ -49,7 +78,7 @@ func main() {
 	}()
 
 	// 6.启动Http服务
-	config.Info("HTTP server started at :8080")
+	config.Info("HTTP server started at " + *addr)
 	if err := webSever.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
 		config.Error("http listen failed: %v", err)
 	}
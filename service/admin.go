@@ -0,0 +1,103 @@
+package service
+
+import (
+	"encoding/json"
+	"fileClick/config"
+	"fileClick/system"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	maintenance atomic.Bool // 维护模式下拒绝点击、上传和删除，只读接口照常服务
+	restoreMu   sync.Mutex  // 同一时刻只允许一个恢复请求
+)
+
+// InMaintenance 是否处于维护模式
+func InMaintenance() bool {
+	return maintenance.Load()
+}
+
+// AdminMaintenance 开启或关闭维护模式，enable为true或false
+func AdminMaintenance(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enable, err := strconv.ParseBool(r.URL.Query().Get("enable"))
+	if err != nil {
+		_ = json.NewEncoder(w).Encode(system.ResFailed("enable只能为true或false"))
+		return
+	}
+	maintenance.Store(enable)
+	config.Info(fmt.Sprintf("维护模式: %v", enable))
+	_ = json.NewEncoder(w).Encode(system.ResSuccess(map[string]bool{"maintenance": enable}))
+}
+
+// AdminSnapshot 立即保存快照并清理WAL
+func AdminSnapshot(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := system.RankEngine().Snapshot(); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		_ = json.NewEncoder(w).Encode(system.ResFailed("保存快照失败: " + err.Error()))
+		return
+	}
+	_ = json.NewEncoder(w).Encode(system.ResSuccess(nil))
+}
+
+// AdminBackup 先保存快照，再以tar.gz流式返回最新快照、WAL段文件、文件信息和上传的文件
+func AdminBackup(w http.ResponseWriter, r *http.Request) {
+	// 先保存快照，恢复时需要回放的WAL尽量少
+	if err := system.RankEngine().Snapshot(); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		_ = json.NewEncoder(w).Encode(system.ResFailed("保存快照失败: " + err.Error()))
+		return
+	}
+
+	name := fmt.Sprintf("fileclick-backup-%d.tar.gz", time.Now().Unix())
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", "attachment; filename="+name)
+	// 归档边读边写，开始写入后无法再返回错误响应，客户端会收到不完整的归档
+	if err := system.RankEngine().Backup(w); err != nil {
+		config.Error("备份失败: " + err.Error())
+	}
+}
+
+// AdminRestore 从请求体中的tar.gz备份恢复数据，只能在维护模式下执行，原数据文件保留在恢复目录中
+func AdminRestore(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if !InMaintenance() {
+		w.WriteHeader(http.StatusConflict)
+		_ = json.NewEncoder(w).Encode(system.ResFailed("请先开启维护模式"))
+		return
+	}
+	if !restoreMu.TryLock() {
+		w.WriteHeader(http.StatusConflict)
+		_ = json.NewEncoder(w).Encode(system.ResFailed("正在恢复备份"))
+		return
+	}
+	defer restoreMu.Unlock()
+	// 恢复后的新引擎不再复制主节点，从节点应重新全量同步而不是恢复备份
+	if system.RankEngine().Following() {
+		w.WriteHeader(http.StatusForbidden)
+		_ = json.NewEncoder(w).Encode(system.ResFailed("从节点不支持恢复备份"))
+		return
+	}
+
+	engine, old, err := system.RankEngine().Restore(r.Body)
+	if engine != nil {
+		system.SetRankEngine(engine)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		_ = json.NewEncoder(w).Encode(system.ResFailed("恢复备份失败: " + err.Error()))
+		return
+	}
+	config.Info("已从备份恢复数据，原数据文件保存在: " + old)
+	_ = json.NewEncoder(w).Encode(system.ResSuccess(map[string]interface{}{
+		"previous": old,
+		"recovery": engine.Status().Recovery,
+	}))
+}
@@ -1,7 +1,11 @@
 package service
 
 import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fileClick/config"
 	"fileClick/system"
 	"fileClick/util"
@@ -10,6 +14,7 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // UploadFile 上传文件
@@ -44,19 +49,34 @@ func UploadFile(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	defer dst.Close()
-	// 4.复制文件内容
-	_, err = io.Copy(dst, file)
+	// 4.按开头的内容识别文件类型，复制文件内容，同时计算SHA-256
+	br := bufio.NewReaderSize(file, 512)
+	head, _ := br.Peek(512)
+	mimeType := http.DetectContentType(head)
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(dst, hash), br)
 	if err != nil {
+		_ = os.Remove(filepath)
 		_ = json.NewEncoder(w).Encode(system.ResFailed("保存文件失败: " + err.Error()))
 		return
 	}
 
-	// 5.维护数据json
-	err = system.AddFileToJSON(id, &system.FileInfo{
-		Name: sourceFileName, Path: filepath,
+	// 5.保存文件信息
+	err = system.AddFile(id, &system.FileInfo{
+		Name:     sourceFileName,
+		Path:     filepath,
+		UploadTs: time.Now().Unix(),
+		Size:     size,
+		Sha256:   hex.EncodeToString(hash.Sum(nil)),
+		MimeType: mimeType,
+		Uploader: getVisitor(r),
 	})
 	if err != nil {
-		panic("保存文件信息json失败！")
+		// 没有文件信息的文件无法访问，删除已保存的文件内容
+		_ = os.Remove(filepath)
+		w.WriteHeader(http.StatusInternalServerError)
+		_ = json.NewEncoder(w).Encode(system.ResFailed("保存文件信息失败: " + err.Error()))
+		return
 	}
 
 	// 6.返回成功响应
@@ -86,12 +106,82 @@ func DownloadFile(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// 设置下载响应头
-	w.Header().Set("Content-Type", "application/octet-stream")
+	// 从节点尚未从主节点拉取到文件内容时拒绝下载
+	if _, err := os.Stat(fileInfo.Path); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		msg := "文件内容不存在"
+		if system.RankEngine().Following() {
+			msg = "文件内容尚未从主节点同步"
+		}
+		_ = json.NewEncoder(w).Encode(system.ResFailed(msg))
+		return
+	}
+
+	// 设置下载响应头，旧版本上传的文件没有类型和校验和
+	contentType := fileInfo.MimeType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
 	w.Header().Set("Content-Disposition", "attachment; filename="+fileInfo.Name)
+	if fileInfo.Size > 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(fileInfo.Size, 10))
+	}
+	if fileInfo.Sha256 != "" {
+		w.Header().Set("ETag", `"`+fileInfo.Sha256+`"`)
+	}
+
+	// 返回文件内容，ServeFile按ETag处理条件请求，按范围请求修正Content-Length
+	sw := &statusWriter{ResponseWriter: w}
+	http.ServeFile(sw, r, fileInfo.Path)
 
-	// 返回文件内容
-	http.ServeFile(w, r, fileInfo.Path)
+	// 只有完整返回文件内容的下载计入下载事件，304、范围请求、出错和中途断开的不计
+	if sw.status != http.StatusOK || (fileInfo.Size > 0 && sw.written != fileInfo.Size) {
+		return
+	}
+	board, ok := getBoard(r)
+	if !ok {
+		board = config.DefaultBoard
+	}
+	// 统计失败不影响已完成的下载，异步写入WAL；从节点只读，下载不计入
+	err = system.RankEngine().Click(board, id, system.DownloadEvent, getVisitor(r), true)
+	if err != nil && !errors.Is(err, system.ErrReadOnly) {
+		config.Warn("记录下载事件失败: " + err.Error())
+	}
+}
+
+// statusWriter 记录响应状态码和写入的响应体字节数
+type statusWriter struct {
+	http.ResponseWriter
+	status  int
+	written int64
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.written += int64(n)
+	return n, err
+}
+
+// ReadFrom 保留底层连接的 sendfile 优化
+func (w *statusWriter) ReadFrom(r io.Reader) (int64, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := io.Copy(w.ResponseWriter, r)
+	w.written += n
+	return n, err
 }
 
 // DeleteFile 删除文件
@@ -112,7 +202,10 @@ func DeleteFile(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	// 删除排行榜记录
-	system.RankEngine.Delete(id)
+	if err := system.RankEngine().Delete(id); err != nil {
+		writeFailed(w, "删除排行榜记录失败: ", err)
+		return
+	}
 
 	// 读取文件信息
 	fileInfo, err := system.GetFileByID(id)
@@ -128,8 +221,8 @@ func DeleteFile(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// 从JSON文件中移除记录
-	err = system.RemoveFileFromJSON(id)
+	// 移除文件信息
+	err = system.RemoveFile(id)
 	if err != nil {
 		_ = json.NewEncoder(w).Encode(system.ResFailed("更新文件记录失败: " + err.Error()))
 		return
@@ -150,6 +243,98 @@ func GetAllFile(w http.ResponseWriter, r *http.Request) {
 	_ = json.NewEncoder(w).Encode(system.ResSuccess(files))
 }
 
+// GetFile 获取单个文件的信息，路径为 /files/{id}
+func GetFile(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	id, err := strconv.ParseUint(strings.TrimPrefix(r.URL.Path, "/files/"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		_ = json.NewEncoder(w).Encode(system.ResFailed("无效的文件ID"))
+		return
+	}
+	fileInfo, err := system.GetFileByID(id)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		_ = json.NewEncoder(w).Encode(system.ResFailed(err.Error()))
+		return
+	}
+	_ = json.NewEncoder(w).Encode(system.ResSuccess(&system.FileEntry{Id: id, FileInfo: *fileInfo}))
+}
+
+// SearchFiles 按文件名查询文件
+// q不区分大小写匹配名称子串，match=prefix时只匹配前缀；ext按扩展名过滤；minClicks按排行榜中的点击次数过滤；
+// sort可选 name、clicks、uploadTs、size；offset/limit分页，按名称以外的方式排序时offset+limit不超过 config.FileSearchWindow
+func SearchFiles(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	query := r.URL.Query()
+	q := &system.FileSearch{FileQuery: system.FileQuery{Q: query.Get("q"), Ext: query.Get("ext")}}
+	switch query.Get("match") {
+	case "", "substring":
+	case "prefix":
+		q.Prefix = true
+	default:
+		_ = json.NewEncoder(w).Encode(system.ResFailed("match只能为substring或prefix"))
+		return
+	}
+	sortBy := query.Get("sort")
+	if sortBy == "" {
+		sortBy = "name"
+	}
+	if _, ok := system.FileSorts[sortBy]; !ok {
+		_ = json.NewEncoder(w).Encode(system.ResFailed("sort只能为name、clicks、uploadTs或size"))
+		return
+	}
+	var minClicks uint64
+	if minStr := query.Get("minClicks"); minStr != "" {
+		var err error
+		if minClicks, err = strconv.ParseUint(minStr, 10, 64); err != nil {
+			_ = json.NewEncoder(w).Encode(system.ResFailed("minClicks必须为非负整数"))
+			return
+		}
+	}
+	board, ok := getBoard(r)
+	if !ok {
+		_ = json.NewEncoder(w).Encode(system.ResFailed("非法board"))
+		return
+	}
+	limit := config.FilePageLimit
+	if limitStr := query.Get("limit"); limitStr != "" {
+		var err error
+		limit, err = strconv.Atoi(limitStr)
+		if limit < 1 || limit > config.FilePageMaxLimit || err != nil {
+			_ = json.NewEncoder(w).Encode(system.ResFailed(
+				"limit必须为1到" + strconv.Itoa(config.FilePageMaxLimit) + "之间的整数"))
+			return
+		}
+	}
+	offset := 0
+	if offsetStr := query.Get("offset"); offsetStr != "" {
+		var err error
+		offset, err = strconv.Atoi(offsetStr)
+		if offset < 0 || err != nil {
+			_ = json.NewEncoder(w).Encode(system.ResFailed("offset必须为非负整数"))
+			return
+		}
+	}
+
+	if sortBy != "name" && offset > config.FileSearchWindow-limit {
+		_ = json.NewEncoder(w).Encode(system.ResFailed(
+			"按" + sortBy + "排序时offset+limit不能超过" + strconv.Itoa(config.FileSearchWindow)))
+		return
+	}
+	q.Board, q.MinClicks, q.Sort, q.Offset, q.Limit = board, minClicks, sortBy, offset, limit
+
+	page, err := system.RankEngine().SearchFiles(q)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		_ = json.NewEncoder(w).Encode(system.ResFailed("查询文件失败: " + err.Error()))
+		return
+	}
+	_ = json.NewEncoder(w).Encode(system.ResSuccess(page))
+}
+
 // getFileExtension 获取文件扩展名
 func getFileExtension(filename string) string {
 	lastDot := strings.LastIndex(filename, ".")
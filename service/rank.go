@@ -1,10 +1,16 @@
 package service
 
 import (
+	"encoding/base64"
+	"encoding/binary"
 	"encoding/json"
+	"errors"
+	"fileClick/config"
 	"fileClick/system"
+	"net"
 	"net/http"
 	"strconv"
+	"time"
 )
 
 func Click(w http.ResponseWriter, r *http.Request) {
@@ -18,12 +24,108 @@ func Click(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	board, ok := getBoard(r)
+	if !ok {
+		_ = json.NewEncoder(w).Encode(system.ResFailed("非法board"))
+		return
+	}
+	// 事件类型，默认为点击
+	typ := system.HitEvent
+	if typeStr := r.URL.Query().Get("type"); typeStr != "" {
+		if typ, ok = system.ParseEventType(typeStr); !ok {
+			_ = json.NewEncoder(w).Encode(system.ResFailed("type只能为click、view、download、like或share"))
+			return
+		}
+	}
+
+	// 默认等待WAL刷盘后再响应，durability=async 时写入WAL队列后立即响应
+	async := false
+	switch r.URL.Query().Get("durability") {
+	case "", "sync":
+	case "async":
+		async = true
+	default:
+		_ = json.NewEncoder(w).Encode(system.ResFailed("durability只能为sync或async"))
+		return
+	}
+
 	// 记录点击事件
-	system.RankEngine.Click(id)
+	if err := system.RankEngine().Click(board, id, typ, getVisitor(r), async); err != nil {
+		if errors.Is(err, system.ErrTooManyBoards) {
+			_ = json.NewEncoder(w).Encode(system.ResFailed("排行榜数量已达上限" + strconv.Itoa(config.MaxBoards)))
+			return
+		}
+		writeFailed(w, "记录点击失败: ", err)
+		return
+	}
 
 	_ = json.NewEncoder(w).Encode(system.ResSuccess(id))
 }
 
+// rejectedClick 批量上报中被拒绝的点击
+type rejectedClick struct {
+	Id     uint64 `json:"id"`
+	Reason string `json:"reason"`
+}
+
+// ClickBatch 批量上报点击，请求体为 [{id, count, ts}] 数组
+func ClickBatch(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var clicks []*system.BatchClick
+	if err := json.NewDecoder(r.Body).Decode(&clicks); err != nil {
+		_ = json.NewEncoder(w).Encode(system.ResFailed("解析请求体失败: " + err.Error()))
+		return
+	}
+	if len(clicks) > config.ClickBatchMax {
+		_ = json.NewEncoder(w).Encode(system.ResFailed(
+			"单次最多上报" + strconv.Itoa(config.ClickBatchMax) + "条点击"))
+		return
+	}
+
+	// 过滤非法点击，其余整批写入
+	maxTs := time.Now().Add(config.ClickTsSkew).Unix()
+	accepted := make([]*system.BatchClick, 0, len(clicks))
+	rejected := make([]*rejectedClick, 0)
+	for _, c := range clicks {
+		switch {
+		case c == nil:
+			continue
+		case c.Count < 1 || c.Count > config.ClickCountMax:
+			rejected = append(rejected, &rejectedClick{Id: c.Id,
+				Reason: "count必须为1到" + strconv.Itoa(config.ClickCountMax) + "之间的整数"})
+		case c.Ts < 0 || c.Ts > maxTs:
+			rejected = append(rejected, &rejectedClick{Id: c.Id, Reason: "非法ts"})
+		default:
+			if _, err := system.GetFileByID(c.Id); err != nil {
+				rejected = append(rejected, &rejectedClick{Id: c.Id, Reason: "文件不存在"})
+				continue
+			}
+			accepted = append(accepted, c)
+		}
+	}
+
+	// 校验通过后再解析排行榜，全部点击被拒绝时不创建排行榜
+	board, ok := getBoard(r)
+	if !ok {
+		_ = json.NewEncoder(w).Encode(system.ResFailed("非法board"))
+		return
+	}
+	if err := system.RankEngine().ClickBatch(board, accepted); err != nil {
+		if errors.Is(err, system.ErrTooManyBoards) {
+			_ = json.NewEncoder(w).Encode(system.ResFailed("排行榜数量已达上限" + strconv.Itoa(config.MaxBoards)))
+			return
+		}
+		writeFailed(w, "记录点击失败: ", err)
+		return
+	}
+
+	_ = json.NewEncoder(w).Encode(system.ResSuccess(map[string]interface{}{
+		"accepted": len(accepted),
+		"rejected": rejected,
+	}))
+}
+
 func GetTopN(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
@@ -33,15 +135,286 @@ func GetTopN(w http.ResponseWriter, r *http.Request) {
 		_ = json.NewEncoder(w).Encode(system.ResFailed("topN必须为正整数"))
 		return
 	}
-	files := system.RankEngine.TopN(topN)
+	board, ok := getBoard(r)
+	if !ok {
+		_ = json.NewEncoder(w).Encode(system.ResFailed("非法board"))
+		return
+	}
+
+	// 指定asOf时返回该时刻的历史排行榜
+	if asOfStr := r.URL.Query().Get("asOf"); asOfStr != "" {
+		getTopNAsOf(w, r, board, topN, asOfStr)
+		return
+	}
+
+	// 指定时间窗口时返回窗口内的排行榜
+	if window := r.URL.Query().Get("window"); window != "" {
+		files, err := system.RankEngine().TopNWindow(board, topN, window)
+		if err != nil {
+			_ = json.NewEncoder(w).Encode(system.ResFailed(err.Error()))
+			return
+		}
+		_ = json.NewEncoder(w).Encode(system.ResSuccess(files))
+		return
+	}
+
+	metric, ok := getMetric(r)
+	if !ok {
+		_ = json.NewEncoder(w).Encode(system.ResFailed("metric只能为count或unique"))
+		return
+	}
+	var files []*system.File
+	if metric == metricUnique {
+		files = system.RankEngine().TopNUnique(board, topN)
+	} else {
+		files = system.RankEngine().TopN(board, topN)
+	}
 
 	_ = json.NewEncoder(w).Encode(system.ResSuccess(files))
 }
 
-func GetTopAll(w http.ResponseWriter, r *http.Request) {
+// getTopNAsOf 从保留的快照和WAL重建asOf时刻的排行榜，返回前N的文件
+func getTopNAsOf(w http.ResponseWriter, r *http.Request, board string, topN int, asOfStr string) {
+	asOf, err := strconv.ParseInt(asOfStr, 10, 64)
+	if err != nil || asOf < 0 || asOf > time.Now().Unix() {
+		_ = json.NewEncoder(w).Encode(system.ResFailed("asOf必须为不晚于当前时间的时间戳（秒）"))
+		return
+	}
+	if r.URL.Query().Get("window") != "" {
+		_ = json.NewEncoder(w).Encode(system.ResFailed("asOf不支持window参数"))
+		return
+	}
+	metric, ok := getMetric(r)
+	if !ok {
+		_ = json.NewEncoder(w).Encode(system.ResFailed("metric只能为count或unique"))
+		return
+	}
+
+	var files []*system.File
+	err = system.RankEngine().AsOf(asOf, func(h *system.Engine) {
+		if metric == metricUnique {
+			files = h.TopNUnique(board, topN)
+		} else {
+			files = h.TopN(board, topN)
+		}
+	})
+	if errors.Is(err, system.ErrHistoryBusy) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_ = json.NewEncoder(w).Encode(system.ResFailed("正在重建的历史排行榜过多，请稍后重试"))
+		return
+	}
+	if err != nil {
+		_ = json.NewEncoder(w).Encode(system.ResFailed("重建历史排行榜失败: " + err.Error()))
+		return
+	}
+	_ = json.NewEncoder(w).Encode(system.ResSuccess(files))
+}
+
+// GetRank 查询文件的排名及其前后各around个文件
+func GetRank(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	idStr := r.URL.Query().Get("id")
+	id, err := strconv.ParseUint(idStr, 10, 64)
+	if id < 1 || err != nil {
+		_ = json.NewEncoder(w).Encode(system.ResFailed("非法id"))
+		return
+	}
+	around := 0
+	if aroundStr := r.URL.Query().Get("around"); aroundStr != "" {
+		around, err = strconv.Atoi(aroundStr)
+		if around < 0 || around > config.RankPageMaxLimit || err != nil {
+			_ = json.NewEncoder(w).Encode(system.ResFailed(
+				"around必须为0到" + strconv.Itoa(config.RankPageMaxLimit) + "之间的整数"))
+			return
+		}
+	}
+	board, ok := getBoard(r)
+	if !ok {
+		_ = json.NewEncoder(w).Encode(system.ResFailed("非法board"))
+		return
+	}
+
+	res, ok := system.RankEngine().Rank(board, id, around)
+	if !ok {
+		_ = json.NewEncoder(w).Encode(system.ResFailed("文件不在排行榜中"))
+		return
+	}
+	_ = json.NewEncoder(w).Encode(system.ResSuccess(res))
+}
+
+// GetTrending 获取按时间衰减后的热度排行榜
+func GetTrending(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
-	files := system.RankEngine.TopAll()
+	topNStr := r.URL.Query().Get("topN")
+	topN, err := strconv.Atoi(topNStr)
+	if topN < 1 || err != nil {
+		_ = json.NewEncoder(w).Encode(system.ResFailed("topN必须为正整数"))
+		return
+	}
+	board, ok := getBoard(r)
+	if !ok {
+		_ = json.NewEncoder(w).Encode(system.ResFailed("非法board"))
+		return
+	}
+	files := system.RankEngine().Trending(board, topN)
 
 	_ = json.NewEncoder(w).Encode(system.ResSuccess(files))
 }
+
+// GetTopAll 获取全量排行榜，携带 offset/limit/cursor 任一参数时分页返回
+func GetTopAll(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	board, ok := getBoard(r)
+	if !ok {
+		_ = json.NewEncoder(w).Encode(system.ResFailed("非法board"))
+		return
+	}
+	metric, ok := getMetric(r)
+	if !ok {
+		_ = json.NewEncoder(w).Encode(system.ResFailed("metric只能为count或unique"))
+		return
+	}
+
+	query := r.URL.Query()
+	if !query.Has("offset") && !query.Has("limit") && !query.Has("cursor") {
+		var files []*system.File
+		if metric == metricUnique {
+			files = system.RankEngine().TopAllUnique(board)
+		} else {
+			files = system.RankEngine().TopAll(board)
+		}
+		_ = json.NewEncoder(w).Encode(system.ResSuccess(files))
+		return
+	}
+
+	limit := config.RankPageLimit
+	if limitStr := query.Get("limit"); limitStr != "" {
+		var err error
+		limit, err = strconv.Atoi(limitStr)
+		if limit < 1 || limit > config.RankPageMaxLimit || err != nil {
+			_ = json.NewEncoder(w).Encode(system.ResFailed(
+				"limit必须为1到" + strconv.Itoa(config.RankPageMaxLimit) + "之间的整数"))
+			return
+		}
+	}
+
+	page := &system.RankPage{}
+	hasMore := false
+	if cursor := query.Get("cursor"); cursor != "" {
+		// 游标翻页：多取一条用于判断是否还有下一页
+		value, id, err := decodeRankCursor(metric, cursor)
+		if err != nil {
+			_ = json.NewEncoder(w).Encode(system.ResFailed(err.Error()))
+			return
+		}
+		if metric == metricUnique {
+			page.Files, page.Total = system.RankEngine().PageAfterUnique(board, value, id, limit+1)
+		} else {
+			page.Files, page.Total = system.RankEngine().PageAfter(board, value, id, limit+1)
+		}
+		if len(page.Files) > limit {
+			page.Files = page.Files[:limit]
+			hasMore = true
+		}
+	} else {
+		offset := 0
+		if offsetStr := query.Get("offset"); offsetStr != "" {
+			var err error
+			offset, err = strconv.Atoi(offsetStr)
+			if offset < 0 || err != nil {
+				_ = json.NewEncoder(w).Encode(system.ResFailed("offset必须为非负整数"))
+				return
+			}
+		}
+		if metric == metricUnique {
+			page.Files, page.Total = system.RankEngine().PageUnique(board, offset, limit)
+		} else {
+			page.Files, page.Total = system.RankEngine().Page(board, offset, limit)
+		}
+		hasMore = offset+len(page.Files) < page.Total
+	}
+	if hasMore {
+		last := page.Files[len(page.Files)-1]
+		value := last.Count
+		if metric == metricUnique {
+			value = last.Unique
+		}
+		page.NextCursor = encodeRankCursor(metric, value, last.Id)
+	}
+
+	_ = json.NewEncoder(w).Encode(system.ResSuccess(page))
+}
+
+// 排行榜排序指标
+const (
+	metricCount  byte = 0 // 点击次数
+	metricUnique byte = 1 // 独立访客数
+)
+
+// getMetric 获取请求中的排序指标，未指定时按点击次数排序
+func getMetric(r *http.Request) (byte, bool) {
+	switch r.URL.Query().Get("metric") {
+	case "", "count":
+		return metricCount, true
+	case "unique":
+		return metricUnique, true
+	default:
+		return 0, false
+	}
+}
+
+// writeFailed 写入排行榜失败时的响应，从节点只读返回403，其余返回500
+func writeFailed(w http.ResponseWriter, msg string, err error) {
+	if errors.Is(err, system.ErrReadOnly) {
+		w.WriteHeader(http.StatusForbidden)
+		_ = json.NewEncoder(w).Encode(system.ResFailed("只读从节点，不接受写入"))
+		return
+	}
+	w.WriteHeader(http.StatusInternalServerError)
+	_ = json.NewEncoder(w).Encode(system.ResFailed(msg + err.Error()))
+}
+
+// getVisitor 获取访客标识，优先使用 X-Visitor-Id 请求头，否则使用客户端IP
+func getVisitor(r *http.Request) string {
+	if visitor := r.Header.Get("X-Visitor-Id"); visitor != "" {
+		return visitor
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// encodeRankCursor 将排序指标和排序键 (value, id) 编码为不透明游标
+func encodeRankCursor(metric byte, value, id uint64) string {
+	var buf [17]byte
+	buf[0] = metric
+	binary.BigEndian.PutUint64(buf[1:9], value)
+	binary.BigEndian.PutUint64(buf[9:17], id)
+	return base64.RawURLEncoding.EncodeToString(buf[:])
+}
+
+// decodeRankCursor 解析游标中的排序键 (value, id)，游标必须由同一排序指标生成
+func decodeRankCursor(metric byte, cursor string) (value, id uint64, err error) {
+	buf, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil || len(buf) != 17 || buf[0] != metric {
+		return 0, 0, errors.New("非法cursor")
+	}
+	return binary.BigEndian.Uint64(buf[1:9]), binary.BigEndian.Uint64(buf[9:17]), nil
+}
+
+// getBoard 获取请求中的排行榜命名空间，未指定时使用默认排行榜
+func getBoard(r *http.Request) (string, bool) {
+	board := r.URL.Query().Get("board")
+	if board == "" {
+		return config.DefaultBoard, true
+	}
+	if !system.ValidBoardName(board) {
+		return "", false
+	}
+	return board, true
+}
@@ -0,0 +1,46 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fileClick/config"
+	"fileClick/system"
+	"net/http"
+	"strconv"
+)
+
+// ReplicationStream 向从节点发送复制流，直到连接断开
+func ReplicationStream(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/octet-stream")
+	flusher, _ := w.(http.Flusher)
+	flush := func() {
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	config.Info("从节点已连接: " + r.RemoteAddr)
+	err := system.RankEngine().Replicate(r.Context(), w, flush)
+	if err != nil && !errors.Is(err, context.Canceled) {
+		config.Warn("复制流断开: " + r.RemoteAddr + ", " + err.Error())
+	}
+}
+
+// ReplicationFile 向从节点发送文件内容，不计入下载事件
+func ReplicationFile(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(r.URL.Query().Get("id"), 10, 64)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(system.ResFailed("无效的文件ID"))
+		return
+	}
+	fileInfo, err := system.GetFileByID(id)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		_ = json.NewEncoder(w).Encode(system.ResFailed("文件不存在: " + err.Error()))
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeFile(w, r, fileInfo.Path)
+}
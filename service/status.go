@@ -0,0 +1,15 @@
+package service
+
+import (
+	"encoding/json"
+	"fileClick/system"
+	"net/http"
+)
+
+// GetStatus 获取服务状态，包括启动恢复时使用的快照及跳过的损坏快照
+func GetStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	status := system.RankEngine().Status()
+	status.Maintenance = InMaintenance()
+	_ = json.NewEncoder(w).Encode(system.ResSuccess(status))
+}
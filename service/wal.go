@@ -0,0 +1,13 @@
+package service
+
+import (
+	"encoding/json"
+	"fileClick/system"
+	"net/http"
+)
+
+// GetWalStats 获取WAL刷盘策略及fsync耗时分布
+func GetWalStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(system.ResSuccess(system.RankEngine().WalStats()))
+}
@@ -0,0 +1,334 @@
+package system
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"fileClick/config"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// 备份归档为 tar.gz，归档内的路径与数据目录下的相对路径一致：
+// 最新的基准快照及其增量快照、全部WAL段文件、文件信息日志和上传的文件
+
+// ErrEngineClosed 引擎已关闭，通常是恢复备份后被新的引擎替换
+var ErrEngineClosed = errors.New("engine closed")
+
+// backupFile 待写入归档的文件，size为打开文件时的大小，之后追加的内容不写入归档
+type backupFile struct {
+	name    string
+	f       *os.File
+	size    int64
+	modTime time.Time
+}
+
+// Backup 将当前数据写入tar.gz归档
+// 持有快照锁打开快照和WAL段文件，期间不会保存快照或清理WAL，打开之后文件被删除也能继续读取；
+// WAL段文件只写入打开时已有的内容，末尾不完整的记录在恢复时按崩溃留下的半条记录处理
+func (e *Engine) Backup(w io.Writer) error {
+	files, err := e.openBackupFiles()
+	defer func() {
+		for _, bf := range files {
+			_ = bf.f.Close()
+		}
+	}()
+	if err != nil {
+		return err
+	}
+	// 上传的文件先写入内容再登记到文件信息日志，先打开日志再列出文件，保证登记的文件都在归档中；
+	// 日志只追加，压缩时整体替换，打开时的内容总是完整的
+	infoFiles, err := openBackupGlob(filepath.Join(config.MetaPath, "*.log"))
+	files = append(files, infoFiles...)
+	if err != nil {
+		return err
+	}
+	blobs, err := openBackupGlob(filepath.Join(config.FilePath, "*"))
+	files = append(files, blobs...)
+	if err != nil {
+		return err
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	for _, bf := range files {
+		hdr := &tar.Header{
+			Name:    bf.name,
+			Mode:    0644,
+			Size:    bf.size,
+			ModTime: bf.modTime,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(tw, bf.f, bf.size); err != nil {
+			return fmt.Errorf("backup %s: %w", bf.name, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// openBackupFiles 持有快照锁打开最新的基准快照、其增量快照和全部WAL段文件
+func (e *Engine) openBackupFiles() ([]*backupFile, error) {
+	e.snapMu.Lock()
+	defer e.snapMu.Unlock()
+	if e.closed {
+		return nil, ErrEngineClosed
+	}
+
+	paths := e.rdb.chainFiles()
+	segments, err := ListWalSegments(config.WalPath)
+	if err != nil {
+		return nil, err
+	}
+	for _, seg := range segments {
+		paths = append(paths, seg.Path)
+	}
+	var files []*backupFile
+	for _, p := range paths {
+		bf, err := openBackupFile(p)
+		if err != nil {
+			return files, err
+		}
+		if bf != nil {
+			files = append(files, bf)
+		}
+	}
+	return files, nil
+}
+
+// openBackupGlob 打开匹配pattern的普通文件
+func openBackupGlob(pattern string) ([]*backupFile, error) {
+	matches, _ := filepath.Glob(pattern)
+	sort.Strings(matches)
+	var files []*backupFile
+	for _, p := range matches {
+		bf, err := openBackupFile(p)
+		if err != nil {
+			return files, err
+		}
+		if bf != nil {
+			files = append(files, bf)
+		}
+	}
+	return files, nil
+}
+
+// openBackupFile 打开文件并记录当前大小，目录返回nil
+func openBackupFile(p string) (*backupFile, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil || !fi.Mode().IsRegular() {
+		_ = f.Close()
+		return nil, err
+	}
+	return &backupFile{name: filepath.ToSlash(filepath.Clean(p)), f: f, size: fi.Size(), modTime: fi.ModTime()}, nil
+}
+
+// chainFiles 返回最新的基准快照及其增量快照，本进程保存过基准快照时使用该基准快照
+func (r *Rdb) chainFiles() []string {
+	baseTs := r.baseTs
+	if baseTs == 0 {
+		matches, _ := filepath.Glob(filepath.Join(r.dir, "dump-*.rdb"))
+		if len(matches) == 0 {
+			return nil
+		}
+		sort.Strings(matches)
+		ts, ok := rdbBaseTs(matches[len(matches)-1])
+		if !ok {
+			return matches[len(matches)-1:]
+		}
+		baseTs = ts
+	}
+	files := []string{filepath.Join(r.dir, fmt.Sprintf("dump-%d.rdb", baseTs))}
+	return append(files, r.deltaFiles(baseTs)...)
+}
+
+// Restore 从备份归档恢复数据，调用方需先暂停写入
+// 归档先解压到暂存目录并校验，通过后关闭引擎、替换数据文件，再按新数据创建并恢复引擎；
+// 返回新的引擎和原数据文件的保存目录，新引擎创建失败时换回原数据文件并重新创建引擎；
+// 新引擎不会继续复制主节点，从节点返回 ErrReadOnly
+func (e *Engine) Restore(r io.Reader) (*Engine, string, error) {
+	if e.follow != nil {
+		return nil, "", ErrReadOnly
+	}
+	dir := filepath.Join(config.RestorePath, fmt.Sprintf("%d", time.Now().UnixNano()))
+	staging := filepath.Join(dir, "new")
+	if err := extractBackup(r, staging); err != nil {
+		_ = os.RemoveAll(dir)
+		return nil, "", err
+	}
+
+	e.Close()
+	old := filepath.Join(dir, "old")
+	if err := replaceFileStoreData(staging, old); err != nil {
+		return e.reopen(old, fmt.Errorf("replace data: %w", err))
+	}
+	_ = os.RemoveAll(staging)
+	ne, err := NewEngine()
+	if err != nil {
+		return e.reopen(old, fmt.Errorf("new engine: %w", err))
+	}
+	if err := ne.Recover(); err != nil {
+		config.Error("恢复备份数据时加载快照失败: " + err.Error())
+	}
+	ne.StartScheduler()
+	return ne, old, nil
+}
+
+// reopen 恢复失败后换回old中的原数据文件并重新创建引擎，返回新引擎和恢复失败的原因
+func (e *Engine) reopen(old string, cause error) (*Engine, string, error) {
+	if err := replaceFileStoreData(old, filepath.Join(filepath.Dir(old), "failed")); err != nil {
+		return nil, old, fmt.Errorf("%v, rollback: %w", cause, err)
+	}
+	ne, err := NewEngine()
+	if err != nil {
+		return nil, old, fmt.Errorf("%v, reopen: %w", cause, err)
+	}
+	_ = ne.Recover()
+	ne.StartScheduler()
+	return ne, "", cause
+}
+
+// RestoreFiles 服务停止时从备份归档恢复数据文件，返回原数据文件的保存目录
+func RestoreFiles(r io.Reader) (string, error) {
+	dir := filepath.Join(config.RestorePath, fmt.Sprintf("%d", time.Now().UnixNano()))
+	staging := filepath.Join(dir, "new")
+	if err := extractBackup(r, staging); err != nil {
+		_ = os.RemoveAll(dir)
+		return "", err
+	}
+	old := filepath.Join(dir, "old")
+	if err := replaceFileStoreData(staging, old); err != nil {
+		return old, err
+	}
+	return old, os.RemoveAll(staging)
+}
+
+// backupTargets 备份中包含的数据文件和目录，旧版本的备份中文件信息为 fileInfo.json，恢复后启动时迁移
+func backupTargets() []string {
+	return []string{
+		filepath.Clean(config.RdbPath),
+		filepath.Clean(config.WalPath),
+		filepath.Clean(config.MetaPath),
+		filepath.Clean(config.FileInfoPath),
+		filepath.Clean(config.FilePath),
+	}
+}
+
+// extractBackup 将归档解压到dir并校验其中的快照，只接受数据目录下的普通文件
+func extractBackup(r io.Reader, dir string) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return fmt.Errorf("bad backup archive: %w", err)
+	}
+	tr := tar.NewReader(gz)
+	var rdbs []string
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("bad backup archive: %w", err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			return fmt.Errorf("unexpected entry in backup: %s", hdr.Name)
+		}
+		name := path.Clean(hdr.Name)
+		if !backupAllowed(name) {
+			return fmt.Errorf("unexpected entry in backup: %s", hdr.Name)
+		}
+		target := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(f, tr)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return fmt.Errorf("extract %s: %w", hdr.Name, err)
+		}
+		if strings.HasSuffix(name, ".rdb") {
+			rdbs = append(rdbs, target)
+		}
+	}
+	for _, p := range rdbs {
+		if _, err := ReadRdbFile(p); err != nil {
+			return fmt.Errorf("bad rdb in backup: %w", err)
+		}
+	}
+	return nil
+}
+
+// backupAllowed 归档中的路径只能是fileInfo.json或数据目录下的文件，不能包含子目录
+func backupAllowed(name string) bool {
+	for _, target := range backupTargets() {
+		target = filepath.ToSlash(target)
+		if name == target {
+			return target == filepath.ToSlash(filepath.Clean(config.FileInfoPath))
+		}
+		rest, ok := strings.CutPrefix(name, target+"/")
+		if ok && rest != "" && !strings.Contains(rest, "/") && rest != ".." {
+			return true
+		}
+	}
+	return false
+}
+
+// replaceFileStoreData 关闭文件信息存储并替换数据文件，期间不会重新打开，之后按新的数据文件打开
+func replaceFileStoreData(src, aside string) error {
+	metaMu.Lock()
+	defer metaMu.Unlock()
+	if metaStore != nil {
+		metaStore.Close()
+		metaStore = nil
+	}
+	return replaceData(src, aside)
+}
+
+// replaceData 将当前的数据文件移动到aside，再将src中的数据文件移动到原位置，src中没有的目录创建为空目录
+func replaceData(src, aside string) error {
+	for _, target := range backupTargets() {
+		if _, err := os.Stat(target); err == nil {
+			moved := filepath.Join(aside, target)
+			if err := os.MkdirAll(filepath.Dir(moved), 0755); err != nil {
+				return err
+			}
+			if err := os.Rename(target, moved); err != nil {
+				return err
+			}
+		}
+		staged := filepath.Join(src, target)
+		if _, err := os.Stat(staged); err == nil {
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			if err := os.Rename(staged, target); err != nil {
+				return err
+			}
+		} else if target != filepath.Clean(config.FileInfoPath) {
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
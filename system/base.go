@@ -2,7 +2,13 @@ package system
 
 import (
 	"fmt"
+	"math"
+	"math/bits"
+	"os"
+	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 )
 
 // Res 响应体
@@ -32,9 +38,11 @@ func ResFailed(message string) *Res {
 
 // File 文件结构体
 type File struct {
-	Id       uint64 `json:"id"`
-	FileName string `json:"fileName"`
-	Count    uint64 `json:"count"`
+	Id       uint64       `json:"id"`
+	FileName string       `json:"fileName"`
+	Count    uint64       `json:"count"`            // 排行榜分值，各类型事件次数按权重累加
+	Unique   uint64       `json:"unique"`           // 独立访客数（HyperLogLog近似值）
+	Events   *EventCounts `json:"events,omitempty"` // 各类型事件次数
 }
 
 // String 返回文件信息的格式化字符串
@@ -45,14 +53,25 @@ func (f *File) String() string {
 type EventType int
 
 const (
-	HitEvent EventType = iota
+	HitEvent EventType = iota // 点击
 	DeleteEvent
+	ViewEvent     // 浏览
+	DownloadEvent // 下载
+	LikeEvent     // 点赞
+	ShareEvent    // 分享
+	BarrierEvent  // 快照屏障，工作线程处理到该事件时拷贝当前状态写入Snap
 )
 
 // FileEvent 文件点击事件
 type FileEvent struct {
-	Id   uint64
-	Type EventType
+	Id      uint64
+	Type    EventType
+	Ts      int64  // 事件发生时间戳（秒）
+	Visitor uint64 // 访客哈希，0表示未知访客
+	Count   uint64 // 事件次数
+	Snap    chan *RdbBoard
+	Delta   bool // 快照屏障是否只拷贝上次快照之后变化的文件
+	Keep    bool // 快照屏障拷贝后保留变化集合，用于复制等不保存快照的场景
 }
 
 // LinkedNode 双向链表节点
@@ -62,8 +81,10 @@ type LinkedNode struct {
 	Next *LinkedNode
 }
 
-// LRUList 基于LRU思想的排行榜实现
+// LRUList 基于LRU思想的排行榜实现，按count降序、ID升序排列，与跳表索引的顺序一致
+// 只有工作线程写入，查询在其他协程中进行，读写都需加锁
 type LRUList struct {
+	mu      sync.RWMutex
 	head    *LinkedNode
 	tail    *LinkedNode
 	fileMap map[uint64]*LinkedNode // 用于快速查找节点
@@ -76,32 +97,44 @@ func NewLRURanking() *LRUList {
 	}
 }
 
-// Hit 处理文件点击事件，如果文件不存在则创建新节点插入，如果存在则更新计数
-func (lru *LRUList) hit(fileId uint64) {
+// addSat 饱和加法，溢出时取最大值，避免分值回绕
+func addSat(a, b uint64) uint64 {
+	sum, carry := bits.Add64(a, b, 0)
+	if carry != 0 {
+		return math.MaxUint64
+	}
+	return sum
+}
+
+// mulSat 饱和乘法，溢出时取最大值
+func mulSat(a, b uint64) uint64 {
+	hi, lo := bits.Mul64(a, b)
+	if hi != 0 {
+		return math.MaxUint64
+	}
+	return lo
+}
+
+// Incr 增加已存在文件的分值并更新位置，文件不存在时返回nil
+func (lru *LRUList) Incr(fileId uint64, delta uint64) *File {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
 	// 通过map快速查找节点
 	node, exists := lru.fileMap[fileId]
 	if !exists {
-		fileInfo, err := GetFileByID(fileId)
-		if err != nil {
-			return
-		}
-		// 节点不存在，创建新文件并插入
-		newFile := &File{
-			Id:       fileId,
-			FileName: fileInfo.Name,
-			Count:    1, // 初始点击次数为1
-		}
-		lru.insert(newFile)
-	} else {
-		// 节点存在，增加点击次数并更新位置
-		node.File.Count++
-		// 重新排序以确保链表按点击次数正确排列
-		lru.update(node.File)
+		return nil
 	}
+	// 节点存在，增加分值并更新位置
+	node.File.Count = addSat(node.File.Count, delta)
+	// 重新排序以确保链表按点击次数正确排列
+	lru.update(node.File)
+	return node.File
 }
 
-// insert 插入文件节点到链表中的正确位置（按count降序排序）
-func (lru *LRUList) insert(file *File) {
+// Insert 插入文件节点到链表中的正确位置（按count降序排序）
+func (lru *LRUList) Insert(file *File) {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
 	// 检查节点是否已存在
 	if _, exists := lru.fileMap[file.Id]; exists {
 		return // 节点已存在，不重复插入
@@ -121,8 +154,8 @@ func (lru *LRUList) insert(file *File) {
 		return
 	}
 
-	// 文件首次点击
-	if file.Count == 1 {
+	// 文件首次点击，排在链表尾部之后时直接追加
+	if lru.tail.File.less(file) {
 		lru.tail.Next = newNode
 		newNode.Prev = lru.tail
 		lru.tail = newNode
@@ -133,8 +166,7 @@ func (lru *LRUList) insert(file *File) {
 	var curr *LinkedNode
 	for curr = lru.head; curr != nil; curr = curr.Next {
 		// 按count降序排序，count相同时按ID升序排序
-		if curr.File.Count < file.Count ||
-			(curr.File.Count == file.Count && curr.File.Id > file.Id) {
+		if file.less(curr.File) {
 			break
 		}
 	}
@@ -166,11 +198,16 @@ func (lru *LRUList) update(file *File) {
 
 	// 更新点击数
 	node.File.Count = file.Count
-	for node.Prev != nil && node.Prev.File.Count < node.File.Count {
+	for node.Prev != nil && node.File.less(node.Prev.File) {
 		lru.swapWithPrev(node)
 	}
 }
 
+// less 判断f是否排在other之前：count降序，count相同时ID升序
+func (f *File) less(other *File) bool {
+	return f.Count > other.Count || (f.Count == other.Count && f.Id < other.Id)
+}
+
 // swapWithPrev 将节点与其前一个节点交换位置
 func (lru *LRUList) swapWithPrev(node *LinkedNode) {
 	prev := node.Prev
@@ -201,12 +238,15 @@ func (lru *LRUList) swapWithPrev(node *LinkedNode) {
 
 // TopN 获取点击次数前N的文件（按count降序排列）
 func (lru *LRUList) TopN(n int) []*File {
+	lru.mu.RLock()
+	defer lru.mu.RUnlock()
 	var result []*File
 	curr := lru.head
 	count := 0
 
 	for curr != nil && count < n {
-		result = append(result, curr.File)
+		file := *curr.File
+		result = append(result, &file)
 		curr = curr.Next
 		count++
 	}
@@ -216,11 +256,14 @@ func (lru *LRUList) TopN(n int) []*File {
 
 // TopAll 获取所有文件，按点击次数降序排列
 func (lru *LRUList) TopAll() []*File {
+	lru.mu.RLock()
+	defer lru.mu.RUnlock()
 	var result []*File
 	curr := lru.head
 
 	for curr != nil {
-		result = append(result, curr.File)
+		file := *curr.File
+		result = append(result, &file)
 		curr = curr.Next
 	}
 
@@ -237,8 +280,17 @@ func (lru *LRUList) String() string {
 	return strings.Join(result, "\n")
 }
 
-// delete 从排行榜中移除指定ID的文件
-func (lru *LRUList) delete(id uint64) {
+// Len 获取排行榜中的文件数
+func (lru *LRUList) Len() int {
+	lru.mu.RLock()
+	defer lru.mu.RUnlock()
+	return len(lru.fileMap)
+}
+
+// Delete 从排行榜中移除指定ID的文件
+func (lru *LRUList) Delete(id uint64) {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
 	node, exists := lru.fileMap[id]
 	if !exists {
 		return
@@ -260,3 +312,31 @@ func (lru *LRUList) delete(id uint64) {
 	// 从map中移除
 	delete(lru.fileMap, id)
 }
+
+// replaceFile 先写入临时文件并刷盘，再替换原文件并刷新目录，崩溃后文件要么是旧内容要么是新内容
+func replaceFile(path string, data []byte) error {
+	tmpPath := fmt.Sprintf("%s.%d.tmp", path, time.Now().UnixNano())
+	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+	if dir, err := os.Open(filepath.Dir(path)); err == nil {
+		_ = dir.Sync()
+		_ = dir.Close()
+	}
+	return nil
+}
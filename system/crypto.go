@@ -0,0 +1,188 @@
+package system
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// WAL记录负载和RDB数据块可使用AES-GCM加密，段文件头和快照头中记录加密所用的密钥ID，0表示未加密。
+// 密钥文件每行为 "<密钥ID> <十六进制AES密钥>"，密钥长度为16、24或32字节，#开头的行为注释；
+// 最后一行为当前密钥，用于加密新写入的文件，其余密钥只用于读取旧文件，轮换密钥时在末尾追加新密钥
+
+// ErrKeyNotFound 文件使用的密钥不在密钥文件中
+var ErrKeyNotFound = errors.New("encryption key not found")
+
+// sealOverhead 加密后增加的长度：随机nonce和认证标签
+const sealOverhead = 12 + 16
+
+// Keyring 密钥集合
+type Keyring struct {
+	keys   map[uint32]cipher.AEAD
+	active uint32
+}
+
+// keyring 当前使用的密钥，nil表示不加密
+var keyring atomic.Pointer[Keyring]
+
+// LoadKeyring 读取密钥文件
+func LoadKeyring(path string) (*Keyring, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	k := &Keyring{keys: make(map[uint32]cipher.AEAD)}
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("bad key file line %d", lineNo)
+		}
+		id, err := strconv.ParseUint(fields[0], 10, 32)
+		if err != nil || id == 0 {
+			return nil, fmt.Errorf("bad key id at line %d", lineNo)
+		}
+		raw, err := hex.DecodeString(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("bad key at line %d: %w", lineNo, err)
+		}
+		block, err := aes.NewCipher(raw)
+		if err != nil {
+			return nil, fmt.Errorf("bad key at line %d: %w", lineNo, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		if _, exists := k.keys[uint32(id)]; exists {
+			return nil, fmt.Errorf("duplicate key id %d", id)
+		}
+		k.keys[uint32(id)] = aead
+		k.active = uint32(id)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if k.active == 0 {
+		return nil, fmt.Errorf("no key in %s", path)
+	}
+	return k, nil
+}
+
+// UseKeyring 设置读写WAL和RDB使用的密钥，nil表示不加密新文件
+func UseKeyring(k *Keyring) {
+	keyring.Store(k)
+}
+
+// activeKey 返回当前密钥的ID，未配置密钥时返回0
+func activeKey() uint32 {
+	if k := keyring.Load(); k != nil {
+		return k.active
+	}
+	return 0
+}
+
+// lookupKey 按ID查找密钥
+func lookupKey(id uint32) (cipher.AEAD, error) {
+	if k := keyring.Load(); k != nil {
+		if aead, exists := k.keys[id]; exists {
+			return aead, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %d", ErrKeyNotFound, id)
+}
+
+// sealWithKey 使用指定密钥加密，返回 nonce | 密文
+func sealWithKey(id uint32, plain, aad []byte) ([]byte, error) {
+	aead, err := lookupKey(id)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plain)+aead.Overhead())
+	if _, err := rand.Read(out); err != nil {
+		return nil, err
+	}
+	return aead.Seal(out, out, plain, aad), nil
+}
+
+// openWithKey 使用指定密钥解密sealWithKey的结果
+func openWithKey(id uint32, sealed, aad []byte) ([]byte, error) {
+	aead, err := lookupKey(id)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("sealed data too short")
+	}
+	return aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], aad)
+}
+
+// RekeyWalSegment 使用当前密钥重新加密段文件，返回是否改写
+// 已使用当前密钥加密并带附加认证数据、未加密且不需要加密，或版本3之前没有LSN的段文件不做修改，段文件损坏时返回错误
+func RekeyWalSegment(path string) (bool, error) {
+	keyId := activeKey()
+	var recs []*WalRecord
+	res, err := ScanWalSegment(path, func(offset int64, rec *WalRecord) error {
+		recs = append(recs, rec)
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	if res.Err != nil {
+		return false, fmt.Errorf("%s: %w", path, res.Err)
+	}
+	if res.Version < 3 || (res.KeyId == keyId && (keyId == 0 || res.Version >= walVersion)) {
+		return false, nil
+	}
+
+	var buf bytes.Buffer
+	header := encodeWalHeader(res.BaseLsn, keyId)
+	buf.Write(header)
+	for _, rec := range recs {
+		payload := rec.encodePayload()
+		if keyId != 0 {
+			if payload, err = sealWithKey(keyId, payload, walRecordAad(header, int64(buf.Len()))); err != nil {
+				return false, err
+			}
+		}
+		var head [8]byte
+		binary.LittleEndian.PutUint32(head[0:4], uint32(len(payload)))
+		binary.LittleEndian.PutUint32(head[4:8], crc32.ChecksumIEEE(payload))
+		buf.Write(head[:])
+		buf.Write(payload)
+	}
+	return true, replaceFile(path, buf.Bytes())
+}
+
+// RekeyRdbFile 使用当前密钥重新加密快照，保留快照时间戳，返回是否改写
+// 已使用当前密钥的快照和 RDB1 快照不做修改
+func RekeyRdbFile(path string) (bool, error) {
+	ld, err := ReadRdbFile(path)
+	if err != nil {
+		return false, err
+	}
+	if ld.Format < 2 || ld.KeyId == activeKey() {
+		return false, nil
+	}
+	r := NewRDBWithDir(filepath.Dir(path))
+	return true, r.write(path, &RdbSnapshot{Lsns: ld.Lsns, Boards: ld.Boards}, ld.SnapshotTs)
+}
@@ -0,0 +1,264 @@
+package system
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fileClick/config"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// useKeys 写入密钥文件并启用，最后一个ID为当前密钥，测试结束后恢复为不加密
+func useKeys(t *testing.T, ids ...uint32) {
+	t.Helper()
+	var sb strings.Builder
+	for _, id := range ids {
+		key := make([]byte, 32)
+		for i := range key {
+			key[i] = byte(id) + byte(i)
+		}
+		fmt.Fprintf(&sb, "%d %s\n", id, hex.EncodeToString(key))
+	}
+	path := filepath.Join(t.TempDir(), "keys")
+	if err := os.WriteFile(path, []byte(sb.String()), 0600); err != nil {
+		t.Fatal(err)
+	}
+	k, err := LoadKeyring(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	UseKeyring(k)
+	t.Cleanup(func() { UseKeyring(nil) })
+}
+
+// writeWalRecords 写入记录并关闭WAL，返回记录所在线程的段文件
+func writeWalRecords(t *testing.T, recs []*WalRecord) []*WalSegment {
+	t.Helper()
+	w, err := NewWAL()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.SetApplier(func(rec *WalRecord) {})
+	for _, rec := range recs {
+		if err := w.Append(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.Close()
+	segments, err := listWalSegments(config.WalPath, walThreadOf(recs[0].FileId))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return segments
+}
+
+// scanWal 读取段文件中的全部记录
+func scanWal(t *testing.T, path string) (*WalScanResult, []*WalRecord) {
+	t.Helper()
+	var recs []*WalRecord
+	res, err := ScanWalSegment(path, func(offset int64, rec *WalRecord) error {
+		recs = append(recs, rec)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res, recs
+}
+
+func sampleWalRecords() []*WalRecord {
+	return []*WalRecord{
+		{Op: WalOpClick, FileId: 1, Ts: 1700000000, Board: "docs", Visitor: 42, Type: DownloadEvent, Count: 3},
+		{Op: WalOpClick, FileId: 1, Ts: 1700000001, Board: "docs", Visitor: 43, Type: DownloadEvent, Count: 4},
+	}
+}
+
+func TestEncryptedWalRoundTrip(t *testing.T) {
+	useTempData(t)
+	useKeys(t, 7)
+	recs := sampleWalRecords()
+	segments := writeWalRecords(t, recs)
+
+	res, got := scanWal(t, segments[len(segments)-1].Path)
+	if res.Err != nil || res.KeyId != 7 || res.Version != walVersion {
+		t.Fatalf("scan result: err=%v keyId=%d version=%d", res.Err, res.KeyId, res.Version)
+	}
+	if !reflect.DeepEqual(got, recs) {
+		t.Fatalf("records differ after round trip")
+	}
+	// 记录负载是密文
+	data, err := os.ReadFile(segments[len(segments)-1].Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "docs") {
+		t.Fatal("wal segment contains plain text board name")
+	}
+}
+
+// TestEncryptedWalRecordMoved 加密记录换到其他偏移或其他段文件时解密失败，按损坏处理
+func TestEncryptedWalRecordMoved(t *testing.T) {
+	useTempData(t)
+	useKeys(t, 7)
+	segments := writeWalRecords(t, sampleWalRecords())
+	path := segments[len(segments)-1].Path
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 交换两条等长的记录
+	body := data[walHeaderSize:]
+	n := len(body) / 2
+	swapped := append(append(append([]byte(nil), data[:walHeaderSize]...), body[n:]...), body[:n]...)
+	if err := os.WriteFile(path, swapped, 0644); err != nil {
+		t.Fatal(err)
+	}
+	res, recs := scanWal(t, path)
+	if !errors.Is(res.Err, ErrWalCorrupt) || len(recs) != 0 {
+		t.Fatalf("swapped records: err=%v records=%d, want corrupt", res.Err, len(recs))
+	}
+
+	// 同一偏移的记录放到baseLsn不同的段文件
+	other := append([]byte(nil), data...)
+	copy(other[6:14], encodeWalHeader(100, 7)[6:14])
+	if err := os.WriteFile(path, other, 0644); err != nil {
+		t.Fatal(err)
+	}
+	res, recs = scanWal(t, path)
+	if !errors.Is(res.Err, ErrWalCorrupt) || len(recs) != 0 {
+		t.Fatalf("moved records: err=%v records=%d, want corrupt", res.Err, len(recs))
+	}
+}
+
+// TestWalV4Encrypted 版本4的加密记录没有附加认证数据，仍可读取
+func TestWalV4Encrypted(t *testing.T) {
+	useTempData(t)
+	useKeys(t, 7)
+	recs := sampleWalRecords()
+	header := encodeWalHeader(1, 7)
+	header[4] = 4
+	data := header
+	for i, rec := range recs {
+		rec.Lsn = uint64(i + 1)
+		payload, err := sealWithKey(7, rec.encodePayload(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data = appendWalFrame(data, payload)
+	}
+	path := filepath.Join(config.WalPath, "wal-0-000001.log")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	res, got := scanWal(t, path)
+	if res.Err != nil || res.Version != 4 || !reflect.DeepEqual(got, recs) {
+		t.Fatalf("v4 scan: err=%v version=%d records=%d", res.Err, res.Version, len(got))
+	}
+
+	// 使用当前密钥的版本4段文件重新加密后升级到当前版本
+	if changed, err := RekeyWalSegment(path); err != nil || !changed {
+		t.Fatalf("rekey v4: changed=%v err=%v", changed, err)
+	}
+	res, got = scanWal(t, path)
+	if res.Err != nil || res.Version != walVersion || !reflect.DeepEqual(got, recs) {
+		t.Fatalf("rekeyed v4 scan: err=%v version=%d records=%d", res.Err, res.Version, len(got))
+	}
+}
+
+func TestEncryptedRdbRoundTrip(t *testing.T) {
+	useKeys(t, 7)
+	snap := sampleRdbSnapshot()
+	r := NewRDBWithDir(t.TempDir())
+	_, path, err := r.Save(snap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := ReadRdbFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.KeyId != 7 || !reflect.DeepEqual(res.Boards, snap.Boards) || !reflect.DeepEqual(res.Lsns, snap.Lsns) {
+		t.Fatalf("encrypted rdb differs after round trip, keyId=%d", res.KeyId)
+	}
+}
+
+// TestMissingKey 缺少文件所用的密钥时返回 ErrKeyNotFound，而不是当作损坏的文件
+func TestMissingKey(t *testing.T) {
+	useTempData(t)
+	useKeys(t, 7)
+	segments := writeWalRecords(t, sampleWalRecords())
+	_, rdbPath, err := NewRDB().Save(sampleRdbSnapshot())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	useKeys(t, 8)
+	if _, err := ScanWalSegment(segments[len(segments)-1].Path, func(int64, *WalRecord) error { return nil }); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("scan wal without key: %v, want ErrKeyNotFound", err)
+	}
+	if _, err := ReadRdbFile(rdbPath); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("read rdb without key: %v, want ErrKeyNotFound", err)
+	}
+	UseKeyring(nil)
+	if _, err := ReadRdbFile(rdbPath); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("read rdb without keyring: %v, want ErrKeyNotFound", err)
+	}
+}
+
+func TestRekey(t *testing.T) {
+	useTempData(t)
+	useKeys(t, 7)
+	recs := sampleWalRecords()
+	segments := writeWalRecords(t, recs)
+	walPath := segments[len(segments)-1].Path
+	snap := sampleRdbSnapshot()
+	snapTs, rdbPath, err := NewRDB().Save(snap)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 轮换密钥后用新密钥重新加密，之后只有新密钥也能读取
+	useKeys(t, 7, 8)
+	for _, step := range []struct {
+		name string
+		fn   func(string) (bool, error)
+		path string
+	}{
+		{"wal", RekeyWalSegment, walPath},
+		{"rdb", RekeyRdbFile, rdbPath},
+	} {
+		if changed, err := step.fn(step.path); err != nil || !changed {
+			t.Fatalf("rekey %s: changed=%v err=%v", step.name, changed, err)
+		}
+		if changed, err := step.fn(step.path); err != nil || changed {
+			t.Fatalf("rekey %s again: changed=%v err=%v, want unchanged", step.name, changed, err)
+		}
+	}
+
+	useKeys(t, 8)
+	res, got := scanWal(t, walPath)
+	if res.Err != nil || res.KeyId != 8 || !reflect.DeepEqual(got, recs) {
+		t.Fatalf("rekeyed wal: err=%v keyId=%d records=%d", res.Err, res.KeyId, len(got))
+	}
+	ld, err := ReadRdbFile(rdbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ld.KeyId != 8 || ld.SnapshotTs != snapTs || !reflect.DeepEqual(ld.Boards, snap.Boards) {
+		t.Fatalf("rekeyed rdb: keyId=%d ts=%d", ld.KeyId, ld.SnapshotTs)
+	}
+}
+
+// appendWalFrame 追加一条记录: 长度 | CRC | 负载
+func appendWalFrame(data, payload []byte) []byte {
+	data = binary.LittleEndian.AppendUint32(data, uint32(len(payload)))
+	data = binary.LittleEndian.AppendUint32(data, crc32.ChecksumIEEE(payload))
+	return append(data, payload...)
+}
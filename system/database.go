@@ -1,93 +1,66 @@
 package system
 
-import (
-	"encoding/json"
-	"fileClick/config"
-	"fmt"
-	"os"
-	"strconv"
-)
-
 type FileInfo struct {
-	Name string `json:"fileName"`
-	Path string `json:"path"`
+	Name     string `json:"fileName"`
+	Path     string `json:"path"`
+	UploadTs int64  `json:"uploadTs,omitempty"` // 上传时间戳（秒）
+	Size     int64  `json:"size,omitempty"`     // 文件字节数
+	Sha256   string `json:"sha256,omitempty"`   // 文件内容的SHA-256（十六进制）
+	MimeType string `json:"mimeType,omitempty"` // 按文件内容识别的类型
+	Uploader string `json:"uploader,omitempty"` // 上传者，与访客标识相同，取自客户端自行填写的 X-Visitor-Id 请求头，未经验证，仅供参考
 }
 
-// AddFileToJSON 将文件信息添加到JSON文件
-func AddFileToJSON(id uint64, file *FileInfo) error {
-
-	// 读取现有数据
-	files, err := GetAllFiles()
-	if err != nil && !os.IsNotExist(err) {
-		return err
-	}
-
-	// 添加新文件信息
-	files[id] = *file
-
-	// 写入JSON文件
-	data, err := json.Marshal(files)
+// AddFile 保存文件信息
+func AddFile(id uint64, file *FileInfo) error {
+	s, err := fileStore()
 	if err != nil {
 		return err
 	}
-
-	return os.WriteFile(config.FileInfoPath, data, 0644)
+	return s.Put(id, file)
 }
 
-// RemoveFileFromJSON 从JSON文件中移除指定ID的文件记录
-func RemoveFileFromJSON(id uint64) error {
-	files, err := GetAllFiles()
+// RemoveFile 移除指定ID的文件信息
+func RemoveFile(id uint64) error {
+	s, err := fileStore()
 	if err != nil {
 		return err
 	}
+	return s.Delete(id)
+}
 
-	// 删除指定ID的文件
-	delete(files, id)
-
-	// 写入更新后的数据
-	data, err := json.Marshal(files)
+// ReplaceAllFiles 用files替换全部文件信息
+func ReplaceAllFiles(files map[uint64]FileInfo) error {
+	s, err := fileStore()
 	if err != nil {
 		return err
 	}
-
-	return os.WriteFile(config.FileInfoPath, data, 0644)
+	return s.Replace(files)
 }
 
 // GetAllFiles 获取所有文件信息
 func GetAllFiles() (map[uint64]FileInfo, error) {
-	// 检查文件是否存在
-	if _, err := os.Stat(config.FileInfoPath); os.IsNotExist(err) {
-		return make(map[uint64]FileInfo), nil
-	}
-
-	// 读取文件内容
-	data, err := os.ReadFile(config.FileInfoPath)
-	if err != nil {
-		return nil, err
-	}
-
-	// 解析JSON
-	var files map[uint64]FileInfo
-	err = json.Unmarshal(data, &files)
+	s, err := fileStore()
 	if err != nil {
 		return nil, err
 	}
-
-	return files, nil
+	return s.All(), nil
 }
 
 // GetFileByID 根据ID获取文件信息
 func GetFileByID(id uint64) (*FileInfo, error) {
-	// 获取map格式的数据
-	filesMap, err := GetAllFiles()
+	s, err := fileStore()
 	if err != nil {
 		return nil, err
 	}
+	return s.Get(id)
+}
 
-	// 直接通过key查找
-	if file, exists := filesMap[id]; exists {
-		return &file, nil
+// ScanFiles 按名称顺序对匹配q的文件调用fn，fn返回false时停止
+func ScanFiles(q *FileQuery, fn func(id uint64, info *FileInfo) bool) error {
+	s, err := fileStore()
+	if err != nil {
+		return err
 	}
-
-	return nil, fmt.Errorf("文件不存在, Id: " + strconv.FormatUint(id, 10))
+	s.Scan(q, fn)
+	return nil
 }
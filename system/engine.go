@@ -2,24 +2,47 @@ package system
 
 import (
 	"context"
+	"errors"
 	"fileClick/config"
 	"fmt"
-	"os"
-	"path/filepath"
-	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-var RankEngine *Engine
+// rankEngine 服务使用的引擎，恢复备份时整体替换
+var rankEngine atomic.Pointer[Engine]
+
+// RankEngine 返回服务当前使用的引擎
+func RankEngine() *Engine {
+	return rankEngine.Load()
+}
+
+// SetRankEngine 替换服务使用的引擎，正在处理的请求继续使用原引擎
+func SetRankEngine(e *Engine) {
+	rankEngine.Store(e)
+}
 
 type Engine struct {
-	mu        sync.Mutex
-	rankBoard *RankBoard
+	mu      sync.RWMutex
+	boards  map[string]*RankBoard // 按命名空间区分的排行榜
+	stopped bool                  // 排行榜工作线程已停止，不再创建排行榜，受mu保护
 
 	wal *Wal
 	rdb *Rdb
 
+	startTs  int64
+	recovery *RecoveryStatus // 启动恢复结果，Recover完成后不再修改
+
+	snapMu sync.Mutex // 串行化快照，增量快照基于上一次快照
+	deltas int        // 当前基准快照之后的增量快照数，-1表示下一次必须保存全量快照
+	closed bool       // 已关闭，不再保存快照，受snapMu保护
+
+	history bool // 按时间点重建的历史排行榜，没有WAL，查询后丢弃
+
+	repl   replHub   // 复制流订阅者
+	follow *follower // 从节点的复制状态，主节点为nil
+
 	snapInterval time.Duration
 	ctx          context.Context
 	cancel       context.CancelFunc
@@ -27,69 +50,414 @@ type Engine struct {
 }
 
 func NewEngine() (*Engine, error) {
-	wal, err := NewWAL()
+	rdb := NewRDB()
+	opts := DefaultWalOptions()
+	opts.MinLsns = rdb.MaxLsns()
+	wal, err := NewWALWithOptions(opts)
 	if err != nil {
 		return nil, err
 	}
-	rdb := NewRDB()
 
 	e := &Engine{
-		rankBoard:    GetRankBoard(),
+		boards:       make(map[string]*RankBoard),
 		wal:          wal,
 		rdb:          rdb,
 		snapInterval: config.RdbShotEvery,
+		startTs:      time.Now().Unix(),
+		deltas:       -1,
 	}
+	// WAL记录写入成功后按LSN顺序投递到排行榜
+	wal.SetApplier(e.apply)
 	e.ctx, e.cancel = context.WithCancel(context.Background())
 	return e, nil
 }
 
 func (e *Engine) Recover() error {
-	ld, err := e.rdb.LoadLatest()
+	start := time.Now()
+	status := &RecoveryStatus{}
+	defer func() {
+		status.CostMs = time.Since(start).Milliseconds()
+		e.recovery = status
+	}()
+
+	// 最新快照损坏时LoadLatest会回退到更早的快照，全部损坏时仍回放全部WAL，尽量恢复数据
+	ld, loadErr := e.rdb.LoadLatest()
+	status.Snapshot = ld.Path
+	status.SnapshotTs = ld.SnapshotTs
+	status.Lsns = ld.Lsns
+	status.Deltas = ld.Deltas
+	status.Skipped = ld.Skipped
+	if errors.Is(loadErr, ErrKeyNotFound) {
+		status.Error = loadErr.Error()
+		return loadErr
+	}
+	if loadErr != nil {
+		status.Error = loadErr.Error()
+		config.Error("没有可用的RDB快照，从WAL恢复数据: " + loadErr.Error())
+	} else if ld.Path != "" {
+		config.Info(fmt.Sprintf("使用RDB快照恢复: %s, 合并增量快照: %d, 快照时间: %d, 跳过损坏的快照: %d",
+			ld.Path, len(ld.Deltas), ld.SnapshotTs, len(ld.Skipped)))
+	}
+	// 恢复数据
+	for _, board := range ld.Boards {
+		e.board(board.Name).load(board)
+	}
+
+	// 快照记录了各WAL线程已应用的LSN时按LSN精确回放，否则按快照时间戳回放
+	var replayed atomic.Uint64
+	apply := func(rec *WalRecord) error {
+		replayed.Add(1)
+		e.apply(rec)
+		return nil
+	}
+	err := e.wal.ReplayAll(ld.SnapshotTs, ld.Lsns, apply)
+	status.Replayed = replayed.Load()
 	if err != nil {
+		status.Error = err.Error()
 		return err
 	}
+	config.Info(fmt.Sprintf("WAL回放完成，回放记录数: %d", status.Replayed))
+	return loadErr
+}
+
+// RecoveryStatus 启动恢复结果
+type RecoveryStatus struct {
+	Snapshot   string        `json:"snapshot"` // 用于恢复的快照文件，为空表示没有可用快照
+	SnapshotTs int64         `json:"snapshotTs"`
+	Lsns       []uint64      `json:"lsns"`
+	Deltas     []string      `json:"deltas"`   // 合并的增量快照
+	Skipped    []*RdbSkipped `json:"skipped"`  // 校验失败被跳过的快照
+	Replayed   uint64        `json:"replayed"` // 回放的WAL记录数
+	CostMs     int64         `json:"costMs"`
+	Error      string        `json:"error,omitempty"`
+}
+
+// Status 服务状态
+type Status struct {
+	StartTs     int64              `json:"startTs"`
+	Boards      int                `json:"boards"`
+	Recovery    *RecoveryStatus    `json:"recovery"`
+	Maintenance bool               `json:"maintenance"`           // 是否处于维护模式，由服务层填写
+	Replication *ReplicationStatus `json:"replication,omitempty"` // 从节点的复制状态
+}
+
+// Status 返回启动时间、排行榜数量、启动恢复结果及从节点的复制状态
+func (e *Engine) Status() *Status {
+	status := &Status{
+		StartTs:  e.startTs,
+		Boards:   len(e.allBoards()),
+		Recovery: e.recovery,
+	}
+	if e.follow != nil {
+		status.Replication = e.follow.snapshot()
+	}
+	return status
+}
+
+// apply 将WAL记录投递到排行榜，回放时带上WAL记录的时间戳，用于重建时间窗口分桶和衰减分数
+func (e *Engine) apply(rec *WalRecord) {
+	switch rec.Op {
+	case WalOpClick:
+		e.board(rec.Board).writeCh <- &FileEvent{
+			Id:      rec.FileId,
+			Type:    rec.Type,
+			Ts:      rec.Ts,
+			Visitor: rec.Visitor,
+			Count:   rec.Count,
+		}
+	case WalOpDelete:
+		e.deleteFromBoards(rec.FileId)
+	default:
+		config.Error(fmt.Sprintf("不支持的WAL记录类型: %d", rec.Op))
+		return
+	}
+	e.repl.publish(rec)
+}
+
+// board 获取指定命名空间的排行榜，不存在时创建
+func (e *Engine) board(name string) *RankBoard {
+	if name == "" {
+		name = config.DefaultBoard
+	}
+	e.mu.RLock()
+	rb, exists := e.boards[name]
+	e.mu.RUnlock()
+	if exists {
+		return rb
+	}
+
 	e.mu.Lock()
-	// 恢复数据
-	fileMap := make(map[uint64]*File, len(ld.Files))
-	for _, file := range ld.Files {
-		fileMap[file.Id] = file
-		e.rankBoard.lru.insert(file)
+	defer e.mu.Unlock()
+	if rb, exists = e.boards[name]; !exists {
+		rb = newRankBoard(name, e.history)
+		e.boards[name] = rb
 	}
-	e.mu.Unlock()
+	return rb
+}
 
-	apply := func(fileId uint64, ts int64) error {
-		e.rankBoard.writeCh <- &FileEvent{Id: fileId, Type: HitEvent}
-		return nil
+// ErrTooManyBoards 排行榜数量已达上限
+var ErrTooManyBoards = errors.New("too many boards")
+
+// ErrBadBoard 排行榜命名空间不合法
+var ErrBadBoard = errors.New("bad board name")
+
+// ValidBoardName 命名空间只允许字母、数字、下划线和中划线，长度为1到64
+func ValidBoardName(name string) bool {
+	if name == "" || len(name) > 64 {
+		return false
 	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
 
-	if err = e.wal.ReplayAll(ld.SnapshotTs, apply); err != nil {
-		return err
+// writableBoard 获取写入请求使用的排行榜，数量达到上限时不再创建新的排行榜
+// WAL回放和复制应用的记录已经写入，仍通过board创建
+func (e *Engine) writableBoard(name string) (*RankBoard, error) {
+	if rb := e.lookup(name); rb != nil {
+		return rb, nil
 	}
-	return nil
+	if name == "" {
+		name = config.DefaultBoard
+	}
+	if !ValidBoardName(name) {
+		return nil, ErrBadBoard
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.stopped {
+		return nil, ErrEngineClosed
+	}
+	rb, exists := e.boards[name]
+	if !exists {
+		if len(e.boards) >= config.MaxBoards {
+			return nil, ErrTooManyBoards
+		}
+		rb = newRankBoard(name, e.history)
+		e.boards[name] = rb
+	}
+	return rb, nil
+}
+
+// lookup 查询指定命名空间的排行榜，不存在时返回nil，避免只读请求创建排行榜
+func (e *Engine) lookup(name string) *RankBoard {
+	if name == "" {
+		name = config.DefaultBoard
+	}
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.boards[name]
 }
 
-func (e *Engine) Click(fileId uint64) {
+// allBoards 获取全部排行榜
+func (e *Engine) allBoards() []*RankBoard {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	boards := make([]*RankBoard, 0, len(e.boards))
+	for _, rb := range e.boards {
+		boards = append(boards, rb)
+	}
+	return boards
+}
+
+// Click 记录一次计分事件（点击、浏览、下载、点赞、分享），visitor为访客标识，为空时不计入独立访客数
+// 记录由WAL线程按刷盘策略写入成功后投递到排行榜，默认等投递后返回，写入失败时返回错误；
+// async为true时不等待刷盘，写入失败只记录日志
+func (e *Engine) Click(board string, fileId uint64, typ EventType, visitor string, async bool) error {
+	if e.follow != nil {
+		return ErrReadOnly
+	}
+	rb, err := e.writableBoard(board)
+	if err != nil {
+		return err
+	}
 	ts := time.Now().Unix()
-	e.wal.Append(fileId, ts)
-	e.rankBoard.writeCh <- &FileEvent{
-		Id:   fileId,
-		Type: HitEvent,
+	var visitorHash uint64
+	if visitor != "" {
+		visitorHash = HashVisitor(visitor)
+	}
+	rec := &WalRecord{Op: WalOpClick, FileId: fileId, Ts: ts, Board: rb.name, Visitor: visitorHash, Type: typ, Count: 1}
+	if async {
+		err = e.wal.AppendAsync(rec)
+	} else {
+		err = e.wal.Append(rec)
+	}
+	return err
+}
+
+// BatchClick 批量上报中的一条点击
+type BatchClick struct {
+	Id    uint64 `json:"id"`
+	Count uint64 `json:"count"`
+	Ts    int64  `json:"ts"` // 点击时间戳（秒），为0时使用当前时间
+}
+
+// ClickBatch 批量记录点击，整批通过一次WAL写入和一次fsync落盘后再投递到排行榜
+func (e *Engine) ClickBatch(board string, clicks []*BatchClick) error {
+	if e.follow != nil {
+		return ErrReadOnly
+	}
+	// 没有点击时不创建排行榜
+	if len(clicks) == 0 {
+		return nil
+	}
+	rb, err := e.writableBoard(board)
+	if err != nil {
+		return err
+	}
+	now := time.Now().Unix()
+	recs := make([]*WalRecord, len(clicks))
+	for i, c := range clicks {
+		ts := c.Ts
+		if ts == 0 {
+			ts = now
+		}
+		recs[i] = &WalRecord{Op: WalOpClick, FileId: c.Id, Ts: ts, Board: rb.name, Type: HitEvent, Count: c.Count}
+	}
+	return e.wal.AppendBatch(recs)
+}
+
+// Delete 从所有排行榜中移除文件，删除记录先写入WAL，避免崩溃恢复后文件重新出现在排行榜中
+func (e *Engine) Delete(fileId uint64) error {
+	if e.follow != nil {
+		return ErrReadOnly
+	}
+	return e.wal.Append(&WalRecord{Op: WalOpDelete, FileId: fileId, Ts: time.Now().Unix()})
+}
+
+// deleteFromBoards 向所有排行榜投递删除事件
+func (e *Engine) deleteFromBoards(fileId uint64) {
+	for _, rb := range e.allBoards() {
+		rb.writeCh <- &FileEvent{
+			Id:   fileId,
+			Type: DeleteEvent,
+		}
+	}
+}
+
+// WalStats 获取WAL刷盘策略及fsync耗时分布
+func (e *Engine) WalStats() *WalStats {
+	return e.wal.Stats()
+}
+
+func (e *Engine) TopN(board string, n int) []*File {
+	rb := e.lookup(board)
+	if rb == nil {
+		return []*File{}
+	}
+	return rb.annotate(rb.ranking.TopN(n))
+}
+
+func (e *Engine) TopAll(board string) []*File {
+	rb := e.lookup(board)
+	if rb == nil {
+		return []*File{}
+	}
+	return rb.annotate(rb.ranking.TopAll())
+}
+
+// Page 按偏移量分页获取排行榜，同时返回文件总数
+func (e *Engine) Page(board string, offset, limit int) ([]*File, int) {
+	rb := e.lookup(board)
+	if rb == nil {
+		return []*File{}, 0
+	}
+	files, total := rb.index.Page(offset, limit)
+	return rb.annotate(files), total
+}
+
+// PageAfter 获取排在 (count, id) 之后的limit个文件，同时返回文件总数
+func (e *Engine) PageAfter(board string, count, id uint64, limit int) ([]*File, int) {
+	rb := e.lookup(board)
+	if rb == nil {
+		return []*File{}, 0
+	}
+	files, total := rb.index.PageAfter(count, id, limit)
+	return rb.annotate(files), total
+}
+
+// FillCounts 填充文件在排行榜中的点击次数，不在排行榜中的文件为0
+func (e *Engine) FillCounts(board string, files []*File) {
+	rb := e.lookup(board)
+	if rb == nil {
+		return
+	}
+	rb.index.fillCounts(files)
+}
+
+// Rank 查询文件的排名及其前后各k个文件
+func (e *Engine) Rank(board string, fileId uint64, k int) (*RankResult, bool) {
+	rb := e.lookup(board)
+	if rb == nil {
+		return nil, false
+	}
+	res, ok := rb.index.Around(fileId, k)
+	if ok {
+		res.File = rb.annotate([]*File{res.File})[0]
+		res.Above = rb.annotate(res.Above)
+		res.Below = rb.annotate(res.Below)
+	}
+	return res, ok
+}
+
+// TopNUnique 获取独立访客数前N的文件
+func (e *Engine) TopNUnique(board string, n int) []*File {
+	rb := e.lookup(board)
+	if rb == nil {
+		return []*File{}
+	}
+	return rb.withCounts(rb.unique.topN(n))
+}
+
+// TopAllUnique 获取所有文件，按独立访客数降序排列
+func (e *Engine) TopAllUnique(board string) []*File {
+	rb := e.lookup(board)
+	if rb == nil {
+		return []*File{}
+	}
+	return rb.withCounts(rb.unique.all())
+}
+
+// PageUnique 按独立访客数排序后按偏移量分页，同时返回文件总数
+func (e *Engine) PageUnique(board string, offset, limit int) ([]*File, int) {
+	rb := e.lookup(board)
+	if rb == nil {
+		return []*File{}, 0
 	}
+	files, total := rb.unique.page(offset, limit)
+	return rb.withCounts(files), total
 }
 
-func (e *Engine) Delete(fileId uint64) {
-	e.rankBoard.writeCh <- &FileEvent{
-		Id:   fileId,
-		Type: DeleteEvent,
+// PageAfterUnique 按独立访客数排序后获取排在 (unique, id) 之后的limit个文件，同时返回文件总数
+func (e *Engine) PageAfterUnique(board string, unique, id uint64, limit int) ([]*File, int) {
+	rb := e.lookup(board)
+	if rb == nil {
+		return []*File{}, 0
 	}
+	files, total := rb.unique.pageAfter(unique, id, limit)
+	return rb.withCounts(files), total
 }
 
-func (e *Engine) TopN(n int) []*File {
-	return e.rankBoard.lru.TopN(n)
+// TopNWindow 获取指定时间窗口（1h/24h/7d）内点击次数前N的文件
+func (e *Engine) TopNWindow(board string, n int, window string) ([]*File, error) {
+	rb := e.lookup(board)
+	if rb == nil {
+		// 借用空窗口排行榜校验窗口参数
+		return NewWindowBoard().TopN(n, window)
+	}
+	return rb.window.TopN(n, window)
 }
 
-func (e *Engine) TopAll() []*File {
-	return e.rankBoard.lru.TopAll()
+// Trending 获取按时间衰减后热度前N的文件
+func (e *Engine) Trending(board string, n int) []*TrendingFile {
+	rb := e.lookup(board)
+	if rb == nil {
+		return []*TrendingFile{}
+	}
+	return rb.trending.TopN(n)
 }
 
 // StartScheduler 周期快照 & AOF 清理
@@ -119,34 +487,116 @@ func (e *Engine) Stop() {
 	e.wal.Close()
 	// 退出前再做一次快照
 	e.doSnapshotAndPrune()
+	e.Close()
 }
 
-func (e *Engine) doSnapshotAndPrune() {
-	// 1) 保存 RDB
-	data := e.TopAll() // 拷贝快照态
-	snapTs, _, err := e.rdb.Save(data)
-	if err != nil {
-		fmt.Println("RDB save failed:", err)
+// Close 停止后台调度、关闭WAL并停止各排行榜的工作线程，不保存快照，用于替换数据文件前释放引擎
+func (e *Engine) Close() {
+	e.cancel()
+	e.wg.Wait()
+	e.snapMu.Lock()
+	defer e.snapMu.Unlock()
+	if e.closed {
 		return
 	}
+	e.closed = true
+	e.wal.Close()
+	// WAL关闭后不再投递记录，快照屏障也因closed不再投递，可以关闭事件队列
+	e.stopBoards()
+}
+
+// stopBoards 停止全部排行榜的工作线程，之后写入请求不再创建排行榜
+func (e *Engine) stopBoards() {
+	e.mu.Lock()
+	e.stopped = true
+	e.mu.Unlock()
+	for _, rb := range e.allBoards() {
+		rb.stop()
+	}
+}
+
+func (e *Engine) doSnapshotAndPrune() {
+	if err := e.Snapshot(); err != nil {
+		config.Error("RDB save failed: " + err.Error())
+	}
+}
+
+// Snapshot 保存快照并删除已全部包含在各保留快照中的WAL段文件
+// 只在向各排行榜投递快照屏障时短暂暂停WAL投递，屏障之前恰好是各WAL线程LSN不大于检查点的记录；
+// 各工作线程处理到屏障时拷贝状态，拷贝之后的点击照常处理，序列化和写文件不阻塞点击
+func (e *Engine) Snapshot() error {
+	e.snapMu.Lock()
+	defer e.snapMu.Unlock()
+	if e.closed {
+		return ErrEngineClosed
+	}
+
+	// 1) 投递快照屏障并等待各工作线程拷贝快照态，本进程保存过基准快照后只拷贝变化的文件
+	delta := e.deltas >= 0 && config.RdbDeltaMax > 0
+	data := &RdbSnapshot{}
+	var pending []<-chan *RdbBoard
+	e.wal.Checkpoint(func(lsns []uint64) {
+		data.Lsns = lsns
+		for _, rb := range e.allBoards() {
+			pending = append(pending, rb.requestSnapshot(delta))
+		}
+	})
+	for _, snap := range pending {
+		data.Boards = append(data.Boards, <-snap)
+	}
+	// 文件元数据不属于排行榜状态，在工作线程之外补全
+	if infos, err := GetAllFiles(); err == nil {
+		for _, board := range data.Boards {
+			board.Meta = fileMetas(board.Files, infos)
+		}
+	} else {
+		config.Warn("读取文件信息失败，快照不含文件元数据: " + err.Error())
+	}
 
-	// 2) 删除早于 snapTs 的 WAL 段
-	_ = pruneOldWAL(e.wal.dir, snapTs)
+	// 2) 保存 RDB，失败时各排行榜的变化集合已清空，下一次必须保存全量快照
+	if err := e.save(data, delta); err != nil {
+		e.deltas = -1
+		return err
+	}
+
+	// 3) 删除已全部包含在各保留快照中的 WAL 段，最新快照损坏时仍可从更早的快照恢复
+	// 历史查询固定了WAL段文件时推迟到之后的快照再清理
+	lsns := e.rdb.RetainedLsns()
+	if lsns == nil || e.rdb.pins.Load() > 0 {
+		return nil
+	}
+	return e.wal.Prune(lsns)
 }
 
-func pruneOldWAL(dir string, snapTs int64) error {
-	// 新的WAL文件格式: wal-{threadId}-{seq}.log
-	files, _ := filepath.Glob(filepath.Join(dir, "wal-*-*.log"))
-	sort.Strings(files)
-	for _, p := range files {
-		// 简单策略：如果文件的 mtime < snapTs，就删掉
-		fi, err := os.Stat(p)
-		if err != nil {
-			continue
+// save 保存全量或增量快照，增量快照数达到上限时合并为新的基准快照
+func (e *Engine) save(data *RdbSnapshot, delta bool) error {
+	if !delta {
+		if _, _, err := e.rdb.Save(data); err != nil {
+			return err
 		}
-		if fi.ModTime().Unix() < snapTs {
-			_ = os.Remove(p)
+		e.deltas = 0
+		return nil
+	}
+	if _, err := e.rdb.SaveDelta(data); err != nil {
+		return err
+	}
+	e.deltas++
+	if e.deltas >= config.RdbDeltaMax {
+		if _, err := e.rdb.Compact(); err != nil {
+			return fmt.Errorf("compact rdb: %w", err)
 		}
+		e.deltas = 0
 	}
 	return nil
 }
+
+// fileMetas 从文件信息中提取快照保存的文件元数据
+func fileMetas(files []*File, infos map[uint64]FileInfo) map[uint64]*RdbFileMeta {
+	metas := make(map[uint64]*RdbFileMeta, len(files))
+	for _, f := range files {
+		if info, exists := infos[f.Id]; exists {
+			metas[f.Id] = &RdbFileMeta{UploadTs: info.UploadTs, Size: info.Size, Sha256: info.Sha256}
+		}
+	}
+	return metas
+}
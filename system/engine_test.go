@@ -0,0 +1,181 @@
+package system
+
+import (
+	"errors"
+	"fileClick/config"
+	"fmt"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestEngineCloseStopsBoards 关闭引擎后各排行榜的工作线程退出，不再创建新的排行榜
+func TestEngineCloseStopsBoards(t *testing.T) {
+	useTempData(t)
+	before := runtime.NumGoroutine()
+
+	e, err := NewEngine()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		if _, err := e.writableBoard(fmt.Sprintf("board-%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	e.Close()
+
+	if _, err := e.writableBoard("board-new"); !errors.Is(err, ErrEngineClosed) {
+		t.Fatalf("writableBoard after close: %v, want ErrEngineClosed", err)
+	}
+	if err := e.Click("board-0", 1, HitEvent, "", false); err == nil {
+		t.Fatal("click after close succeeded")
+	}
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			t.Fatalf("goroutines = %d after close, want %d", runtime.NumGoroutine(), before)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// 重复关闭不会再次关闭事件队列
+	e.Close()
+}
+
+// TestValidBoardName 命名空间只允许字母、数字、下划线和中划线，长度为1到64
+func TestValidBoardName(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{name: "default", want: true},
+		{name: "Docs_2024-v1", want: true},
+		{name: strings.Repeat("a", 64), want: true},
+		{name: strings.Repeat("a", 65), want: false},
+		{name: "", want: false},
+		{name: "a b", want: false},
+		{name: "a/b", want: false},
+		{name: "a.b", want: false},
+		{name: "排行", want: false},
+	}
+	for _, tt := range tests {
+		if got := ValidBoardName(tt.name); got != tt.want {
+			t.Errorf("ValidBoardName(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// TestEngineMaxBoards 排行榜数量达到上限后写入新的命名空间被拒绝，已有的排行榜和只读查询不受影响
+func TestEngineMaxBoards(t *testing.T) {
+	useTempData(t)
+	e, err := NewEngine()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+
+	for i := len(e.allBoards()); i < config.MaxBoards; i++ {
+		if err := e.Click(fmt.Sprintf("board-%d", i), 1, HitEvent, "", false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := e.Click("board-over", 1, HitEvent, "", false); !errors.Is(err, ErrTooManyBoards) {
+		t.Fatalf("click on new board = %v, want ErrTooManyBoards", err)
+	}
+	if err := e.ClickBatch("board-over", []*BatchClick{{Id: 1, Count: 1}}); !errors.Is(err, ErrTooManyBoards) {
+		t.Fatalf("batch on new board = %v, want ErrTooManyBoards", err)
+	}
+	if err := e.Click("board-1", 1, HitEvent, "", false); err != nil {
+		t.Fatalf("click on existing board = %v", err)
+	}
+	if err := e.Click("bad board", 1, HitEvent, "", false); !errors.Is(err, ErrBadBoard) {
+		t.Fatalf("click on bad board = %v, want ErrBadBoard", err)
+	}
+	if files := e.TopN("board-over", 10); len(files) != 0 || len(e.allBoards()) != config.MaxBoards {
+		t.Fatalf("boards = %d after rejected writes, want %d", len(e.allBoards()), config.MaxBoards)
+	}
+}
+
+// TestDeleteReplay 删除记录写入WAL，重启回放后文件从所有排行榜中移除，删除之后的点击重新计入
+func TestDeleteReplay(t *testing.T) {
+	type op struct {
+		kind  string // click、delete 或 snapshot
+		board string
+		id    uint64
+	}
+	tests := []struct {
+		name string
+		ops  []op
+		want map[string]map[uint64]uint64 // 重启后各排行榜中文件的点击数
+	}{
+		{
+			name: "点击后删除",
+			ops:  []op{{"click", "default", 1}, {"click", "docs", 1}, {"delete", "", 1}},
+			want: map[string]map[uint64]uint64{"default": {}, "docs": {}},
+		},
+		{
+			name: "只删除指定文件",
+			ops:  []op{{"click", "default", 1}, {"click", "default", 2}, {"delete", "", 1}},
+			want: map[string]map[uint64]uint64{"default": {2: 1}},
+		},
+		{
+			name: "删除后再次点击",
+			ops:  []op{{"click", "default", 1}, {"click", "default", 1}, {"delete", "", 1}, {"click", "default", 1}},
+			want: map[string]map[uint64]uint64{"default": {1: 1}},
+		},
+		{
+			name: "快照之后删除",
+			ops:  []op{{"click", "default", 1}, {"click", "docs", 2}, {"snapshot", "", 0}, {"delete", "", 1}},
+			want: map[string]map[uint64]uint64{"default": {}, "docs": {2: 1}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTempData(t)
+			addTestFile(t, 1, "one")
+			addTestFile(t, 2, "two")
+			e, err := NewEngine()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, o := range tt.ops {
+				switch o.kind {
+				case "click":
+					err = e.Click(o.board, o.id, HitEvent, "", false)
+				case "delete":
+					err = e.Delete(o.id)
+				case "snapshot":
+					err = e.Snapshot()
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			e.Close()
+
+			e, err = NewEngine()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer e.Close()
+			if err := e.Recover(); err != nil {
+				t.Fatal(err)
+			}
+			// 快照屏障排在回放投递的事件之后，返回时各排行榜已处理完回放的记录
+			if err := e.Snapshot(); err != nil {
+				t.Fatal(err)
+			}
+			for board, want := range tt.want {
+				got := make(map[uint64]uint64)
+				for _, f := range e.TopAll(board) {
+					got[f.Id] = f.Count
+				}
+				if !reflect.DeepEqual(got, want) {
+					t.Fatalf("board %s = %v, want %v", board, got, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,162 @@
+package system
+
+import (
+	"encoding/json"
+	"fileClick/config"
+	"sync"
+)
+
+// eventKindNum 计入排行榜的事件类型个数
+const eventKindNum = 5
+
+// eventKinds 计入排行榜的事件类型，顺序即 EventCounts 中的下标
+var eventKinds = [eventKindNum]EventType{HitEvent, ViewEvent, DownloadEvent, LikeEvent, ShareEvent}
+
+// eventNames 事件类型名称，同时作为 config.EventWeights 的键
+var eventNames = map[EventType]string{
+	HitEvent:      "click",
+	ViewEvent:     "view",
+	DownloadEvent: "download",
+	LikeEvent:     "like",
+	ShareEvent:    "share",
+}
+
+// ParseEventType 根据名称解析计入排行榜的事件类型
+func ParseEventType(name string) (EventType, bool) {
+	for typ, n := range eventNames {
+		if n == name {
+			return typ, true
+		}
+	}
+	return 0, false
+}
+
+// String 返回事件类型名称
+func (t EventType) String() string {
+	if name, ok := eventNames[t]; ok {
+		return name
+	}
+	if t == DeleteEvent {
+		return "delete"
+	}
+	return "unknown"
+}
+
+// weight 获取事件类型计入排行榜分值的权重，未配置时为1
+func (t EventType) weight() uint64 {
+	if w, ok := config.EventWeights[eventNames[t]]; ok {
+		return w
+	}
+	return 1
+}
+
+// slot 获取事件类型在 EventCounts 中的下标，非计分事件返回-1
+func (t EventType) slot() int {
+	for i, kind := range eventKinds {
+		if kind == t {
+			return i
+		}
+	}
+	return -1
+}
+
+// EventCounts 各类型事件的次数
+type EventCounts [eventKindNum]uint64
+
+// MarshalJSON 按事件名称输出各类型次数
+func (c *EventCounts) MarshalJSON() ([]byte, error) {
+	m := make(map[string]uint64, eventKindNum)
+	for i, kind := range eventKinds {
+		m[eventNames[kind]] = c[i]
+	}
+	return json.Marshal(m)
+}
+
+// EventEntry 单个文件的各类型事件次数，用于快照持久化
+type EventEntry struct {
+	Id     uint64
+	Counts EventCounts
+}
+
+// EventBoard 按类型统计每个文件的事件次数，由RankBoard工作线程写入
+type EventBoard struct {
+	mu     sync.RWMutex
+	counts map[uint64]*EventCounts
+}
+
+// NewEventBoard 创建事件计数器
+func NewEventBoard() *EventBoard {
+	return &EventBoard{
+		counts: make(map[uint64]*EventCounts),
+	}
+}
+
+// hit 记录n次指定类型的事件
+func (eb *EventBoard) hit(id uint64, typ EventType, n uint64) {
+	slot := typ.slot()
+	if slot < 0 {
+		return
+	}
+	eb.mu.Lock()
+	defer eb.mu.Unlock()
+
+	c, exists := eb.counts[id]
+	if !exists {
+		c = &EventCounts{}
+		eb.counts[id] = c
+	}
+	c[slot] = addSat(c[slot], n)
+}
+
+// delete 移除文件的事件计数
+func (eb *EventBoard) delete(id uint64) {
+	eb.mu.Lock()
+	defer eb.mu.Unlock()
+	delete(eb.counts, id)
+}
+
+// fill 填充文件的各类型事件次数
+func (eb *EventBoard) fill(files []*File) {
+	eb.mu.RLock()
+	defer eb.mu.RUnlock()
+	for _, f := range files {
+		if c, exists := eb.counts[f.Id]; exists {
+			counts := *c
+			f.Events = &counts
+		}
+	}
+}
+
+// snapshot 拷贝事件计数，ids不为nil时只拷贝其中的文件
+func (eb *EventBoard) snapshot(ids map[uint64]struct{}) []*EventEntry {
+	eb.mu.RLock()
+	defer eb.mu.RUnlock()
+
+	var entries []*EventEntry
+	if ids == nil {
+		for id, c := range eb.counts {
+			entries = append(entries, &EventEntry{Id: id, Counts: *c})
+		}
+		return entries
+	}
+	for id := range ids {
+		if c, exists := eb.counts[id]; exists {
+			entries = append(entries, &EventEntry{Id: id, Counts: *c})
+		}
+	}
+	return entries
+}
+
+// load 从快照恢复事件计数，只恢复仍在排行榜中的文件
+func (eb *EventBoard) load(entries []*EventEntry, fileMap map[uint64]*File) {
+	eb.mu.Lock()
+	defer eb.mu.Unlock()
+
+	for _, entry := range entries {
+		if _, exists := fileMap[entry.Id]; !exists {
+			continue
+		}
+		counts := entry.Counts
+		eb.counts[entry.Id] = &counts
+	}
+}
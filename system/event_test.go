@@ -0,0 +1,67 @@
+package system
+
+import (
+	"fileClick/config"
+	"reflect"
+	"testing"
+)
+
+// TestEventWeights 排行榜分值按事件类型的权重累加，各类型次数分别统计，未配置权重的类型按1计
+func TestEventWeights(t *testing.T) {
+	useTempData(t)
+	weights := config.EventWeights
+	config.EventWeights = map[string]uint64{"click": 1, "view": 1, "download": 3, "like": 5}
+	t.Cleanup(func() { config.EventWeights = weights })
+	e, err := NewEngine()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+
+	tests := []struct {
+		id         uint64
+		events     []EventType
+		wantCount  uint64
+		wantEvents EventCounts // 顺序同 eventKinds: click view download like share
+	}{
+		{id: 1, events: []EventType{HitEvent, HitEvent, ViewEvent}, wantCount: 3, wantEvents: EventCounts{2, 1, 0, 0, 0}},
+		{id: 2, events: []EventType{DownloadEvent}, wantCount: 3, wantEvents: EventCounts{0, 0, 1, 0, 0}},
+		{id: 3, events: []EventType{LikeEvent, DownloadEvent, HitEvent}, wantCount: 9, wantEvents: EventCounts{1, 0, 1, 1, 0}},
+		{id: 4, events: []EventType{ShareEvent, ShareEvent}, wantCount: 2, wantEvents: EventCounts{0, 0, 0, 0, 2}},
+	}
+	total := 0
+	for _, tt := range tests {
+		addTestFile(t, tt.id, "content")
+		for _, typ := range tt.events {
+			if err := e.Click(config.DefaultBoard, tt.id, typ, "", false); err != nil {
+				t.Fatal(err)
+			}
+			total++
+		}
+	}
+	waitFor(t, func() bool {
+		var sum uint64
+		for _, f := range e.TopAll(config.DefaultBoard) {
+			if f.Events != nil {
+				for _, n := range f.Events {
+					sum += n
+				}
+			}
+		}
+		return sum == uint64(total)
+	})
+
+	files := make(map[uint64]*File)
+	for _, f := range e.TopAll(config.DefaultBoard) {
+		files[f.Id] = f
+	}
+	for _, tt := range tests {
+		f := files[tt.id]
+		if f == nil {
+			t.Fatalf("file %d not ranked", tt.id)
+		}
+		if f.Count != tt.wantCount || !reflect.DeepEqual(*f.Events, tt.wantEvents) {
+			t.Fatalf("file %d: count %d events %v, want %d %v", tt.id, f.Count, *f.Events, tt.wantCount, tt.wantEvents)
+		}
+	}
+}
@@ -0,0 +1,342 @@
+package system
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fileClick/config"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ErrReadOnly 从节点只应用复制的记录，不接受写入
+var ErrReadOnly = errors.New("read-only follower")
+
+// ReplicationStatus 从节点的复制状态
+type ReplicationStatus struct {
+	Primary       string   `json:"primary"`
+	Connected     bool     `json:"connected"`
+	Syncs         uint64   `json:"syncs"`         // 全量同步次数
+	PrimaryLsns   []uint64 `json:"primaryLsns"`   // 最近一次心跳中主节点各WAL线程已投递的LSN
+	AppliedLsns   []uint64 `json:"appliedLsns"`   // 已应用的主节点各WAL线程的LSN
+	LagRecords    uint64   `json:"lagRecords"`    // 落后主节点的记录数
+	LagMs         int64    `json:"lagMs"`         // 距上次追平主节点的时间（毫秒）
+	LastHeartbeat int64    `json:"lastHeartbeat"` // 最近一次心跳的主节点时间戳（毫秒）
+	Error         string   `json:"error,omitempty"`
+}
+
+// follower 从节点复制状态，caughtUp为最近一次追平主节点的时间
+type follower struct {
+	mu       sync.Mutex
+	status   ReplicationStatus
+	caughtUp time.Time
+	files    chan uint64 // 待从主节点拉取内容的文件
+}
+
+// Following 是否为从节点，从节点只读
+func (e *Engine) Following() bool {
+	return e.follow != nil
+}
+
+// Follow 启动后台复制，连接主节点的复制流并应用到本引擎，断开后每隔 ReplRetryInterval 重新连接并全量同步
+// 复制的记录写入本节点的WAL并照常保存快照，缺少的文件内容在后台从主节点拉取，
+// 去掉 --follow 重启后即可作为主节点提供服务
+func (e *Engine) Follow(primary, token string) {
+	e.follow = &follower{
+		status: ReplicationStatus{Primary: primary},
+		files:  make(chan uint64, config.ReplFileQueue),
+	}
+	e.wg.Add(2)
+	go func() {
+		defer e.wg.Done()
+		e.fetchFiles(primary, token)
+	}()
+	go func() {
+		defer e.wg.Done()
+		for {
+			err := e.followOnce(primary, token)
+			e.follow.update(func(s *ReplicationStatus) {
+				s.Connected = false
+				if err != nil {
+					s.Error = err.Error()
+				}
+			})
+			if err != nil && !errors.Is(err, context.Canceled) {
+				config.Warn("复制流断开: " + err.Error())
+			}
+			select {
+			case <-e.ctx.Done():
+				return
+			case <-time.After(config.ReplRetryInterval):
+			}
+		}
+	}()
+}
+
+// followOnce 连接一次复制流，直到断开
+func (e *Engine) followOnce(primary, token string) error {
+	req, err := http.NewRequestWithContext(e.ctx, http.MethodGet, primary+"/replication/stream", nil)
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("replication stream: %s", resp.Status)
+	}
+
+	// 超过 ReplTimeout 没有收到任何帧时断开重连
+	timer := time.AfterFunc(config.ReplTimeout, func() { _ = resp.Body.Close() })
+	defer timer.Stop()
+	br := bufio.NewReader(resp.Body)
+	var recs []*WalRecord
+	for {
+		typ, data, err := readReplFrame(br)
+		if err != nil {
+			return err
+		}
+		timer.Reset(config.ReplTimeout)
+		switch typ {
+		case replFrameFiles:
+			var files map[uint64]FileInfo
+			if err := json.Unmarshal(data, &files); err != nil {
+				return err
+			}
+			if err := ReplaceAllFiles(files); err != nil {
+				return err
+			}
+			for id, info := range files {
+				e.follow.queueFile(id, &info)
+			}
+		case replFrameSnapshot:
+			if err := e.syncSnapshot(data); err != nil {
+				return err
+			}
+		case replFrameFile:
+			id, n := binary.Uvarint(data)
+			var info FileInfo
+			if n <= 0 || json.Unmarshal(data[n:], &info) != nil {
+				return errors.New("bad replication file frame")
+			}
+			if err := AddFile(id, &info); err != nil {
+				return err
+			}
+			e.follow.queueFile(id, &info)
+		case replFrameRecord:
+			rec, err := decodeWalPayload(data, walVersion)
+			if err != nil {
+				return err
+			}
+			recs = append(recs, rec)
+		case replFrameHeartbeat:
+			tsMs, lsns, err := decodeReplHeartbeat(data)
+			if err != nil {
+				return err
+			}
+			e.follow.update(func(s *ReplicationStatus) {
+				s.LastHeartbeat = tsMs
+				s.PrimaryLsns = lsns
+			})
+		default:
+			// 未知的帧类型直接跳过，兼容更新版本的主节点
+		}
+		// 已读完收到的数据或积累了一批记录时写入本节点的WAL
+		if len(recs) > 0 && (br.Buffered() == 0 || len(recs) >= config.ClickBatchMax) {
+			if err := e.applyReplicated(recs); err != nil {
+				return err
+			}
+			recs = nil
+		}
+	}
+}
+
+// syncSnapshot 用主节点的全量快照替换本节点的排行榜，并保存为本节点的基准快照
+func (e *Engine) syncSnapshot(data []byte) error {
+	ld, err := decodeRdb("replication", data)
+	if err != nil {
+		return err
+	}
+	e.resetBoards(ld.Boards)
+	e.follow.update(func(s *ReplicationStatus) {
+		s.Connected = true
+		s.Syncs++
+		s.AppliedLsns = ld.Lsns
+		s.Error = ""
+	})
+	config.Info(fmt.Sprintf("已从主节点全量同步，排行榜数: %d", len(ld.Boards)))
+	// 本节点WAL中同步之前的记录已被快照覆盖，快照检查点之后只有复制的记录
+	return e.Snapshot()
+}
+
+// resetBoards 丢弃当前的排行榜并从快照加载，下一次快照保存为全量快照
+func (e *Engine) resetBoards(boards []*RdbBoard) {
+	e.snapMu.Lock()
+	defer e.snapMu.Unlock()
+	e.mu.Lock()
+	old := e.boards
+	e.boards = make(map[string]*RankBoard, len(boards))
+	for _, board := range boards {
+		rb := newRankBoard(board.Name, e.history)
+		rb.load(board)
+		e.boards[board.Name] = rb
+	}
+	e.deltas = -1
+	e.mu.Unlock()
+	for _, rb := range old {
+		rb.stop()
+	}
+}
+
+// applyReplicated 将复制的记录写入本节点的WAL，写入成功后由WAL投递到排行榜
+// 记录保留主节点的时间戳，LSN由本节点重新分配
+func (e *Engine) applyReplicated(recs []*WalRecord) error {
+	applied := make(map[int]uint64)
+	var deleted []uint64
+	for _, rec := range recs {
+		applied[walThreadOf(rec.FileId)] = rec.Lsn
+		if rec.Op == WalOpDelete {
+			deleted = append(deleted, rec.FileId)
+		}
+	}
+	if err := e.wal.AppendBatch(recs); err != nil {
+		return err
+	}
+	for _, id := range deleted {
+		if info, err := GetFileByID(id); err == nil {
+			_ = os.Remove(info.Path)
+		}
+		_ = RemoveFile(id)
+	}
+	e.follow.update(func(s *ReplicationStatus) {
+		for i, lsn := range applied {
+			if i < len(s.AppliedLsns) {
+				s.AppliedLsns[i] = lsn
+			}
+		}
+	})
+	return nil
+}
+
+// queueFile 本节点没有文件内容时加入拉取队列
+func (f *follower) queueFile(id uint64, info *FileInfo) {
+	if _, err := os.Stat(info.Path); err == nil {
+		return
+	}
+	select {
+	case f.files <- id:
+	default:
+	}
+}
+
+// fetchFiles 依次从主节点拉取队列中的文件内容，直到引擎关闭
+func (e *Engine) fetchFiles(primary, token string) {
+	for {
+		select {
+		case <-e.ctx.Done():
+			return
+		case id := <-e.follow.files:
+			if err := e.fetchFile(primary, token, id); err != nil && !errors.Is(err, context.Canceled) {
+				config.Warn(fmt.Sprintf("拉取文件内容失败: %d, %v", id, err))
+			}
+		}
+	}
+}
+
+// fetchFile 从主节点拉取一个文件的内容，校验SHA-256后改名为文件信息中的路径
+// 文件已删除或内容已存在时不做修改，失败的文件在下次全量同步时重新拉取
+func (e *Engine) fetchFile(primary, token string, id uint64) error {
+	info, err := GetFileByID(id)
+	if err != nil {
+		return nil
+	}
+	if _, err := os.Stat(info.Path); err == nil {
+		return nil
+	}
+	// 只写入文件目录，不信任主节点发来的路径
+	if filepath.Clean(filepath.Dir(info.Path)) != filepath.Clean(config.FilePath) {
+		return fmt.Errorf("bad file path: %s", info.Path)
+	}
+	req, err := http.NewRequestWithContext(e.ctx, http.MethodGet, fmt.Sprintf("%s/replication/file?id=%d", primary, id), nil)
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("fetch file: %s", resp.Status)
+	}
+
+	tmp, err := os.CreateTemp(config.FilePath, ".repl-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tmp, hash), resp.Body)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if info.Sha256 != "" && hex.EncodeToString(hash.Sum(nil)) != info.Sha256 {
+		return errors.New("sha256 mismatch")
+	}
+	return os.Rename(tmp.Name(), info.Path)
+}
+
+// update 修改复制状态并重新计算延迟
+func (f *follower) update(fn func(s *ReplicationStatus)) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if fn != nil {
+		fn(&f.status)
+	}
+	s := &f.status
+	s.LagRecords = 0
+	for i := 0; i < len(s.PrimaryLsns) && i < len(s.AppliedLsns); i++ {
+		if s.PrimaryLsns[i] > s.AppliedLsns[i] {
+			s.LagRecords += s.PrimaryLsns[i] - s.AppliedLsns[i]
+		}
+	}
+	now := time.Now()
+	if s.Connected && s.LagRecords == 0 {
+		f.caughtUp = now
+	}
+	s.LagMs = 0
+	if !f.caughtUp.IsZero() {
+		s.LagMs = now.Sub(f.caughtUp).Milliseconds()
+	}
+}
+
+// snapshot 拷贝复制状态
+func (f *follower) snapshot() *ReplicationStatus {
+	f.update(nil)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s := f.status
+	s.PrimaryLsns = append([]uint64(nil), s.PrimaryLsns...)
+	s.AppliedLsns = append([]uint64(nil), s.AppliedLsns...)
+	return &s
+}
@@ -0,0 +1,118 @@
+package system
+
+import (
+	"errors"
+	"fileClick/config"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// ErrHistoryBusy 同时重建的历史排行榜已达 config.HistoryRebuildMax
+var ErrHistoryBusy = errors.New("too many history rebuilds")
+
+// historySlots 限制同时重建的历史排行榜数
+var historySlots = make(chan struct{}, config.HistoryRebuildMax)
+
+// AsOf 重建asOf时刻的排行榜并交给fn查询，fn返回后丢弃
+// 从时间戳不晚于asOf的最新保留基准快照开始，回放WAL中检查点之后、时间戳不晚于asOf的记录；
+// 只在固定快照和WAL段文件列表时持有快照锁，重建期间不清理这些文件，不影响点击和快照
+func (e *Engine) AsOf(asOf int64, fn func(h *Engine)) error {
+	select {
+	case historySlots <- struct{}{}:
+		defer func() { <-historySlots }()
+	default:
+		return ErrHistoryBusy
+	}
+
+	bases, segments, err := e.pinHistory(asOf)
+	if err != nil {
+		return err
+	}
+	defer e.rdb.pins.Add(-1)
+
+	base, err := loadFirstRdb(bases)
+	if err != nil {
+		// 各WAL线程的段文件都没有被清理过时从头回放
+		if !walComplete(segments) {
+			return fmt.Errorf("no retained rdb before %d", asOf)
+		}
+		base = &RdbLoadResult{Boards: []*RdbBoard{}}
+	}
+	h := &Engine{boards: make(map[string]*RankBoard), history: true}
+	defer h.stopBoards()
+	for _, board := range base.Boards {
+		h.board(board.Name).load(board)
+	}
+	// 记录的时间戳最多晚于写入时刻 config.ClickTsSkew，第一条晚于stopTs的记录及其之后的记录都在asOf之后写入，
+	// 不再回放；asOf之后补报的更早点击不计入历史排行榜
+	stopTs := asOf + int64(config.ClickTsSkew/time.Second)
+	apply := func(rec *WalRecord) error {
+		if rec.Ts > stopTs {
+			return errReplayStop
+		}
+		if rec.Ts <= asOf {
+			h.apply(rec)
+		}
+		return nil
+	}
+	if err := e.wal.replaySegments(segments, base.SnapshotTs, base.Lsns, apply); err != nil {
+		return err
+	}
+	// 等待各工作线程处理完回放的事件
+	for _, rb := range h.allBoards() {
+		<-rb.requestCopy()
+	}
+	fn(h)
+	return nil
+}
+
+// pinHistory 列出时间戳不晚于asOf的基准快照（从新到旧）和当前的WAL段文件，
+// 并固定这些文件，调用方用完后需执行 e.rdb.pins.Add(-1)
+func (e *Engine) pinHistory(asOf int64) ([]string, [][]*WalSegment, error) {
+	e.snapMu.Lock()
+	defer e.snapMu.Unlock()
+	if e.closed {
+		return nil, nil, ErrEngineClosed
+	}
+	segments, err := e.wal.segments()
+	if err != nil {
+		return nil, nil, err
+	}
+	e.rdb.pins.Add(1)
+	return e.rdb.basesAsOf(asOf), segments, nil
+}
+
+// basesAsOf 列出时间戳不晚于asOf的基准快照，从新到旧排列
+func (r *Rdb) basesAsOf(asOf int64) []string {
+	matches, _ := filepath.Glob(filepath.Join(r.dir, "dump-*.rdb"))
+	sort.Sort(sort.Reverse(sort.StringSlice(matches)))
+	bases := make([]string, 0, len(matches))
+	for _, path := range matches {
+		if ts, ok := rdbBaseTs(path); ok && ts <= asOf {
+			bases = append(bases, path)
+		}
+	}
+	return bases
+}
+
+// loadFirstRdb 依次加载快照文件，返回第一个可用的快照，不合并增量快照
+func loadFirstRdb(paths []string) (*RdbLoadResult, error) {
+	for _, path := range paths {
+		res, err := ReadRdbFile(path)
+		if err != nil {
+			config.Error("RDB快照校验失败，尝试更早的快照: " + err.Error())
+			continue
+		}
+		return res, nil
+	}
+	return nil, errors.New("no usable rdb")
+}
+
+// rdbBaseTs 从基准快照文件名 dump-<ts>.rdb 中解析时间戳
+func rdbBaseTs(path string) (int64, bool) {
+	var ts int64
+	_, err := fmt.Sscanf(filepath.Base(path), "dump-%d.rdb", &ts)
+	return ts, err == nil
+}
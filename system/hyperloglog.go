@@ -0,0 +1,275 @@
+package system
+
+import (
+	"hash/fnv"
+	"math"
+	"math/bits"
+	"slices"
+	"sync"
+)
+
+const (
+	hllPrecision = 10                // 寄存器索引位数
+	hllRegisters = 1 << hllPrecision // 寄存器个数，标准误差约 1.04/sqrt(1024) ≈ 3.3%
+	// hllSparseMax 稀疏表示最多保存的访客哈希数，64个哈希占512字节，超过后转为1 KiB的寄存器
+	hllSparseMax = 64
+)
+
+// HyperLogLog 基数估计草图，用于近似统计独立访客数
+// 大部分文件的访客很少，访客数不超过 hllSparseMax 时只保存访客哈希的有序集合，计数精确；超过后转为寄存器
+type HyperLogLog struct {
+	sparse    []uint64             // 按升序排列的访客哈希，registers为nil时使用
+	registers *[hllRegisters]uint8 // 稠密表示的寄存器
+}
+
+// newHyperLogLog 从快照恢复草图，registers不为nil时使用稠密表示
+func newHyperLogLog(hashes []uint64, registers *[hllRegisters]uint8) HyperLogLog {
+	if registers != nil {
+		r := *registers
+		return HyperLogLog{registers: &r}
+	}
+	h := HyperLogLog{}
+	for _, hash := range hashes {
+		h.Add(hash)
+	}
+	return h
+}
+
+// Add 加入一个访客哈希，草图发生变化时返回true
+func (h *HyperLogLog) Add(hash uint64) bool {
+	if h.registers == nil {
+		i, found := slices.BinarySearch(h.sparse, hash)
+		if found {
+			return false
+		}
+		if len(h.sparse) < hllSparseMax {
+			h.sparse = slices.Insert(h.sparse, i, hash)
+			return true
+		}
+		h.registers = new([hllRegisters]uint8)
+		for _, v := range h.sparse {
+			h.addDense(v)
+		}
+		h.sparse = nil
+		h.addDense(hash)
+		return true
+	}
+	return h.addDense(hash)
+}
+
+// addDense 更新寄存器，寄存器发生变化时返回true
+func (h *HyperLogLog) addDense(hash uint64) bool {
+	idx := hash >> (64 - hllPrecision)
+	// 低位补1，保证前导零个数不超过剩余位数
+	w := hash<<hllPrecision | 1<<(hllPrecision-1)
+	rho := uint8(bits.LeadingZeros64(w)) + 1
+	if rho > h.registers[idx] {
+		h.registers[idx] = rho
+		return true
+	}
+	return false
+}
+
+// Estimate 估计独立访客数，稀疏表示时为精确值
+func (h *HyperLogLog) Estimate() uint64 {
+	if h.registers == nil {
+		return uint64(len(h.sparse))
+	}
+	m := float64(hllRegisters)
+	sum := 0.0
+	zeros := 0
+	for _, r := range h.registers {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+	est := 0.7213 / (1 + 1.079/m) * m * m / sum
+	// 小基数时使用线性计数修正
+	if est <= 2.5*m && zeros > 0 {
+		est = m * math.Log(m/float64(zeros))
+	}
+	return uint64(est + 0.5)
+}
+
+// HashVisitor 计算访客标识的64位哈希，0保留表示未知访客
+func HashVisitor(visitor string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(visitor))
+	// splitmix64 混淆，使高位分布足够均匀
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	if x == 0 {
+		x = 1
+	}
+	return x
+}
+
+// UniqueEntry 单个文件的访客草图，用于快照持久化
+type UniqueEntry struct {
+	Id        uint64
+	Hashes    []uint64             // 稀疏表示的访客哈希，Registers为nil时使用
+	Registers *[hllRegisters]uint8 // 稠密表示的寄存器
+}
+
+// newUniqueEntry 拷贝草图
+func newUniqueEntry(id uint64, h *HyperLogLog) *UniqueEntry {
+	entry := &UniqueEntry{Id: id}
+	if h.registers != nil {
+		r := *h.registers
+		entry.Registers = &r
+	} else {
+		entry.Hashes = slices.Clone(h.sparse)
+	}
+	return entry
+}
+
+// Estimate 估计草图中的独立访客数
+func (e *UniqueEntry) Estimate() uint64 {
+	h := newHyperLogLog(e.Hashes, e.Registers)
+	return h.Estimate()
+}
+
+// uniqueCounter 单个文件的访客草图
+type uniqueCounter struct {
+	fileName string
+	hll      HyperLogLog
+	estimate uint64 // 缓存的估计值，寄存器变化时重新计算
+}
+
+// UniqueBoard 独立访客排行榜，由RankBoard工作线程写入
+// 估计值按文件缓存，并用跳表维护按估计值排序的索引，查询时不再逐个估计和排序
+type UniqueBoard struct {
+	mu       sync.RWMutex
+	counters map[uint64]*uniqueCounter
+	order    *SkipList // 按估计值降序、ID升序排列，节点的count为估计值
+}
+
+// NewUniqueBoard 创建独立访客排行榜
+func NewUniqueBoard() *UniqueBoard {
+	return &UniqueBoard{
+		counters: make(map[uint64]*uniqueCounter),
+		order:    NewSkipList(),
+	}
+}
+
+// refresh 重新估计文件的独立访客数，估计值变化时更新排序索引，调用方持有写锁
+func (ub *UniqueBoard) refresh(id uint64, c *uniqueCounter) {
+	estimate := c.hll.Estimate()
+	if estimate == c.estimate && c.estimate != 0 {
+		return
+	}
+	c.estimate = estimate
+	ub.order.update(&File{Id: id, FileName: c.fileName, Count: estimate})
+}
+
+// hit 记录一次访问，visitor为0时忽略
+func (ub *UniqueBoard) hit(file *File, visitor uint64) {
+	if visitor == 0 {
+		return
+	}
+	ub.mu.Lock()
+	defer ub.mu.Unlock()
+
+	c, exists := ub.counters[file.Id]
+	if !exists {
+		c = &uniqueCounter{fileName: file.FileName}
+		ub.counters[file.Id] = c
+	}
+	// 大部分访问不改变寄存器，只有寄存器变化时才重新估计
+	if c.hll.Add(visitor) {
+		ub.refresh(file.Id, c)
+	}
+}
+
+// delete 移除文件的访客草图
+func (ub *UniqueBoard) delete(id uint64) {
+	ub.mu.Lock()
+	defer ub.mu.Unlock()
+	delete(ub.counters, id)
+	ub.order.Delete(id)
+}
+
+// fill 填充文件的独立访客数
+func (ub *UniqueBoard) fill(files []*File) {
+	ub.mu.RLock()
+	defer ub.mu.RUnlock()
+	for _, f := range files {
+		if c, exists := ub.counters[f.Id]; exists {
+			f.Unique = c.estimate
+		}
+	}
+}
+
+// uniqueFiles 将排序索引返回的文件转换为独立访客数
+func uniqueFiles(files []*File) []*File {
+	for _, f := range files {
+		f.Unique, f.Count = f.Count, 0
+	}
+	return files
+}
+
+// topN 获取独立访客数前N的文件
+func (ub *UniqueBoard) topN(n int) []*File {
+	return uniqueFiles(ub.order.TopN(n))
+}
+
+// all 获取全部文件，按独立访客数降序、ID升序排列
+func (ub *UniqueBoard) all() []*File {
+	return uniqueFiles(ub.order.TopAll())
+}
+
+// page 按偏移量分页，同时返回文件总数
+func (ub *UniqueBoard) page(offset, limit int) ([]*File, int) {
+	files, total := ub.order.Page(offset, limit)
+	return uniqueFiles(files), total
+}
+
+// pageAfter 获取排在 (unique, id) 之后的limit个文件，同时返回文件总数
+func (ub *UniqueBoard) pageAfter(unique, id uint64, limit int) ([]*File, int) {
+	files, total := ub.order.PageAfter(unique, id, limit)
+	return uniqueFiles(files), total
+}
+
+// snapshot 拷贝访客草图，ids不为nil时只拷贝其中的文件
+func (ub *UniqueBoard) snapshot(ids map[uint64]struct{}) []*UniqueEntry {
+	ub.mu.RLock()
+	defer ub.mu.RUnlock()
+
+	var entries []*UniqueEntry
+	if ids == nil {
+		for id, c := range ub.counters {
+			entries = append(entries, newUniqueEntry(id, &c.hll))
+		}
+		return entries
+	}
+	for id := range ids {
+		if c, exists := ub.counters[id]; exists {
+			entries = append(entries, newUniqueEntry(id, &c.hll))
+		}
+	}
+	return entries
+}
+
+// load 从快照恢复访客草图，fileMap用于补全文件名
+func (ub *UniqueBoard) load(entries []*UniqueEntry, fileMap map[uint64]*File) {
+	ub.mu.Lock()
+	defer ub.mu.Unlock()
+
+	for _, entry := range entries {
+		file, exists := fileMap[entry.Id]
+		if !exists {
+			continue
+		}
+		c := &uniqueCounter{
+			fileName: file.FileName,
+			hll:      newHyperLogLog(entry.Hashes, entry.Registers),
+		}
+		ub.counters[entry.Id] = c
+		ub.refresh(entry.Id, c)
+	}
+}
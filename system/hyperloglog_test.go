@@ -0,0 +1,75 @@
+package system
+
+import (
+	"strconv"
+	"testing"
+)
+
+// TestHyperLogLogSparse 访客数不超过 hllSparseMax 时精确计数，超过后转为寄存器，估计误差在标准误差的几倍以内
+func TestHyperLogLogSparse(t *testing.T) {
+	tests := []struct {
+		name     string
+		visitors int
+		repeat   int // 每个访客重复访问的次数
+		dense    bool
+	}{
+		{name: "单个访客", visitors: 1, repeat: 3},
+		{name: "稀疏上限", visitors: hllSparseMax, repeat: 2},
+		{name: "超过上限转为寄存器", visitors: hllSparseMax + 1, repeat: 1, dense: true},
+		{name: "大量访客", visitors: 20000, repeat: 2, dense: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var h HyperLogLog
+			for r := 0; r < tt.repeat; r++ {
+				for i := 0; i < tt.visitors; i++ {
+					changed := h.Add(HashVisitor(strconv.Itoa(i)))
+					if r > 0 && changed {
+						t.Fatalf("repeated visitor %d changed the sketch", i)
+					}
+				}
+			}
+			if dense := h.registers != nil; dense != tt.dense {
+				t.Fatalf("dense = %v, want %v", dense, tt.dense)
+			}
+			est := float64(h.Estimate())
+			if !tt.dense && est != float64(tt.visitors) {
+				t.Fatalf("estimate = %v, want exact %d", est, tt.visitors)
+			}
+			if diff := est/float64(tt.visitors) - 1; diff > 0.1 || diff < -0.1 {
+				t.Fatalf("estimate = %v for %d visitors", est, tt.visitors)
+			}
+		})
+	}
+}
+
+// TestUniqueBoardSnapshotSparse 快照和恢复保留稀疏表示，恢复后的估计值不变
+func TestUniqueBoardSnapshotSparse(t *testing.T) {
+	ub := NewUniqueBoard()
+	small, large := &File{Id: 1, FileName: "a.txt"}, &File{Id: 2, FileName: "b.txt"}
+	for i := 0; i < 5; i++ {
+		ub.hit(small, HashVisitor(strconv.Itoa(i)))
+	}
+	for i := 0; i < 500; i++ {
+		ub.hit(large, HashVisitor(strconv.Itoa(i)))
+	}
+
+	entries := ub.snapshot(nil)
+	restored := NewUniqueBoard()
+	restored.load(entries, map[uint64]*File{1: small, 2: large})
+	for _, e := range entries {
+		if sparse := e.Registers == nil; sparse != (e.Id == 1) {
+			t.Fatalf("entry %d sparse = %v", e.Id, sparse)
+		}
+	}
+	want, got := ub.all(), restored.all()
+	if len(got) != 2 || got[0].Id != 2 || got[1].Id != 1 || got[1].Unique != 5 {
+		t.Fatalf("restored = %+v", got)
+	}
+	if got[0].Unique != want[0].Unique {
+		t.Fatalf("restored estimate = %d, want %d", got[0].Unique, want[0].Unique)
+	}
+	if restored.counters[1].hll.registers != nil {
+		t.Fatal("restored sparse sketch became dense")
+	}
+}
@@ -0,0 +1,363 @@
+package system
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fileClick/config"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// 文件信息日志: magic "FCMT" | version(2) | 记录...
+// 每条记录与WAL相同为 len(4) | crc(4) | 负载，负载为 op(1) | fileId(8) | FileInfo的JSON（删除时为空）；
+// 每次写入追加一条记录并刷盘，内存中保存全部文件信息，失效记录过多时重写日志压缩
+const (
+	metaMagic   = "FCMT"
+	metaVersion = 1
+	metaHeader  = 6
+	metaLogName = "files.log"
+	// metaMaxRecord 单条记录负载的最大长度，超过时按损坏处理
+	metaMaxRecord = 1 << 20
+)
+
+const (
+	metaOpPut    byte = 1
+	metaOpDelete byte = 2
+)
+
+// MetaStore 文件信息存储
+type MetaStore struct {
+	mu    sync.RWMutex
+	path  string
+	f     *os.File
+	files map[uint64]FileInfo
+	names *nameIndex
+	dead  int // 被覆盖或删除的失效记录数
+}
+
+// OpenMetaStore 打开dir中的文件信息日志，日志不存在而legacy中有旧的JSON文件时先迁移
+// 尾部不完整的最后一条记录是写入时崩溃留下的，截断后继续追加；中间的记录损坏时返回错误，不修改日志
+func OpenMetaStore(dir, legacy string) (*MetaStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	s := &MetaStore{path: filepath.Join(dir, metaLogName), files: make(map[uint64]FileInfo)}
+	if _, err := os.Stat(s.path); os.IsNotExist(err) {
+		if err := s.migrate(legacy); err != nil {
+			return nil, err
+		}
+	}
+	validSize, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	s.names = newNameIndex(s.files)
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if fi, err := f.Stat(); err == nil && fi.Size() > validSize {
+		config.Warn(fmt.Sprintf("文件信息日志尾部不完整: %s, 截断%d字节", s.path, fi.Size()-validSize))
+		if err := f.Truncate(validSize); err != nil {
+			_ = f.Close()
+			return nil, err
+		}
+	}
+	s.f = f
+	return s, nil
+}
+
+// migrate 将旧的JSON文件写入新日志，完成后JSON文件改名为 .migrated
+func (s *MetaStore) migrate(legacy string) error {
+	data, err := os.ReadFile(legacy)
+	if os.IsNotExist(err) {
+		return s.rewrite(nil)
+	}
+	if err != nil {
+		return err
+	}
+	var files map[uint64]FileInfo
+	if err := json.Unmarshal(data, &files); err != nil {
+		return fmt.Errorf("migrate %s: %w", legacy, err)
+	}
+	if err := s.rewrite(files); err != nil {
+		return err
+	}
+	config.Info(fmt.Sprintf("已将%s迁移到%s，文件数: %d", legacy, s.path, len(files)))
+	return os.Rename(legacy, legacy+".migrated")
+}
+
+// load 读取日志重建内存索引，返回最后一条完整记录的结束偏移
+func (s *MetaStore) load() (int64, error) {
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return 0, err
+	}
+	if len(data) < metaHeader || string(data[:len(metaMagic)]) != metaMagic {
+		return 0, fmt.Errorf("bad meta log header: %s", s.path)
+	}
+	if v := binary.LittleEndian.Uint16(data[4:6]); v > metaVersion {
+		return 0, fmt.Errorf("unsupported meta log version: %d", v)
+	}
+	offset := metaHeader
+	records := 0
+	for offset < len(data) {
+		// 写入时崩溃只会留下最后一条不完整的记录，或文件系统补齐的全0尾部
+		if offset+8 > len(data) || allZero(data[offset:]) {
+			break
+		}
+		length := int(binary.LittleEndian.Uint32(data[offset : offset+4]))
+		sum := binary.LittleEndian.Uint32(data[offset+4 : offset+8])
+		if length < 9 || length > metaMaxRecord {
+			return 0, fmt.Errorf("%w: %s, 偏移: %d, bad length %d", errMetaCorrupt, s.path, offset, length)
+		}
+		end := offset + 8 + length
+		if end > len(data) {
+			break
+		}
+		var err error
+		if crc32.ChecksumIEEE(data[offset+8:end]) != sum {
+			err = errors.New("crc mismatch")
+		} else {
+			err = s.replay(data[offset+8 : end])
+		}
+		if err != nil {
+			if end == len(data) {
+				break
+			}
+			// 中间的记录损坏时不截断，避免丢失之后的有效记录
+			return 0, fmt.Errorf("%w: %s, 偏移: %d, %v", errMetaCorrupt, s.path, offset, err)
+		}
+		records++
+		offset = end
+	}
+	s.dead = records - len(s.files)
+	return int64(offset), nil
+}
+
+// allZero data是否全为0
+func allZero(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// replay 应用一条记录的负载
+func (s *MetaStore) replay(payload []byte) error {
+	id := binary.LittleEndian.Uint64(payload[1:9])
+	switch payload[0] {
+	case metaOpPut:
+		var info FileInfo
+		if err := json.Unmarshal(payload[9:], &info); err != nil {
+			return err
+		}
+		s.files[id] = info
+	case metaOpDelete:
+		delete(s.files, id)
+	default:
+		return fmt.Errorf("unknown meta op %d", payload[0])
+	}
+	return nil
+}
+
+// encodeMetaRecord 编码一条完整记录
+func encodeMetaRecord(op byte, id uint64, info *FileInfo) ([]byte, error) {
+	payload := []byte{op}
+	payload = binary.LittleEndian.AppendUint64(payload, id)
+	if info != nil {
+		data, err := json.Marshal(info)
+		if err != nil {
+			return nil, err
+		}
+		payload = append(payload, data...)
+	}
+	rec := binary.LittleEndian.AppendUint32(nil, uint32(len(payload)))
+	rec = binary.LittleEndian.AppendUint32(rec, crc32.ChecksumIEEE(payload))
+	return append(rec, payload...), nil
+}
+
+// append 追加一条记录并刷盘，成功后更新内存索引
+func (s *MetaStore) append(op byte, id uint64, info *FileInfo) error {
+	rec, err := encodeMetaRecord(op, id, info)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f == nil {
+		return errMetaClosed
+	}
+	if _, err := s.f.Write(rec); err != nil {
+		return err
+	}
+	if err := s.f.Sync(); err != nil {
+		return err
+	}
+	_, exists := s.files[id]
+	if op == metaOpPut {
+		s.files[id] = *info
+		s.names.put(id, info.Name)
+	} else {
+		delete(s.files, id)
+		s.names.remove(id)
+	}
+	// 覆盖或删除使原记录失效，删除记录本身也是失效记录，与重新打开时的计数一致
+	if exists {
+		s.dead++
+	}
+	if op == metaOpDelete {
+		s.dead++
+	}
+	// 失效记录超过有效记录时压缩，压缩失败不影响已写入的记录
+	if s.dead > config.MetaCompactMin && s.dead > len(s.files) {
+		if err := s.compactLocked(); err != nil {
+			config.Error("压缩文件信息日志失败: " + err.Error())
+		}
+	}
+	return nil
+}
+
+// compactLocked 用当前全部文件信息重写日志并重新打开
+func (s *MetaStore) compactLocked() error {
+	if err := s.rewrite(s.files); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	_ = s.f.Close()
+	s.f = f
+	s.dead = 0
+	return nil
+}
+
+// rewrite 将files写入临时文件并刷盘，再替换日志
+func (s *MetaStore) rewrite(files map[uint64]FileInfo) error {
+	data := append([]byte(metaMagic), 0, 0)
+	binary.LittleEndian.PutUint16(data[4:6], metaVersion)
+	for id, info := range files {
+		rec, err := encodeMetaRecord(metaOpPut, id, &info)
+		if err != nil {
+			return err
+		}
+		data = append(data, rec...)
+	}
+	return replaceFile(s.path, data)
+}
+
+// Put 保存文件信息
+func (s *MetaStore) Put(id uint64, info *FileInfo) error {
+	return s.append(metaOpPut, id, info)
+}
+
+// Delete 删除文件信息，文件不存在时不做修改
+func (s *MetaStore) Delete(id uint64) error {
+	if _, err := s.Get(id); err != nil {
+		return nil
+	}
+	return s.append(metaOpDelete, id, nil)
+}
+
+// Get 根据ID获取文件信息
+func (s *MetaStore) Get(id uint64) (*FileInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if info, exists := s.files[id]; exists {
+		return &info, nil
+	}
+	return nil, fmt.Errorf("文件不存在, Id: %d", id)
+}
+
+// All 拷贝全部文件信息
+func (s *MetaStore) All() map[uint64]FileInfo {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	files := make(map[uint64]FileInfo, len(s.files))
+	for id, info := range s.files {
+		files[id] = info
+	}
+	return files
+}
+
+// Replace 用files替换全部文件信息
+func (s *MetaStore) Replace(files map[uint64]FileInfo) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f == nil {
+		return errMetaClosed
+	}
+	old := s.files
+	s.files = make(map[uint64]FileInfo, len(files))
+	for id, info := range files {
+		s.files[id] = info
+	}
+	if err := s.compactLocked(); err != nil {
+		s.files = old
+		return err
+	}
+	s.names = newNameIndex(s.files)
+	return nil
+}
+
+// Search 按名称顺序返回匹配q的文件
+func (s *MetaStore) Search(q *FileQuery) []*FileEntry {
+	var entries []*FileEntry
+	s.Scan(q, func(id uint64, info *FileInfo) bool {
+		entries = append(entries, &FileEntry{Id: id, FileInfo: *info})
+		return true
+	})
+	return entries
+}
+
+// Scan 按名称顺序对匹配q的文件调用fn，fn返回false时停止；扫描期间持有读锁，fn中不能修改存储
+func (s *MetaStore) Scan(q *FileQuery, fn func(id uint64, info *FileInfo) bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	s.names.each(q, func(id uint64) bool {
+		info := s.files[id]
+		return fn(id, &info)
+	})
+}
+
+// Close 关闭日志，之后的写入返回错误
+func (s *MetaStore) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f != nil {
+		_ = s.f.Close()
+		s.f = nil
+	}
+}
+
+var errMetaClosed = errors.New("meta store closed")
+
+// errMetaCorrupt 文件信息日志中间的记录损坏，需要人工处理，不自动截断
+var errMetaCorrupt = errors.New("meta log corrupt")
+
+// metaStore 服务使用的文件信息存储，首次使用时打开
+var (
+	metaMu    sync.Mutex
+	metaStore *MetaStore
+)
+
+// fileStore 返回服务使用的文件信息存储，尚未打开时按配置的目录打开
+func fileStore() (*MetaStore, error) {
+	metaMu.Lock()
+	defer metaMu.Unlock()
+	if metaStore == nil {
+		s, err := OpenMetaStore(config.MetaPath, config.FileInfoPath)
+		if err != nil {
+			return nil, err
+		}
+		metaStore = s
+	}
+	return metaStore, nil
+}
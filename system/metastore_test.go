@@ -0,0 +1,297 @@
+package system
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fileClick/config"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// openMeta 打开dir中的文件信息日志，测试结束时关闭
+func openMeta(t *testing.T, dir, legacy string) *MetaStore {
+	t.Helper()
+	s, err := OpenMetaStore(dir, legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Close)
+	return s
+}
+
+func metaInfo(name string) *FileInfo {
+	return &FileInfo{Name: name, Path: "data/files/" + name, Size: int64(len(name))}
+}
+
+func TestMetaStoreReopen(t *testing.T) {
+	dir := t.TempDir()
+	s := openMeta(t, dir, "")
+	for id, name := range map[uint64]string{1: "a.txt", 2: "b.txt", 3: "c.txt"} {
+		if err := s.Put(id, metaInfo(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Put(2, metaInfo("b2.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete(3); err != nil {
+		t.Fatal(err)
+	}
+	// 被覆盖的记录、被删除的记录和删除记录本身
+	if s.dead != 3 {
+		t.Fatalf("dead records = %d, want 3", s.dead)
+	}
+	want := s.All()
+	s.Close()
+
+	s = openMeta(t, dir, "")
+	if got := s.All(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("files after reopen = %v, want %v", got, want)
+	}
+	if s.dead != 3 {
+		t.Fatalf("dead records after reopen = %d, want 3", s.dead)
+	}
+	if entries := s.Search(&FileQuery{Q: "b2"}); len(entries) != 1 || entries[0].Id != 2 {
+		t.Fatalf("search after reopen = %v", entries)
+	}
+}
+
+// TestMetaStoreTruncatedTail 写入时崩溃留下的半条记录在重新打开时截断，之后的记录追加在完整记录之后
+func TestMetaStoreTruncatedTail(t *testing.T) {
+	dir := t.TempDir()
+	s := openMeta(t, dir, "")
+	if err := s.Put(1, metaInfo("a.txt")); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	path := filepath.Join(dir, metaLogName)
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	validSize := fi.Size()
+
+	rec, err := encodeMetaRecord(metaOpPut, 2, metaInfo("b.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write(rec[:len(rec)-3]); err != nil {
+		t.Fatal(err)
+	}
+	_ = f.Close()
+
+	s = openMeta(t, dir, "")
+	if fi, err := os.Stat(path); err != nil || fi.Size() != validSize {
+		t.Fatalf("size after reopen = %d, want %d", fi.Size(), validSize)
+	}
+	if _, err := s.Get(2); err == nil {
+		t.Fatal("truncated record was applied")
+	}
+	if err := s.Put(3, metaInfo("c.txt")); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	s = openMeta(t, dir, "")
+	if got := s.All(); len(got) != 2 || got[1].Name != "a.txt" || got[3].Name != "c.txt" {
+		t.Fatalf("files after append = %v", got)
+	}
+}
+
+// TestMetaStoreCompact 失效记录超过阈值且多于有效记录时重写日志
+func TestMetaStoreCompact(t *testing.T) {
+	dir := t.TempDir()
+	s := openMeta(t, dir, "")
+	if err := s.Put(1, metaInfo("a.txt")); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i <= config.MetaCompactMin+1; i++ {
+		if err := s.Put(2, metaInfo("b.txt")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if s.dead != 0 {
+		t.Fatalf("dead records after compaction = %d, want 0", s.dead)
+	}
+	want := s.All()
+	s.Close()
+
+	path := filepath.Join(dir, metaLogName)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var size int
+	for id, info := range want {
+		rec, err := encodeMetaRecord(metaOpPut, id, &info)
+		if err != nil {
+			t.Fatal(err)
+		}
+		size += len(rec)
+	}
+	if len(data) != metaHeader+size {
+		t.Fatalf("log size after compaction = %d, want %d", len(data), metaHeader+size)
+	}
+
+	s = openMeta(t, dir, "")
+	if got := s.All(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("files after reopen = %v, want %v", got, want)
+	}
+}
+
+// TestMetaStoreMigrate 日志不存在时从旧的JSON文件迁移，完成后改名为 .migrated
+func TestMetaStoreMigrate(t *testing.T) {
+	dir := t.TempDir()
+	legacy := filepath.Join(dir, "fileInfo.json")
+	files := map[uint64]FileInfo{1: *metaInfo("a.txt"), 2: *metaInfo("b.txt")}
+	data, err := json.Marshal(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(legacy, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	metaDir := filepath.Join(dir, "meta")
+	s := openMeta(t, metaDir, legacy)
+	if got := s.All(); !reflect.DeepEqual(got, files) {
+		t.Fatalf("migrated files = %v, want %v", got, files)
+	}
+	if _, err := os.Stat(legacy); !os.IsNotExist(err) {
+		t.Fatalf("legacy file still exists: %v", err)
+	}
+	if _, err := os.Stat(legacy + ".migrated"); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	// 已有日志时不再读取旧文件
+	if err := os.WriteFile(legacy, []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s = openMeta(t, metaDir, legacy)
+	if got := s.All(); !reflect.DeepEqual(got, files) {
+		t.Fatalf("files after reopen = %v, want %v", got, files)
+	}
+}
+
+func TestMetaStoreReplace(t *testing.T) {
+	dir := t.TempDir()
+	s := openMeta(t, dir, "")
+	for id := uint64(1); id <= 3; id++ {
+		if err := s.Put(id, metaInfo("old.txt")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files := map[uint64]FileInfo{4: *metaInfo("new.txt"), 5: *metaInfo("other.txt")}
+	if err := s.Replace(files); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.All(); !reflect.DeepEqual(got, files) {
+		t.Fatalf("files after replace = %v, want %v", got, files)
+	}
+	if entries := s.Search(&FileQuery{Q: "old"}); len(entries) != 0 {
+		t.Fatalf("name index still has replaced files: %v", entries)
+	}
+	if err := s.Put(6, metaInfo("six.txt")); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	if err := s.Replace(files); err == nil {
+		t.Fatal("replace after close succeeded")
+	}
+
+	s = openMeta(t, dir, "")
+	files[6] = *metaInfo("six.txt")
+	if got := s.All(); !reflect.DeepEqual(got, files) {
+		t.Fatalf("files after reopen = %v, want %v", got, files)
+	}
+}
+
+// TestMetaStoreCorrupt 只截断写入时崩溃留下的尾部，中间的记录损坏时打开失败且不修改日志
+func TestMetaStoreCorrupt(t *testing.T) {
+	tests := []struct {
+		name    string
+		corrupt func(data []byte, recs []int) []byte // recs为各记录的起始偏移
+		wantErr bool
+		want    []uint64 // 打开后保留的文件
+	}{
+		{"middle crc", func(data []byte, recs []int) []byte {
+			data[recs[1]+20] ^= 0xff
+			return data
+		}, true, nil},
+		{"middle length", func(data []byte, recs []int) []byte {
+			binary.LittleEndian.PutUint32(data[recs[1]:], 1<<30)
+			return data
+		}, true, nil},
+		{"last crc", func(data []byte, recs []int) []byte {
+			data[len(data)-1] ^= 0xff
+			return data
+		}, false, []uint64{1, 2}},
+		{"torn last", func(data []byte, recs []int) []byte {
+			return data[:len(data)-5]
+		}, false, []uint64{1, 2}},
+		{"zero tail", func(data []byte, recs []int) []byte {
+			return append(data, make([]byte, 100)...)
+		}, false, []uint64{1, 2, 3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			s := openMeta(t, dir, "")
+			path := filepath.Join(dir, metaLogName)
+			var recs []int
+			for id := uint64(1); id <= 3; id++ {
+				fi, err := os.Stat(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				recs = append(recs, int(fi.Size()))
+				if err := s.Put(id, metaInfo("a.txt")); err != nil {
+					t.Fatal(err)
+				}
+			}
+			s.Close()
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data = tt.corrupt(data, recs)
+			if err := os.WriteFile(path, data, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			s, err = OpenMetaStore(dir, "")
+			if tt.wantErr {
+				if !errors.Is(err, errMetaCorrupt) {
+					t.Fatalf("open error = %v, want errMetaCorrupt", err)
+				}
+				if after, _ := os.ReadFile(path); !bytes.Equal(after, data) {
+					t.Fatal("corrupt log was modified")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			files := s.All()
+			if len(files) != len(tt.want) {
+				t.Fatalf("files after open = %v, want ids %v", files, tt.want)
+			}
+			for _, id := range tt.want {
+				if _, ok := files[id]; !ok {
+					t.Fatalf("file %d lost after open", id)
+				}
+			}
+		})
+	}
+}
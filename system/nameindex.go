@@ -0,0 +1,153 @@
+package system
+
+import (
+	"math/rand"
+	"path/filepath"
+	"strings"
+)
+
+// nameEntry 名称索引中的一个文件，名称和扩展名均为小写
+type nameEntry struct {
+	id    uint64
+	lower string
+	ext   string
+}
+
+// nameNode 名称索引的跳表节点
+type nameNode struct {
+	nameEntry
+	forward []*nameNode
+}
+
+// nameIndex 文件名索引，跳表按 (小写名称, id) 升序排列，增删为O(logN)；
+// 前缀查询从第一个不小于前缀的节点开始遍历，子串查询按顺序扫描预先转换的小写名称
+type nameIndex struct {
+	header *nameNode
+	level  int
+	rnd    *rand.Rand
+	names  map[uint64]string // 文件ID到小写名称，用于定位
+}
+
+// FileQuery 文件名查询条件
+type FileQuery struct {
+	Q      string // 不区分大小写的名称子串，为空时匹配全部文件
+	Prefix bool   // Q只匹配名称前缀
+	Ext    string // 扩展名，如 ".txt"，不区分大小写，为空时不过滤
+}
+
+// FileEntry 带ID的文件信息
+type FileEntry struct {
+	Id uint64 `json:"id"`
+	FileInfo
+}
+
+func newNameEntry(id uint64, name string) nameEntry {
+	lower := strings.ToLower(name)
+	return nameEntry{id: id, lower: lower, ext: filepath.Ext(lower)}
+}
+
+// newNameIndex 为全部文件建立索引
+func newNameIndex(files map[uint64]FileInfo) *nameIndex {
+	x := &nameIndex{
+		header: &nameNode{forward: make([]*nameNode, skipListMaxLevel)},
+		level:  1,
+		rnd:    rand.New(rand.NewSource(rand.Int63())),
+		names:  make(map[uint64]string, len(files)),
+	}
+	for id, info := range files {
+		x.put(id, info.Name)
+	}
+	return x
+}
+
+func nameLess(a string, aId uint64, b string, bId uint64) bool {
+	if a != b {
+		return a < b
+	}
+	return aId < bId
+}
+
+func (x *nameIndex) randomLevel() int {
+	level := 1
+	for level < skipListMaxLevel && x.rnd.Float64() < skipListP {
+		level++
+	}
+	return level
+}
+
+// seek 返回每一层中排在 (lower, id) 之前的最后一个节点
+func (x *nameIndex) seek(lower string, id uint64) [skipListMaxLevel]*nameNode {
+	var update [skipListMaxLevel]*nameNode
+	n := x.header
+	for i := x.level - 1; i >= 0; i-- {
+		for n.forward[i] != nil && nameLess(n.forward[i].lower, n.forward[i].id, lower, id) {
+			n = n.forward[i]
+		}
+		update[i] = n
+	}
+	return update
+}
+
+// put 添加或更新文件名
+func (x *nameIndex) put(id uint64, name string) {
+	x.remove(id)
+	entry := newNameEntry(id, name)
+	update := x.seek(entry.lower, id)
+	level := x.randomLevel()
+	if level > x.level {
+		for i := x.level; i < level; i++ {
+			update[i] = x.header
+		}
+		x.level = level
+	}
+	n := &nameNode{nameEntry: entry, forward: make([]*nameNode, level)}
+	for i := 0; i < level; i++ {
+		n.forward[i] = update[i].forward[i]
+		update[i].forward[i] = n
+	}
+	x.names[id] = entry.lower
+}
+
+// remove 移除文件，文件不存在时忽略
+func (x *nameIndex) remove(id uint64) {
+	lower, exists := x.names[id]
+	if !exists {
+		return
+	}
+	update := x.seek(lower, id)
+	n := update[0].forward[0]
+	for i := 0; i < x.level && update[i].forward[i] == n; i++ {
+		update[i].forward[i] = n.forward[i]
+	}
+	for x.level > 1 && x.header.forward[x.level-1] == nil {
+		x.level--
+	}
+	delete(x.names, id)
+}
+
+// each 按名称顺序对匹配q的文件ID调用fn，fn返回false时停止
+func (x *nameIndex) each(q *FileQuery, fn func(id uint64) bool) {
+	needle := strings.ToLower(q.Q)
+	ext := strings.ToLower(q.Ext)
+	if ext != "" && !strings.HasPrefix(ext, ".") {
+		ext = "." + ext
+	}
+	n := x.header.forward[0]
+	if q.Prefix && needle != "" {
+		n = x.seek(needle, 0)[0].forward[0]
+	}
+	for ; n != nil; n = n.forward[0] {
+		if q.Prefix && !strings.HasPrefix(n.lower, needle) {
+			return
+		}
+		if ext != "" && n.ext != ext {
+			continue
+		}
+		if !q.Prefix && needle != "" && !strings.Contains(n.lower, needle) {
+			continue
+		}
+		if !fn(n.id) {
+			return
+		}
+	}
+}
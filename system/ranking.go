@@ -5,39 +5,234 @@ import (
 	"sync"
 )
 
-var rankBoardOnce sync.Once
-var rankBoard *RankBoard
+// Ranking 排行榜数据结构，按count降序排列，只由RankBoard工作线程写入
+type Ranking interface {
+	// Incr 增加已存在文件的分值并更新位置，文件不存在时返回nil
+	Incr(id uint64, delta uint64) *File
+	// Insert 按点击数插入新文件，文件已存在时忽略
+	Insert(file *File)
+	// Delete 移除文件
+	Delete(id uint64)
+	// TopN 获取点击次数前N的文件
+	TopN(n int) []*File
+	// TopAll 获取所有文件，按点击次数降序排列
+	TopAll() []*File
+	// Len 获取排行榜中的文件数
+	Len() int
+}
+
+// NewRanking 根据类型创建排行榜数据结构，未知类型使用跳表
+func NewRanking(kind string) Ranking {
+	switch kind {
+	case config.RankingSkipList:
+		return NewSkipList()
+	case config.RankingLRU:
+		return NewLRURanking()
+	default:
+		config.Warn("未知的排行榜类型: " + kind + ", 使用skiplist")
+		return NewSkipList()
+	}
+}
 
+// RankBoard 单个命名排行榜，由独立的工作线程串行处理事件
 type RankBoard struct {
-	writeCh chan *FileEvent
-	wg      sync.WaitGroup
-	lru     *LRUList
+	name     string
+	writeCh  chan *FileEvent
+	wg       sync.WaitGroup
+	ranking  Ranking
+	index    *SkipList // 排名索引，ranking为跳表时与其共用同一实例
+	window   *WindowBoard
+	trending *TrendingBoard
+	unique   *UniqueBoard
+	events   *EventBoard
+	dirty    map[uint64]struct{} // 上次快照之后变化或删除的文件，只由工作线程读写
+	history  bool                // 重建的历史排行榜，保留之后被删除的文件
 }
 
-func GetRankBoard() *RankBoard {
-	rankBoardOnce.Do(func() {
-		rankBoard = &RankBoard{
-			writeCh: make(chan *FileEvent, config.FileEventMax),
-			lru:     NewLRURanking(),
-		}
-		go rankBoard.worker()
-	})
-	return rankBoard
+// NewRankBoard 创建排行榜并启动工作线程
+func NewRankBoard(name string) *RankBoard {
+	return newRankBoard(name, false)
+}
+
+// newRankBoard 创建排行榜并启动工作线程，history为true时首次出现的文件已被删除也计入排行榜
+func newRankBoard(name string, history bool) *RankBoard {
+	rb := &RankBoard{
+		name:     name,
+		history:  history,
+		writeCh:  make(chan *FileEvent, config.FileEventMax),
+		ranking:  NewRanking(config.RankingType),
+		window:   NewWindowBoard(),
+		trending: NewTrendingBoard(config.TrendingHalfLife),
+		unique:   NewUniqueBoard(),
+		events:   NewEventBoard(),
+		dirty:    make(map[uint64]struct{}),
+	}
+	if sl, ok := rb.ranking.(*SkipList); ok {
+		rb.index = sl
+	} else {
+		rb.index = NewSkipList()
+	}
+	rb.wg.Add(1)
+	go rb.worker()
+	return rb
+}
+
+// stop 关闭事件队列并等待工作线程处理完已投递的事件后退出，之后不能再投递事件
+func (rb *RankBoard) stop() {
+	close(rb.writeCh)
+	rb.wg.Wait()
 }
 
 // 启动工作线程
 func (rb *RankBoard) worker() {
-	rb.wg.Add(1)
 	defer rb.wg.Done()
 
 	for event := range rb.writeCh {
 		switch event.Type {
-		case HitEvent:
-			rb.lru.hit(event.Id)
+		case HitEvent, ViewEvent, DownloadEvent, LikeEvent, ShareEvent:
+			score := mulSat(event.Type.weight(), event.Count)
+			if file := rb.hit(event.Id, score); file != nil {
+				rb.window.hit(file, event.Ts, score)
+				rb.trending.hit(file, event.Ts, score)
+				rb.unique.hit(file, event.Visitor)
+				rb.events.hit(file.Id, event.Type, event.Count)
+				rb.dirty[file.Id] = struct{}{}
+			}
 		case DeleteEvent:
-			rb.lru.delete(event.Id)
+			rb.ranking.Delete(event.Id)
+			if rb.index != rb.ranking {
+				rb.index.Delete(event.Id)
+			}
+			rb.window.delete(event.Id)
+			rb.trending.delete(event.Id)
+			rb.unique.delete(event.Id)
+			rb.events.delete(event.Id)
+			rb.dirty[event.Id] = struct{}{}
+		case BarrierEvent:
+			// 工作线程是唯一的写入者，此时拷贝的状态恰好包含屏障之前的全部事件
+			event.Snap <- rb.snapshot(event.Delta)
+			if !event.Keep {
+				rb.dirty = make(map[uint64]struct{})
+			}
 		default:
 			config.Error("不支持的事件！")
 		}
 	}
 }
+
+// hit 处理计分事件，如果文件不存在则创建新文件插入，如果存在则增加分值
+// 返回被点击的文件，文件不存在时返回nil
+func (rb *RankBoard) hit(fileId uint64, score uint64) *File {
+	file := rb.ranking.Incr(fileId, score)
+	if file == nil {
+		// 文件首次出现，初始分值为该事件的分值
+		file = &File{
+			Id:    fileId,
+			Count: score,
+		}
+		if fileInfo, err := GetFileByID(fileId); err == nil {
+			file.FileName = fileInfo.Name
+		} else if !rb.history {
+			return nil
+		}
+		rb.ranking.Insert(file)
+	}
+	if rb.index != rb.ranking {
+		rb.index.update(file)
+	}
+	return file
+}
+
+// load 从快照恢复排行榜数据
+func (rb *RankBoard) load(board *RdbBoard) {
+	fileMap := make(map[uint64]*File, len(board.Files))
+	for _, file := range board.Files {
+		fileMap[file.Id] = file
+		rb.ranking.Insert(file)
+		if rb.index != rb.ranking {
+			rb.index.update(file)
+		}
+	}
+	rb.window.load(board.Windows, fileMap)
+	rb.trending.load(board.Trending, fileMap)
+	rb.unique.load(board.Unique, fileMap)
+	if board.Events == nil {
+		// 旧版本快照没有分类型计数，此前分值全部来自点击
+		for _, file := range board.Files {
+			board.Events = append(board.Events, &EventEntry{Id: file.Id, Counts: EventCounts{file.Count}})
+		}
+	}
+	rb.events.load(board.Events, fileMap)
+}
+
+// requestSnapshot 向工作线程投递快照屏障，返回的通道在工作线程处理完屏障之前的事件后收到状态拷贝
+// delta为true时只拷贝上次快照之后变化的文件
+func (rb *RankBoard) requestSnapshot(delta bool) <-chan *RdbBoard {
+	snap := make(chan *RdbBoard, 1)
+	rb.writeCh <- &FileEvent{Type: BarrierEvent, Snap: snap, Delta: delta}
+	return snap
+}
+
+// requestCopy 与requestSnapshot相同，但只拷贝全量状态，不清空变化集合，不影响下一次增量快照
+func (rb *RankBoard) requestCopy() <-chan *RdbBoard {
+	snap := make(chan *RdbBoard, 1)
+	rb.writeCh <- &FileEvent{Type: BarrierEvent, Snap: snap, Keep: true}
+	return snap
+}
+
+// snapshot 拷贝排行榜数据用于保存快照，只在工作线程中调用，文件需要深拷贝，避免保存期间工作线程继续修改分值
+// 增量快照只拷贝变化的文件，已删除的文件记入Deleted
+func (rb *RankBoard) snapshot(delta bool) *RdbBoard {
+	var ids map[uint64]struct{}
+	var files []*File
+	var deleted []uint64
+	if delta {
+		ids = rb.dirty
+		files = rb.index.lookup(ids)
+		deleted = make([]uint64, 0, len(ids)-len(files))
+		found := make(map[uint64]struct{}, len(files))
+		for _, f := range files {
+			found[f.Id] = struct{}{}
+		}
+		for id := range ids {
+			if _, exists := found[id]; !exists {
+				deleted = append(deleted, id)
+			}
+		}
+	} else {
+		files = rb.ranking.TopAll()
+		for i, f := range files {
+			file := *f
+			files[i] = &file
+		}
+	}
+	board := &RdbBoard{
+		Name:     rb.name,
+		Files:    files,
+		Windows:  rb.window.snapshot(ids),
+		Trending: rb.trending.snapshot(ids),
+		Unique:   rb.unique.snapshot(ids),
+		Events:   rb.events.snapshot(ids),
+		Deleted:  deleted,
+	}
+	return board
+}
+
+// annotate 拷贝文件列表并填充独立访客数和各类型事件次数
+func (rb *RankBoard) annotate(files []*File) []*File {
+	result := make([]*File, len(files))
+	for i, f := range files {
+		file := *f
+		result[i] = &file
+	}
+	rb.unique.fill(result)
+	rb.events.fill(result)
+	return result
+}
+
+// withCounts 为按独立访客数排序的文件补全点击次数和各类型事件次数
+func (rb *RankBoard) withCounts(files []*File) []*File {
+	rb.index.fillCounts(files)
+	rb.events.fill(files)
+	return files
+}
@@ -0,0 +1,97 @@
+package system
+
+import (
+	"fileClick/config"
+	"math/rand"
+	"testing"
+)
+
+// 排行榜数据结构基准测试：对比 lru 与 skiplist 在不同点击分布下的单次点击耗时
+//
+// 运行: go test ./system -run '^$' -bench .
+
+// benchFileNum 参与排名的文件数，初始点击数均为1
+const benchFileNum = 10000
+
+// benchDistribution 点击分布，返回每次被点击的文件ID
+type benchDistribution struct {
+	name string
+	gen  func(r *rand.Rand) func() uint64
+}
+
+var benchDistributions = []benchDistribution{
+	{
+		// 与 test/jmeter 压测计划一致：所有请求集中点击同一个文件
+		name: "single",
+		gen: func(r *rand.Rand) func() uint64 {
+			return func() uint64 { return benchFileNum / 2 }
+		},
+	},
+	{
+		// 少量热门文件占据大部分点击
+		name: "zipf",
+		gen: func(r *rand.Rand) func() uint64 {
+			z := rand.NewZipf(r, 1.1, 1, benchFileNum-1)
+			return func() uint64 { return z.Uint64() + 1 }
+		},
+	},
+	{
+		name: "uniform",
+		gen: func(r *rand.Rand) func() uint64 {
+			return func() uint64 { return uint64(r.Intn(benchFileNum)) + 1 }
+		},
+	},
+}
+
+var benchKinds = []string{config.RankingLRU, config.RankingSkipList}
+
+// BenchmarkRanking 只测排行榜数据结构本身
+func BenchmarkRanking(b *testing.B) {
+	for _, kind := range benchKinds {
+		for _, dist := range benchDistributions {
+			b.Run(kind+"/"+dist.name, func(b *testing.B) {
+				ranking := NewRanking(kind)
+				for id := uint64(1); id <= benchFileNum; id++ {
+					ranking.Insert(&File{Id: id, Count: 1})
+				}
+				next := dist.gen(rand.New(rand.NewSource(1)))
+
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					ranking.Incr(next(), 1)
+				}
+			})
+		}
+	}
+}
+
+// BenchmarkRankBoardHit 测排行榜处理一次点击的耗时，lru 同时维护跳表排名索引，包含两者的开销
+func BenchmarkRankBoardHit(b *testing.B) {
+	for _, kind := range benchKinds {
+		for _, dist := range benchDistributions {
+			b.Run(kind+"/"+dist.name, func(b *testing.B) {
+				rb := &RankBoard{ranking: NewRanking(kind)}
+				if sl, ok := rb.ranking.(*SkipList); ok {
+					rb.index = sl
+				} else {
+					rb.index = NewSkipList()
+				}
+				for id := uint64(1); id <= benchFileNum; id++ {
+					file := &File{Id: id, Count: 1}
+					rb.ranking.Insert(file)
+					if rb.index != rb.ranking {
+						rb.index.Insert(file)
+					}
+				}
+				next := dist.gen(rand.New(rand.NewSource(1)))
+
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					rb.hit(next(), 1)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package system
+
+import (
+	"fileClick/config"
+	"testing"
+)
+
+// TestRankingTieOrder lru与skiplist对同样的插入和点击给出相同的顺序：count降序，count相同时ID升序
+func TestRankingTieOrder(t *testing.T) {
+	tests := []struct {
+		name   string
+		insert []uint64 // 依次插入的文件ID，初始点击数均为1
+		incr   []uint64 // 依次点击一次的文件ID
+		want   []uint64
+	}{
+		{name: "倒序插入同分文件", insert: []uint64{3, 2, 1}, want: []uint64{1, 2, 3}},
+		{name: "乱序插入同分文件", insert: []uint64{2, 5, 1, 4, 3}, want: []uint64{1, 2, 3, 4, 5}},
+		{name: "点击后追平前面的文件", insert: []uint64{1, 2, 3}, incr: []uint64{3, 1, 2}, want: []uint64{1, 2, 3}},
+		{name: "点击后越过同分文件", insert: []uint64{4, 3, 2, 1}, incr: []uint64{4, 2, 4}, want: []uint64{4, 2, 1, 3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, kind := range []string{config.RankingLRU, config.RankingSkipList} {
+				r := NewRanking(kind)
+				for _, id := range tt.insert {
+					r.Insert(&File{Id: id, Count: 1})
+				}
+				for _, id := range tt.incr {
+					if r.Incr(id, 1) == nil {
+						t.Fatalf("%s: incr %d on missing file", kind, id)
+					}
+				}
+				var ids []uint64
+				for _, f := range r.TopAll() {
+					ids = append(ids, f.Id)
+				}
+				if len(ids) != len(tt.want) {
+					t.Fatalf("%s: order = %v, want %v", kind, ids, tt.want)
+				}
+				for i := range ids {
+					if ids[i] != tt.want[i] {
+						t.Fatalf("%s: order = %v, want %v", kind, ids, tt.want)
+					}
+				}
+			}
+		})
+	}
+}
@@ -2,8 +2,8 @@ package system
 
 import (
 	"bufio"
-	"bytes"
 	"encoding/binary"
+	"errors"
 	"fileClick/config"
 	"fmt"
 	"hash/crc32"
@@ -11,28 +11,96 @@ import (
 	"os"
 	"path/filepath"
 	"sort"
+	"sync/atomic"
 	"time"
 )
 
 // Rdb 快照
 type Rdb struct {
-	dir     string
-	version uint16
+	dir      string
+	version  uint64       // RDB2 格式版本
+	compress bool         // 排行榜数据块是否使用flate压缩
+	baseTs   int64        // 本进程最近一次保存的基准快照时间戳，0表示尚未保存
+	deltaSeq int          // 基准快照之后已保存的增量快照序号
+	pins     atomic.Int32 // 正在进行的历史查询数，大于0时不删除旧的基准快照和WAL段文件
 }
 
 func NewRDB() *Rdb {
-	return &Rdb{dir: config.RdbPath, version: 1}
+	return NewRDBWithDir(config.RdbPath)
 }
 
-// Save 保存RDB
-func (r *Rdb) Save(files []*File) (snapshotTs int64, path string, err error) {
-	tmpPath := filepath.Join(r.dir, fmt.Sprintf("dump-%d.rdb.tmp", time.Now().UnixNano()))
+// NewRDBWithDir 使用指定目录创建快照管理器
+func NewRDBWithDir(dir string) *Rdb {
+	return &Rdb{dir: dir, version: rdb2Version, compress: config.RdbCompress}
+}
+
+// RdbBoard 单个命名排行榜的快照数据
+type RdbBoard struct {
+	Name     string
+	Files    []*File
+	Windows  []*WindowEntry
+	Trending []*TrendingEntry
+	Unique   []*UniqueEntry
+	Events   []*EventEntry
+	Meta     map[uint64]*RdbFileMeta // 文件元数据，RDB2 起保存
+	Deleted  []uint64                // 增量快照中自上次快照以来删除的文件
+}
+
+// RdbFileMeta 快照中保存的文件元数据，未知的字段为零值
+type RdbFileMeta struct {
+	UploadTs int64  `json:"uploadTs"`
+	Size     int64  `json:"size"`
+	Sha256   string `json:"sha256"` // 十六进制
+}
+
+// RdbSnapshot 待保存的快照数据
+type RdbSnapshot struct {
+	Lsns   []uint64 // 各WAL线程已应用的最大LSN
+	Boards []*RdbBoard
+}
+
+// Save 保存全量快照作为新的基准快照，并删除其他基准快照的增量快照
+func (r *Rdb) Save(snap *RdbSnapshot) (snapshotTs int64, path string, err error) {
 	finalTs := time.Now().Unix()
 	finalPath := filepath.Join(r.dir, fmt.Sprintf("dump-%d.rdb", finalTs))
 
+	// 同一秒内的基准快照会被覆盖，先删除旧基准快照留下的增量快照
+	r.removeDeltas(func(baseTs int64) bool { return baseTs == finalTs })
+	if err = r.write(finalPath, snap, finalTs); err != nil {
+		return 0, "", err
+	}
+	r.baseTs, r.deltaSeq = finalTs, 0
+
+	r.retain(finalTs)
+	// 回退到更早的基准快照时从其检查点回放WAL，不再需要其增量快照
+	r.removeDeltas(func(baseTs int64) bool { return baseTs != finalTs })
+
+	return finalTs, finalPath, nil
+}
+
+// retain 删除多余的基准快照，保留最新的RdbMaxFileNum个及历史保留期内的快照
+// 保留期内最早的快照之前再保留一个，保证保留期开始的时刻也能重建排行榜；WAL按保留的快照清理
+func (r *Rdb) retain(now int64) {
+	if r.pins.Load() > 0 {
+		return
+	}
+	matches, _ := filepath.Glob(filepath.Join(r.dir, "dump-*.rdb"))
+	sort.Strings(matches)
+	cutoff := now - int64(config.RdbHistoryRetention/time.Second)
+	for i := 0; i < len(matches)-config.RdbMaxFileNum; i++ {
+		// 下一个快照也不晚于保留期的开始时刻，该快照不再需要
+		if ts, ok := rdbBaseTs(matches[i+1]); ok && ts <= cutoff {
+			_ = os.Remove(matches[i])
+		}
+	}
+}
+
+// write 编码快照写入临时文件，刷盘后重命名为finalPath
+func (r *Rdb) write(finalPath string, snap *RdbSnapshot, snapshotTs int64) (err error) {
+	tmpPath := filepath.Join(r.dir, fmt.Sprintf("%s.%d.tmp", filepath.Base(finalPath), time.Now().UnixNano()))
 	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
 	if err != nil {
-		return 0, "", err
+		return err
 	}
 	defer func() {
 		if err != nil {
@@ -41,85 +109,192 @@ func (r *Rdb) Save(files []*File) (snapshotTs int64, path string, err error) {
 		}
 	}()
 
-	w := bufio.NewWriter(f)
-	var body bytes.Buffer
-
-	// 头部 magic(4) + version(2) + snapshotTs(8)
-	body.WriteString("RDB1")
-	_ = binary.Write(&body, binary.LittleEndian, r.version)
-	_ = binary.Write(&body, binary.LittleEndian, finalTs)
-
-	// Count
-	n := uint32(len(files))
-	_ = binary.Write(&body, binary.LittleEndian, n)
-
-	// Entries: [id(8) | count(8) | nameLen(2) | name(n)]
-	for _, f := range files {
-		_ = binary.Write(&body, binary.LittleEndian, f.Id)
-		_ = binary.Write(&body, binary.LittleEndian, f.Count)
-		nameBytes := []byte(f.FileName)
-		_ = binary.Write(&body, binary.LittleEndian, uint16(len(nameBytes)))
-		_, _ = body.Write(nameBytes)
-	}
-
-	// CRC
-	crc := crc32.ChecksumIEEE(body.Bytes())
-	if _, err = w.Write(body.Bytes()); err != nil {
-		return 0, "", err
+	data, err := r.encode(snap, snapshotTs, activeKey())
+	if err != nil {
+		return err
 	}
-	var crcBuf [4]byte
-	binary.LittleEndian.PutUint32(crcBuf[:], crc)
-	if _, err = w.Write(crcBuf[:]); err != nil {
-		return 0, "", err
+	w := bufio.NewWriter(f)
+	if _, err = w.Write(data); err != nil {
+		return err
 	}
 	if err = w.Flush(); err != nil {
-		return 0, "", err
+		return err
 	}
 	if err = f.Sync(); err != nil {
-		return 0, "", err
+		return err
 	}
 	if err = f.Close(); err != nil {
-		return 0, "", err
-	}
-	if err = os.Rename(tmpPath, finalPath); err != nil {
-		return 0, "", err
+		return err
 	}
+	return os.Rename(tmpPath, finalPath)
+}
 
-	matches, _ := filepath.Glob(filepath.Join(r.dir, "dump-*.rdb"))
-	if len(matches) > config.RdbMaxFileNum {
-		sort.Strings(matches)
-		for _, old := range matches[:len(matches)-3] {
-			_ = os.Remove(old)
-		}
+// encode 编码快照并在末尾追加CRC，keyId不为0时加密
+func (r *Rdb) encode(snap *RdbSnapshot, snapshotTs int64, keyId uint32) ([]byte, error) {
+	body, err := encodeRdb2(snap, r.version, snapshotTs, r.compress, keyId)
+	if err != nil {
+		return nil, err
 	}
-
-	return finalTs, finalPath, nil
+	return binary.LittleEndian.AppendUint32(body, crc32.ChecksumIEEE(body)), nil
 }
 
 // RdbLoadResult RDB 加载结果
 type RdbLoadResult struct {
 	SnapshotTs int64
-	Files      []*File
+	Lsns       []uint64 // 各WAL线程已应用的最大LSN，version 4 之前的快照为nil
+	Boards     []*RdbBoard
 	Path       string
+	Format     int           // 文件格式: 1 表示 RDB1，2 表示 RDB2
+	KeyId      uint32        // 加密密钥，0表示未加密
+	Deltas     []string      // 已合并的增量快照
+	Skipped    []*RdbSkipped // 校验失败被跳过的较新快照
 }
 
-// LoadLatest 加载RDB文件
+// RdbSkipped 校验失败的快照文件
+type RdbSkipped struct {
+	Path  string `json:"path"`
+	Error string `json:"error"`
+}
+
+// LoadLatest 从最新的基准快照开始依次向前加载，返回第一个校验通过的快照与其增量快照合并后的结果
+// 全部快照都校验失败时返回错误，结果中的Skipped记录了各快照失败的原因
 func (r *Rdb) LoadLatest() (*RdbLoadResult, error) {
 	matches, _ := filepath.Glob(filepath.Join(r.dir, "dump-*.rdb"))
-	if len(matches) == 0 {
-		return &RdbLoadResult{SnapshotTs: 0, Files: []*File{}, Path: ""}, nil
-	}
 	sort.Strings(matches)
-	path := matches[len(matches)-1]
 
+	var skipped []*RdbSkipped
+	for i := len(matches) - 1; i >= 0; i-- {
+		res, err := ReadRdbFile(matches[i])
+		// 缺少密钥不是快照损坏，回退到更早的快照会丢失数据
+		if errors.Is(err, ErrKeyNotFound) {
+			return &RdbLoadResult{Boards: []*RdbBoard{}, Skipped: skipped}, err
+		}
+		if err != nil {
+			config.Error("RDB快照校验失败，尝试更早的快照: " + err.Error())
+			skipped = append(skipped, &RdbSkipped{Path: matches[i], Error: err.Error()})
+			continue
+		}
+		res.Skipped = skipped
+		// 依次合并该基准快照的增量快照，损坏的增量快照及其之后的变化由WAL回放补齐
+		r.applyDeltas(res)
+		return res, nil
+	}
+	res := &RdbLoadResult{SnapshotTs: 0, Boards: []*RdbBoard{}, Path: "", Skipped: skipped}
+	if len(skipped) > 0 {
+		return res, fmt.Errorf("no valid rdb in %d files", len(skipped))
+	}
+	return res, nil
+}
+
+// RetainedLsns 返回保留的各基准快照中每个WAL线程LSN检查点的最小值
+// 最新快照或增量快照损坏时恢复会回退到更早的快照，清理WAL时只能删除全部保留的基准快照都已包含的记录；
+// 存在没有检查点的旧版本快照时返回nil
+func (r *Rdb) RetainedLsns() []uint64 {
+	matches, _ := filepath.Glob(filepath.Join(r.dir, "dump-*.rdb"))
+	var lsns []uint64
+	for _, path := range matches {
+		fileLsns, err := readRdbLsns(path)
+		if err != nil {
+			// 头部都无法读取的快照不会被用于恢复
+			continue
+		}
+		if fileLsns == nil {
+			return nil
+		}
+		if lsns == nil {
+			lsns = fileLsns
+			continue
+		}
+		for i := range lsns {
+			if i >= len(fileLsns) {
+				lsns[i] = 0
+			} else if fileLsns[i] < lsns[i] {
+				lsns[i] = fileLsns[i]
+			}
+		}
+	}
+	return lsns
+}
+
+// MaxLsns 返回保留的基准快照和增量快照中每个WAL线程LSN检查点的最大值，没有检查点时返回nil
+// WAL线程启动时从该值之后分配LSN，保证新记录不会落在任何可能用于恢复的快照的检查点之内
+func (r *Rdb) MaxLsns() []uint64 {
+	dumps, _ := filepath.Glob(filepath.Join(r.dir, "dump-*.rdb"))
+	deltas, _ := filepath.Glob(filepath.Join(r.dir, "delta-*.rdb"))
+	var lsns []uint64
+	for _, path := range append(dumps, deltas...) {
+		fileLsns, err := readRdbLsns(path)
+		if err != nil {
+			continue
+		}
+		for i, lsn := range fileLsns {
+			if i >= len(lsns) {
+				lsns = append(lsns, lsn)
+			} else if lsn > lsns[i] {
+				lsns[i] = lsn
+			}
+		}
+	}
+	return lsns
+}
+
+// readRdbLsns 只读取快照头部的LSN检查点，不校验CRC
+func readRdbLsns(path string) ([]uint64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var magic [4]byte
+	if _, err := io.ReadFull(f, magic[:]); err != nil {
+		return nil, err
+	}
+	switch string(magic[:]) {
+	case rdb1Magic:
+		var head [2 + 8]byte
+		if _, err := io.ReadFull(f, head[:]); err != nil {
+			return nil, err
+		}
+		if binary.LittleEndian.Uint16(head[0:2]) < 4 {
+			return nil, nil
+		}
+		var lsnNum uint16
+		if err := binary.Read(f, binary.LittleEndian, &lsnNum); err != nil {
+			return nil, err
+		}
+		lsns := make([]uint64, lsnNum)
+		if err := binary.Read(f, binary.LittleEndian, lsns); err != nil {
+			return nil, err
+		}
+		return lsns, nil
+	case rdb2Magic:
+		h, err := readRdb2Header(bufio.NewReader(f))
+		if err != nil {
+			return nil, err
+		}
+		return h.lsns, nil
+	default:
+		return nil, fmt.Errorf("bad rdb magic: %s", path)
+	}
+}
+
+// ReadRdbFile 读取并校验单个RDB文件，支持 RDB1 和 RDB2 格式
+func ReadRdbFile(path string) (*RdbLoadResult, error) {
 	b, err := os.ReadFile(path)
 	if err != nil {
 		return nil, err
 	}
-	if len(b) < 4+2+8+4+4 { // 最小长度保护
+	return decodeRdb(path, b)
+}
+
+// decodeRdb 校验并解码完整的RDB文件内容，path只用于错误信息
+func decodeRdb(path string, b []byte) (*RdbLoadResult, error) {
+	if len(b) < 4+4 { // 最小长度保护
 		return nil, fmt.Errorf("rdb too small: %s", path)
 	}
-	if string(b[0:4]) != "RDB1" {
+	magic := string(b[0:4])
+	if magic != rdb1Magic && magic != rdb2Magic {
 		return nil, fmt.Errorf("bad rdb magic: %s", path)
 	}
 	// 校验 CRC
@@ -127,34 +302,8 @@ func (r *Rdb) LoadLatest() (*RdbLoadResult, error) {
 	if crc32.ChecksumIEEE(b[:len(b)-4]) != crcStored {
 		return nil, fmt.Errorf("rdb crc mismatch: %s", path)
 	}
-
-	reader := bytes.NewReader(b[4 : len(b)-4])
-	var ver uint16
-	var ts int64
-	_ = binary.Read(reader, binary.LittleEndian, &ver)
-	_ = binary.Read(reader, binary.LittleEndian, &ts)
-	var n uint32
-	_ = binary.Read(reader, binary.LittleEndian, &n)
-	out := make([]*File, n)
-	for i := uint32(0); i < n; i++ {
-		var id, cnt uint64
-		var nameLen uint16
-		_ = binary.Read(reader, binary.LittleEndian, &id)
-		_ = binary.Read(reader, binary.LittleEndian, &cnt)
-		_ = binary.Read(reader, binary.LittleEndian, &nameLen)
-		name := make([]byte, nameLen)
-		if _, err := io.ReadFull(reader, name); err != nil {
-			return nil, err
-		}
-		out[i] = &File{
-			Id:       id,
-			Count:    cnt,
-			FileName: string(name),
-		}
+	if magic == rdb1Magic {
+		return readRdb1(path, b[4:len(b)-4])
 	}
-	return &RdbLoadResult{
-		SnapshotTs: ts,
-		Files:      out,
-		Path:       path,
-	}, nil
+	return readRdb2(path, b[4:len(b)-4])
 }
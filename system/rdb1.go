@@ -0,0 +1,237 @@
+package system
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fileClick/config"
+	"fmt"
+	"io"
+)
+
+// RDB1 为旧版本快照格式，定长小端编码，文件名长度上限为uint16，只保留读取以便迁移到 RDB2
+
+const rdb1Magic = "RDB1"
+
+// RDB1 扩展段类型，version >= 2 时位于文件条目之后
+const (
+	rdbSectionWindow   byte = 1 // 时间窗口分桶
+	rdbSectionTrending byte = 2 // 热度衰减分数
+	rdbSectionUnique   byte = 3 // 独立访客草图
+	rdbSectionEvents   byte = 4 // 各类型事件次数
+)
+
+// readRdb1 解析 RDB1 格式，body 为去掉 magic 和 CRC 的部分
+// 头部 version(2) + snapshotTs(8) + [lsnNum(2) + lsnNum * lsn(8)]（version >= 4），之后为各排行榜
+func readRdb1(path string, body []byte) (*RdbLoadResult, error) {
+	if len(body) < 2+8+4 { // 最小长度保护
+		return nil, fmt.Errorf("rdb too small: %s", path)
+	}
+	reader := bytes.NewReader(body)
+	var ver uint16
+	var ts int64
+	_ = binary.Read(reader, binary.LittleEndian, &ver)
+	_ = binary.Read(reader, binary.LittleEndian, &ts)
+	res := &RdbLoadResult{
+		SnapshotTs: ts,
+		Path:       path,
+		Format:     1,
+	}
+	if ver >= 4 {
+		var lsnNum uint16
+		if err := binary.Read(reader, binary.LittleEndian, &lsnNum); err != nil {
+			return nil, err
+		}
+		res.Lsns = make([]uint64, lsnNum)
+		if err := binary.Read(reader, binary.LittleEndian, res.Lsns); err != nil {
+			return nil, err
+		}
+	}
+
+	// version 1/2 只有默认排行榜
+	if ver < 3 {
+		board, err := readRdbBoard(reader, ver, config.DefaultBoard)
+		if err != nil {
+			return nil, fmt.Errorf("bad rdb: %s: %w", path, err)
+		}
+		res.Boards = []*RdbBoard{board}
+		return res, nil
+	}
+
+	var boardNum uint32
+	if err := binary.Read(reader, binary.LittleEndian, &boardNum); err != nil {
+		return nil, err
+	}
+	for i := uint32(0); i < boardNum; i++ {
+		var nameLen uint16
+		if err := binary.Read(reader, binary.LittleEndian, &nameLen); err != nil {
+			return nil, err
+		}
+		name := make([]byte, nameLen)
+		if _, err := io.ReadFull(reader, name); err != nil {
+			return nil, err
+		}
+		board, err := readRdbBoard(reader, ver, string(name))
+		if err != nil {
+			return nil, fmt.Errorf("bad rdb board %s: %s: %w", name, path, err)
+		}
+		res.Boards = append(res.Boards, board)
+	}
+	return res, nil
+}
+
+// readRdbBoard 读取单个排行榜
+func readRdbBoard(reader *bytes.Reader, ver uint16, name string) (*RdbBoard, error) {
+	var n uint32
+	if err := binary.Read(reader, binary.LittleEndian, &n); err != nil {
+		return nil, err
+	}
+	board := &RdbBoard{Name: name, Files: make([]*File, n)}
+	for i := uint32(0); i < n; i++ {
+		var id, cnt uint64
+		var nameLen uint16
+		_ = binary.Read(reader, binary.LittleEndian, &id)
+		_ = binary.Read(reader, binary.LittleEndian, &cnt)
+		_ = binary.Read(reader, binary.LittleEndian, &nameLen)
+		fileName := make([]byte, nameLen)
+		if _, err := io.ReadFull(reader, fileName); err != nil {
+			return nil, err
+		}
+		board.Files[i] = &File{
+			Id:       id,
+			Count:    cnt,
+			FileName: string(fileName),
+		}
+	}
+
+	// version 1 没有扩展段；version 2 扩展段一直到文件结尾；version 3 扩展段前带有段数
+	if ver < 2 {
+		return board, nil
+	}
+	sectionNum := -1
+	if ver >= 3 {
+		var num uint16
+		if err := binary.Read(reader, binary.LittleEndian, &num); err != nil {
+			return nil, err
+		}
+		sectionNum = int(num)
+	}
+	for i := 0; sectionNum < 0 && reader.Len() > 0 || i < sectionNum; i++ {
+		var typ byte
+		var size uint32
+		if err := binary.Read(reader, binary.LittleEndian, &typ); err != nil {
+			return nil, err
+		}
+		if err := binary.Read(reader, binary.LittleEndian, &size); err != nil {
+			return nil, err
+		}
+		data := make([]byte, size)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return nil, err
+		}
+		var err error
+		switch typ {
+		case rdbSectionWindow:
+			if board.Windows, err = decodeWindowSection(data); err != nil {
+				return nil, fmt.Errorf("bad window section: %w", err)
+			}
+		case rdbSectionTrending:
+			if board.Trending, err = decodeTrendingSection(data); err != nil {
+				return nil, fmt.Errorf("bad trending section: %w", err)
+			}
+		case rdbSectionUnique:
+			if board.Unique, err = decodeUniqueSection(data); err != nil {
+				return nil, fmt.Errorf("bad unique section: %w", err)
+			}
+		case rdbSectionEvents:
+			if board.Events, err = decodeEventSection(data); err != nil {
+				return nil, fmt.Errorf("bad events section: %w", err)
+			}
+		default:
+			// 未知扩展段直接跳过，便于向前兼容
+		}
+	}
+	return board, nil
+}
+
+// decodeWindowSection 解码时间窗口分桶
+func decodeWindowSection(data []byte) ([]*WindowEntry, error) {
+	reader := bytes.NewReader(data)
+	var n uint32
+	if err := binary.Read(reader, binary.LittleEndian, &n); err != nil {
+		return nil, err
+	}
+	entries := make([]*WindowEntry, 0, n)
+	for i := uint32(0); i < n; i++ {
+		entry := &WindowEntry{}
+		if err := binary.Read(reader, binary.LittleEndian, &entry.Id); err != nil {
+			return nil, err
+		}
+		for _, target := range []*[]WindowBucket{&entry.Minutes, &entry.Hours} {
+			var num uint16
+			if err := binary.Read(reader, binary.LittleEndian, &num); err != nil {
+				return nil, err
+			}
+			buckets := make([]WindowBucket, num)
+			if err := binary.Read(reader, binary.LittleEndian, buckets); err != nil {
+				return nil, err
+			}
+			*target = buckets
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// decodeTrendingSection 解码热度衰减分数
+func decodeTrendingSection(data []byte) ([]*TrendingEntry, error) {
+	reader := bytes.NewReader(data)
+	var n uint32
+	if err := binary.Read(reader, binary.LittleEndian, &n); err != nil {
+		return nil, err
+	}
+	entries := make([]*TrendingEntry, n)
+	for i := range entries {
+		entries[i] = &TrendingEntry{}
+		if err := binary.Read(reader, binary.LittleEndian, entries[i]); err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+// decodeUniqueSection 解码独立访客草图
+func decodeUniqueSection(data []byte) ([]*UniqueEntry, error) {
+	reader := bytes.NewReader(data)
+	var n uint32
+	if err := binary.Read(reader, binary.LittleEndian, &n); err != nil {
+		return nil, err
+	}
+	entries := make([]*UniqueEntry, n)
+	for i := range entries {
+		entries[i] = &UniqueEntry{Registers: new([hllRegisters]uint8)}
+		if err := binary.Read(reader, binary.LittleEndian, &entries[i].Id); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(reader, entries[i].Registers[:]); err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+// decodeEventSection 解码各类型事件次数
+func decodeEventSection(data []byte) ([]*EventEntry, error) {
+	reader := bytes.NewReader(data)
+	var n uint32
+	if err := binary.Read(reader, binary.LittleEndian, &n); err != nil {
+		return nil, err
+	}
+	entries := make([]*EventEntry, n)
+	for i := range entries {
+		entries[i] = &EventEntry{}
+		if err := binary.Read(reader, binary.LittleEndian, entries[i]); err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
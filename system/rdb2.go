@@ -0,0 +1,620 @@
+package system
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math"
+)
+
+// RDB2 快照格式，整数使用varint编码，每个命名空间为一个可单独压缩的数据块
+//
+//	magic "RDB2" | version | snapshotTs | lsnNum | lsn * lsnNum | keyId | blockNum | blocks | crc(4)
+//	block: type(1) | flags(1) | rawLen | dataLen | data，flags 最低位表示 data 经过flate压缩
+//	命名空间块: nameLen | name | fieldNum | fieldNum * [tag(1) | len | data]
+//
+// 版本2起头部带有keyId，不为0时 blockNum | blocks 经过AES-GCM加密，头部作为附加认证数据；
+// 未知的数据块类型和字段标签直接跳过，便于向前兼容
+const (
+	rdb2Magic   = "RDB2"
+	rdb2Version = 2
+
+	rdb2BlockBoard byte = 1 // 命名空间数据块
+
+	rdb2FlagFlate byte = 1 // 数据块经过flate压缩
+
+	rdb2FieldFiles    byte = 1 // 文件条目，含元数据和各类型事件次数
+	rdb2FieldWindow   byte = 2 // 时间窗口分桶
+	rdb2FieldTrending byte = 3 // 热度衰减分数
+	rdb2FieldUnique   byte = 4 // 独立访客草图
+	rdb2FieldDeleted  byte = 5 // 增量快照中删除的文件ID
+	rdb2FieldSparse   byte = 6 // 稀疏表示的独立访客草图
+)
+
+// rdbWriter varint编码缓冲区
+type rdbWriter struct {
+	bytes.Buffer
+	tmp [binary.MaxVarintLen64]byte
+}
+
+func (w *rdbWriter) putUvarint(v uint64) {
+	n := binary.PutUvarint(w.tmp[:], v)
+	w.Write(w.tmp[:n])
+}
+
+func (w *rdbWriter) putVarint(v int64) {
+	n := binary.PutVarint(w.tmp[:], v)
+	w.Write(w.tmp[:n])
+}
+
+// putBytes 写入带长度前缀的字节串
+func (w *rdbWriter) putBytes(b []byte) {
+	w.putUvarint(uint64(len(b)))
+	w.Write(b)
+}
+
+func (w *rdbWriter) putString(s string) {
+	w.putUvarint(uint64(len(s)))
+	w.WriteString(s)
+}
+
+// rdbReader varint解码器，出错后后续读取均返回零值，由调用方最后检查err
+type rdbReader struct {
+	r   *bytes.Reader
+	err error
+}
+
+func newRdbReader(b []byte) *rdbReader {
+	return &rdbReader{r: bytes.NewReader(b)}
+}
+
+func (d *rdbReader) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, err := binary.ReadUvarint(d.r)
+	if err != nil {
+		d.err = io.ErrUnexpectedEOF
+	}
+	return v
+}
+
+func (d *rdbReader) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, err := binary.ReadVarint(d.r)
+	if err != nil {
+		d.err = io.ErrUnexpectedEOF
+	}
+	return v
+}
+
+func (d *rdbReader) u8() byte {
+	if d.err != nil {
+		return 0
+	}
+	b, err := d.r.ReadByte()
+	if err != nil {
+		d.err = io.ErrUnexpectedEOF
+	}
+	return b
+}
+
+// next 读取n个字节，长度超过剩余数据时报错，避免损坏的长度字段导致超大分配
+func (d *rdbReader) next(n uint64) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n > uint64(d.r.Len()) {
+		d.err = io.ErrUnexpectedEOF
+		return nil
+	}
+	b := make([]byte, n)
+	_, _ = io.ReadFull(d.r, b)
+	return b
+}
+
+func (d *rdbReader) blob() []byte {
+	return d.next(d.uvarint())
+}
+
+func (d *rdbReader) str() string {
+	return string(d.blob())
+}
+
+// count 读取条目数，每个条目至少占一个字节
+func (d *rdbReader) count() int {
+	n := d.uvarint()
+	if d.err == nil && n > uint64(d.r.Len()) {
+		d.err = fmt.Errorf("bad entry count %d", n)
+		return 0
+	}
+	return int(n)
+}
+
+// encodeRdb2 编码快照，返回不含CRC的文件内容，keyId不为0时加密数据块
+func encodeRdb2(snap *RdbSnapshot, version uint64, snapshotTs int64, compress bool, keyId uint32) ([]byte, error) {
+	var w rdbWriter
+	w.WriteString(rdb2Magic)
+	w.putUvarint(version)
+	w.putVarint(snapshotTs)
+	w.putUvarint(uint64(len(snap.Lsns)))
+	for _, lsn := range snap.Lsns {
+		w.putUvarint(lsn)
+	}
+	if version < 2 {
+		keyId = 0
+	} else {
+		w.putUvarint(uint64(keyId))
+	}
+
+	var blocks rdbWriter
+	blocks.putUvarint(uint64(len(snap.Boards)))
+	for _, board := range snap.Boards {
+		writeRdb2Block(&blocks, rdb2BlockBoard, encodeRdb2Board(board), compress)
+	}
+	if keyId == 0 {
+		w.Write(blocks.Bytes())
+		return w.Bytes(), nil
+	}
+	sealed, err := sealWithKey(keyId, blocks.Bytes(), w.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	w.Write(sealed)
+	return w.Bytes(), nil
+}
+
+// writeRdb2Block 写入数据块，压缩后没有变小时保存原始数据
+func writeRdb2Block(w *rdbWriter, typ byte, raw []byte, compress bool) {
+	var flags byte
+	data := raw
+	if compress {
+		var buf bytes.Buffer
+		fw, _ := flate.NewWriter(&buf, flate.DefaultCompression)
+		_, _ = fw.Write(raw)
+		_ = fw.Close()
+		if buf.Len() < len(raw) {
+			flags |= rdb2FlagFlate
+			data = buf.Bytes()
+		}
+	}
+	w.WriteByte(typ)
+	w.WriteByte(flags)
+	w.putUvarint(uint64(len(raw)))
+	w.putBytes(data)
+}
+
+// rdb2Field 命名空间数据块中的字段
+type rdb2Field struct {
+	tag  byte
+	data []byte
+}
+
+// encodeRdb2Board 编码单个命名空间
+func encodeRdb2Board(board *RdbBoard) []byte {
+	var w rdbWriter
+	w.putString(board.Name)
+	fields := []rdb2Field{
+		{rdb2FieldFiles, encodeRdb2Files(board)},
+		{rdb2FieldWindow, encodeRdb2Window(board.Windows)},
+		{rdb2FieldTrending, encodeRdb2Trending(board.Trending)},
+		{rdb2FieldUnique, encodeRdb2Unique(board.Unique)},
+	}
+	if sparse := encodeRdb2Sparse(board.Unique); sparse != nil {
+		fields = append(fields, rdb2Field{rdb2FieldSparse, sparse})
+	}
+	if len(board.Deleted) > 0 {
+		fields = append(fields, rdb2Field{rdb2FieldDeleted, encodeRdb2Ids(board.Deleted)})
+	}
+	w.putUvarint(uint64(len(fields)))
+	for _, field := range fields {
+		w.WriteByte(field.tag)
+		w.putBytes(field.data)
+	}
+	return w.Bytes()
+}
+
+// encodeRdb2Files 编码文件条目
+// n + n * [id | count | name | uploadTs | size | sha256 | eventNum | eventNum * count]
+func encodeRdb2Files(board *RdbBoard) []byte {
+	events := make(map[uint64]*EventCounts, len(board.Events))
+	for _, entry := range board.Events {
+		events[entry.Id] = &entry.Counts
+	}
+
+	var w rdbWriter
+	w.putUvarint(uint64(len(board.Files)))
+	for _, f := range board.Files {
+		w.putUvarint(f.Id)
+		w.putUvarint(f.Count)
+		w.putString(f.FileName)
+
+		meta := board.Meta[f.Id]
+		if meta == nil {
+			meta = &RdbFileMeta{}
+		}
+		sum, err := hex.DecodeString(meta.Sha256)
+		if err != nil {
+			sum = nil
+		}
+		w.putVarint(meta.UploadTs)
+		w.putUvarint(uint64(meta.Size))
+		w.putBytes(sum)
+
+		counts := events[f.Id]
+		if counts == nil {
+			w.putUvarint(0)
+			continue
+		}
+		w.putUvarint(eventKindNum)
+		for _, c := range counts {
+			w.putUvarint(c)
+		}
+	}
+	return w.Bytes()
+}
+
+// encodeRdb2Window 编码时间窗口分桶
+// n + n * [id | minuteNum | minuteNum * [start | count] | hourNum | hourNum * [start | count]]
+func encodeRdb2Window(entries []*WindowEntry) []byte {
+	var w rdbWriter
+	w.putUvarint(uint64(len(entries)))
+	for _, entry := range entries {
+		w.putUvarint(entry.Id)
+		for _, buckets := range [][]WindowBucket{entry.Minutes, entry.Hours} {
+			w.putUvarint(uint64(len(buckets)))
+			for _, b := range buckets {
+				w.putVarint(b.Start)
+				w.putUvarint(b.Count)
+			}
+		}
+	}
+	return w.Bytes()
+}
+
+// encodeRdb2Trending 编码热度衰减分数
+// n + n * [id | score(8) | lastTs]
+func encodeRdb2Trending(entries []*TrendingEntry) []byte {
+	var w rdbWriter
+	w.putUvarint(uint64(len(entries)))
+	for _, entry := range entries {
+		w.putUvarint(entry.Id)
+		_ = binary.Write(&w, binary.LittleEndian, math.Float64bits(entry.Score))
+		w.putVarint(entry.LastTs)
+	}
+	return w.Bytes()
+}
+
+// encodeRdb2Unique 编码稠密表示的独立访客草图
+// n + n * [id | registers(1024)]
+func encodeRdb2Unique(entries []*UniqueEntry) []byte {
+	var w rdbWriter
+	n := 0
+	for _, entry := range entries {
+		if entry.Registers != nil {
+			n++
+		}
+	}
+	w.putUvarint(uint64(n))
+	for _, entry := range entries {
+		if entry.Registers != nil {
+			w.putUvarint(entry.Id)
+			w.Write(entry.Registers[:])
+		}
+	}
+	return w.Bytes()
+}
+
+// encodeRdb2Sparse 编码稀疏表示的独立访客草图，没有时返回nil
+// n + n * [id | k | k * 与前一个哈希的差值]，哈希按升序排列
+func encodeRdb2Sparse(entries []*UniqueEntry) []byte {
+	var w rdbWriter
+	n := 0
+	for _, entry := range entries {
+		if entry.Registers == nil {
+			n++
+		}
+	}
+	if n == 0 {
+		return nil
+	}
+	w.putUvarint(uint64(n))
+	for _, entry := range entries {
+		if entry.Registers != nil {
+			continue
+		}
+		w.putUvarint(entry.Id)
+		w.putUvarint(uint64(len(entry.Hashes)))
+		var prev uint64
+		for _, hash := range entry.Hashes {
+			w.putUvarint(hash - prev)
+			prev = hash
+		}
+	}
+	return w.Bytes()
+}
+
+// encodeRdb2Ids 编码文件ID列表
+// n + n * id
+func encodeRdb2Ids(ids []uint64) []byte {
+	var w rdbWriter
+	w.putUvarint(uint64(len(ids)))
+	for _, id := range ids {
+		w.putUvarint(id)
+	}
+	return w.Bytes()
+}
+
+// rdb2Header RDB2 头部
+type rdb2Header struct {
+	version    uint64
+	snapshotTs int64
+	lsns       []uint64
+	keyId      uint32
+}
+
+// readRdb2Header 读取 magic 之后的头部
+func readRdb2Header(r io.ByteReader) (*rdb2Header, error) {
+	h := &rdb2Header{}
+	var err error
+	if h.version, err = binary.ReadUvarint(r); err != nil {
+		return nil, err
+	}
+	if h.version > rdb2Version {
+		return nil, fmt.Errorf("unsupported rdb2 version %d", h.version)
+	}
+	if h.snapshotTs, err = binary.ReadVarint(r); err != nil {
+		return nil, err
+	}
+	lsnNum, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if lsnNum > 1<<16 {
+		return nil, fmt.Errorf("bad lsn count %d", lsnNum)
+	}
+	h.lsns = make([]uint64, lsnNum)
+	for i := range h.lsns {
+		if h.lsns[i], err = binary.ReadUvarint(r); err != nil {
+			return nil, err
+		}
+	}
+	if h.version >= 2 {
+		keyId, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		if keyId > math.MaxUint32 {
+			return nil, fmt.Errorf("bad key id %d", keyId)
+		}
+		h.keyId = uint32(keyId)
+	}
+	return h, nil
+}
+
+// readRdb2 解析 RDB2 格式，body 为去掉 magic 和 CRC 的部分
+func readRdb2(path string, body []byte) (*RdbLoadResult, error) {
+	reader := bytes.NewReader(body)
+	h, err := readRdb2Header(reader)
+	if err != nil {
+		return nil, fmt.Errorf("bad rdb header: %s: %w", path, err)
+	}
+	res := &RdbLoadResult{SnapshotTs: h.snapshotTs, Lsns: h.lsns, Path: path, Format: 2, KeyId: h.keyId}
+	if h.keyId != 0 {
+		headerLen := len(body) - reader.Len()
+		aad := append([]byte(rdb2Magic), body[:headerLen]...)
+		plain, err := openWithKey(h.keyId, body[headerLen:], aad)
+		if err != nil {
+			return nil, fmt.Errorf("decrypt rdb: %s: %w", path, err)
+		}
+		reader = bytes.NewReader(plain)
+	}
+
+	d := &rdbReader{r: reader}
+	blockNum := d.count()
+	for i := 0; i < blockNum && d.err == nil; i++ {
+		typ := d.u8()
+		flags := d.u8()
+		rawLen := d.uvarint()
+		data := d.blob()
+		if d.err != nil {
+			break
+		}
+		if typ != rdb2BlockBoard {
+			continue
+		}
+		raw, err := inflateRdb2Block(data, flags, rawLen)
+		if err != nil {
+			return nil, fmt.Errorf("bad rdb block %d: %s: %w", i, path, err)
+		}
+		board, err := readRdb2Board(raw)
+		if err != nil {
+			return nil, fmt.Errorf("bad rdb block %d: %s: %w", i, path, err)
+		}
+		res.Boards = append(res.Boards, board)
+	}
+	if d.err != nil {
+		return nil, fmt.Errorf("bad rdb: %s: %w", path, d.err)
+	}
+	return res, nil
+}
+
+// inflateRdb2Block 解压数据块并校验原始长度
+func inflateRdb2Block(data []byte, flags byte, rawLen uint64) ([]byte, error) {
+	if flags&rdb2FlagFlate == 0 {
+		if uint64(len(data)) != rawLen {
+			return nil, fmt.Errorf("block length %d, want %d", len(data), rawLen)
+		}
+		return data, nil
+	}
+	fr := flate.NewReader(bytes.NewReader(data))
+	defer fr.Close()
+	// 多读一个字节用于发现解压后超出原始长度的数据
+	raw, err := io.ReadAll(io.LimitReader(fr, int64(rawLen)+1))
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(raw)) != rawLen {
+		return nil, fmt.Errorf("inflated length %d, want %d", len(raw), rawLen)
+	}
+	return raw, nil
+}
+
+// readRdb2Board 解析命名空间数据块
+func readRdb2Board(raw []byte) (*RdbBoard, error) {
+	d := newRdbReader(raw)
+	board := &RdbBoard{Name: d.str()}
+	fieldNum := d.count()
+	for i := 0; i < fieldNum && d.err == nil; i++ {
+		tag := d.u8()
+		data := d.blob()
+		if d.err != nil {
+			break
+		}
+		var err error
+		switch tag {
+		case rdb2FieldFiles:
+			err = decodeRdb2Files(data, board)
+		case rdb2FieldWindow:
+			board.Windows, err = decodeRdb2Window(data)
+		case rdb2FieldTrending:
+			board.Trending, err = decodeRdb2Trending(data)
+		case rdb2FieldUnique:
+			var dense []*UniqueEntry
+			dense, err = decodeRdb2Unique(data)
+			board.Unique = append(dense, board.Unique...)
+		case rdb2FieldSparse:
+			var sparse []*UniqueEntry
+			sparse, err = decodeRdb2Sparse(data)
+			board.Unique = append(board.Unique, sparse...)
+		case rdb2FieldDeleted:
+			board.Deleted, err = decodeRdb2Ids(data)
+		default:
+			// 未知字段直接跳过
+		}
+		if err != nil {
+			return nil, fmt.Errorf("bad field %d of board %s: %w", tag, board.Name, err)
+		}
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	return board, nil
+}
+
+// decodeRdb2Files 解码文件条目，同时填充各类型事件次数和文件元数据
+func decodeRdb2Files(data []byte, board *RdbBoard) error {
+	d := newRdbReader(data)
+	n := d.count()
+	board.Files = make([]*File, 0, n)
+	board.Events = make([]*EventEntry, 0, n)
+	board.Meta = make(map[uint64]*RdbFileMeta)
+	for i := 0; i < n && d.err == nil; i++ {
+		f := &File{Id: d.uvarint(), Count: d.uvarint(), FileName: d.str()}
+		meta := &RdbFileMeta{UploadTs: d.varint(), Size: int64(d.uvarint())}
+		if sum := d.blob(); len(sum) > 0 {
+			meta.Sha256 = hex.EncodeToString(sum)
+		}
+		entry := &EventEntry{Id: f.Id}
+		eventNum := d.count()
+		for j := 0; j < eventNum; j++ {
+			c := d.uvarint()
+			// 新版本增加的事件类型直接忽略
+			if j < eventKindNum {
+				entry.Counts[j] = c
+			}
+		}
+		board.Files = append(board.Files, f)
+		if eventNum > 0 {
+			board.Events = append(board.Events, entry)
+		}
+		if *meta != (RdbFileMeta{}) {
+			board.Meta[f.Id] = meta
+		}
+	}
+	return d.err
+}
+
+// decodeRdb2Window 解码时间窗口分桶
+func decodeRdb2Window(data []byte) ([]*WindowEntry, error) {
+	d := newRdbReader(data)
+	n := d.count()
+	entries := make([]*WindowEntry, 0, n)
+	for i := 0; i < n && d.err == nil; i++ {
+		entry := &WindowEntry{Id: d.uvarint()}
+		for _, target := range []*[]WindowBucket{&entry.Minutes, &entry.Hours} {
+			num := d.count()
+			buckets := make([]WindowBucket, 0, num)
+			for j := 0; j < num; j++ {
+				buckets = append(buckets, WindowBucket{Start: d.varint(), Count: d.uvarint()})
+			}
+			*target = buckets
+		}
+		entries = append(entries, entry)
+	}
+	return entries, d.err
+}
+
+// decodeRdb2Trending 解码热度衰减分数
+func decodeRdb2Trending(data []byte) ([]*TrendingEntry, error) {
+	d := newRdbReader(data)
+	n := d.count()
+	entries := make([]*TrendingEntry, 0, n)
+	for i := 0; i < n && d.err == nil; i++ {
+		entry := &TrendingEntry{Id: d.uvarint()}
+		if score := d.next(8); score != nil {
+			entry.Score = math.Float64frombits(binary.LittleEndian.Uint64(score))
+		}
+		entry.LastTs = d.varint()
+		entries = append(entries, entry)
+	}
+	return entries, d.err
+}
+
+// decodeRdb2Unique 解码独立访客草图
+func decodeRdb2Unique(data []byte) ([]*UniqueEntry, error) {
+	d := newRdbReader(data)
+	n := d.count()
+	entries := make([]*UniqueEntry, 0, n)
+	for i := 0; i < n && d.err == nil; i++ {
+		entry := &UniqueEntry{Id: d.uvarint(), Registers: new([hllRegisters]uint8)}
+		copy(entry.Registers[:], d.next(hllRegisters))
+		entries = append(entries, entry)
+	}
+	return entries, d.err
+}
+
+// decodeRdb2Sparse 解码稀疏表示的独立访客草图
+func decodeRdb2Sparse(data []byte) ([]*UniqueEntry, error) {
+	d := newRdbReader(data)
+	n := d.count()
+	entries := make([]*UniqueEntry, 0, n)
+	for i := 0; i < n && d.err == nil; i++ {
+		entry := &UniqueEntry{Id: d.uvarint()}
+		k := d.count()
+		entry.Hashes = make([]uint64, 0, k)
+		var hash uint64
+		for j := 0; j < k && d.err == nil; j++ {
+			hash += d.uvarint()
+			entry.Hashes = append(entry.Hashes, hash)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, d.err
+}
+
+// decodeRdb2Ids 解码文件ID列表
+func decodeRdb2Ids(data []byte) ([]uint64, error) {
+	d := newRdbReader(data)
+	n := d.count()
+	ids := make([]uint64, 0, n)
+	for i := 0; i < n && d.err == nil; i++ {
+		ids = append(ids, d.uvarint())
+	}
+	return ids, d.err
+}
@@ -0,0 +1,362 @@
+package system
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fileClick/config"
+	"hash/crc32"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// sampleRdbSnapshot 构造各字段都有数据的快照
+func sampleRdbSnapshot() *RdbSnapshot {
+	unique := UniqueEntry{Id: 1, Registers: new([hllRegisters]uint8)}
+	for i := range unique.Registers {
+		unique.Registers[i] = uint8(i % 7)
+	}
+	return &RdbSnapshot{
+		Lsns: []uint64{12, 0, 1 << 40},
+		Boards: []*RdbBoard{
+			{
+				Name: config.DefaultBoard,
+				Files: []*File{
+					{Id: 1, FileName: "a.txt", Count: 300},
+					{Id: 1 << 50, FileName: strings.Repeat("名", 100), Count: 1},
+				},
+				Windows: []*WindowEntry{
+					{Id: 1, Minutes: []WindowBucket{{Start: 60, Count: 2}, {Start: 120, Count: 298}}, Hours: []WindowBucket{{Start: 0, Count: 300}}},
+				},
+				Trending: []*TrendingEntry{{Id: 1, Score: 12.5, LastTs: 1700000000}},
+				Unique:   []*UniqueEntry{&unique, {Id: 1 << 50, Hashes: []uint64{3, 1 << 40, math.MaxUint64}}},
+				Events:   []*EventEntry{{Id: 1, Counts: EventCounts{200, 50, 30, 15, 5}}},
+				Meta: map[uint64]*RdbFileMeta{
+					1: {UploadTs: 1690000000, Size: 1024, Sha256: strings.Repeat("ab", 32)},
+				},
+			},
+			{
+				Name:     "docs",
+				Files:    []*File{{Id: 7, FileName: "b.pdf", Count: 9}},
+				Windows:  []*WindowEntry{},
+				Trending: []*TrendingEntry{},
+				Unique:   []*UniqueEntry{},
+				Events:   []*EventEntry{},
+				Meta:     map[uint64]*RdbFileMeta{},
+				Deleted:  []uint64{3, 4},
+			},
+		},
+	}
+}
+
+// withCrc 在文件内容末尾追加CRC
+func withCrc(body []byte) []byte {
+	return binary.LittleEndian.AppendUint32(body, crc32.ChecksumIEEE(body))
+}
+
+func TestRdb2RoundTrip(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		snap := sampleRdbSnapshot()
+		r := &Rdb{version: rdb2Version, compress: compress}
+		data, err := r.encode(snap, 1700000001, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := decodeRdb("test.rdb", data)
+		if err != nil {
+			t.Fatalf("compress=%v: %v", compress, err)
+		}
+		if res.Format != 2 || res.SnapshotTs != 1700000001 || !reflect.DeepEqual(res.Lsns, snap.Lsns) {
+			t.Fatalf("compress=%v: header = %d %d %v", compress, res.Format, res.SnapshotTs, res.Lsns)
+		}
+		if !reflect.DeepEqual(res.Boards, snap.Boards) {
+			t.Fatalf("compress=%v: boards differ after round trip", compress)
+		}
+	}
+}
+
+// TestRdb2Compress 压缩后变小的数据块才保存压缩数据
+func TestRdb2Compress(t *testing.T) {
+	snap := sampleRdbSnapshot()
+	plain, err := (&Rdb{version: rdb2Version}).encode(snap, 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compressed, err := (&Rdb{version: rdb2Version, compress: true}).encode(snap, 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(compressed) >= len(plain) {
+		t.Fatalf("compressed size %d, plain size %d", len(compressed), len(plain))
+	}
+}
+
+// encodeRdb1 按旧版本格式编码快照，version < 3 时只有默认排行榜，version < 2 时没有扩展段
+func encodeRdb1(version uint16, ts int64, lsns []uint64, boards []*RdbBoard) []byte {
+	var buf bytes.Buffer
+	le := binary.LittleEndian
+	buf.WriteString(rdb1Magic)
+	_ = binary.Write(&buf, le, version)
+	_ = binary.Write(&buf, le, ts)
+	if version >= 4 {
+		_ = binary.Write(&buf, le, uint16(len(lsns)))
+		_ = binary.Write(&buf, le, lsns)
+	}
+	if version >= 3 {
+		_ = binary.Write(&buf, le, uint32(len(boards)))
+	}
+	for _, board := range boards {
+		if version >= 3 {
+			_ = binary.Write(&buf, le, uint16(len(board.Name)))
+			buf.WriteString(board.Name)
+		}
+		_ = binary.Write(&buf, le, uint32(len(board.Files)))
+		for _, f := range board.Files {
+			_ = binary.Write(&buf, le, f.Id)
+			_ = binary.Write(&buf, le, f.Count)
+			_ = binary.Write(&buf, le, uint16(len(f.FileName)))
+			buf.WriteString(f.FileName)
+		}
+		if version < 2 {
+			continue
+		}
+		var trending, events bytes.Buffer
+		_ = binary.Write(&trending, le, uint32(len(board.Trending)))
+		for _, entry := range board.Trending {
+			_ = binary.Write(&trending, le, entry)
+		}
+		_ = binary.Write(&events, le, uint32(len(board.Events)))
+		for _, entry := range board.Events {
+			_ = binary.Write(&events, le, entry)
+		}
+		sections := []struct {
+			typ  byte
+			data []byte
+		}{
+			{rdbSectionTrending, trending.Bytes()},
+			{rdbSectionEvents, events.Bytes()},
+			{99, []byte("unknown")},
+		}
+		if version >= 3 {
+			_ = binary.Write(&buf, le, uint16(len(sections)))
+		}
+		for _, s := range sections {
+			buf.WriteByte(s.typ)
+			_ = binary.Write(&buf, le, uint32(len(s.data)))
+			buf.Write(s.data)
+		}
+	}
+	return withCrc(buf.Bytes())
+}
+
+func TestRdb1Read(t *testing.T) {
+	board := &RdbBoard{
+		Name:     "docs",
+		Files:    []*File{{Id: 1, FileName: "a.txt", Count: 5}, {Id: 2, FileName: "b.txt", Count: 3}},
+		Trending: []*TrendingEntry{{Id: 1, Score: 2.5, LastTs: 100}},
+		Events:   []*EventEntry{{Id: 1, Counts: EventCounts{4, 1}}},
+	}
+	tests := []struct {
+		name    string
+		version uint16
+		lsns    []uint64
+		want    *RdbBoard
+	}{
+		{"v1", 1, nil, &RdbBoard{Name: config.DefaultBoard, Files: board.Files}},
+		{"v2", 2, nil, &RdbBoard{Name: config.DefaultBoard, Files: board.Files, Trending: board.Trending, Events: board.Events}},
+		{"v3", 3, nil, board},
+		{"v4", 4, []uint64{7, 8, 9}, board},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := decodeRdb("test.rdb", encodeRdb1(tt.version, 1600000000, tt.lsns, []*RdbBoard{board}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.Format != 1 || res.SnapshotTs != 1600000000 {
+				t.Fatalf("format %d, ts %d", res.Format, res.SnapshotTs)
+			}
+			if len(tt.lsns) > 0 && !reflect.DeepEqual(res.Lsns, tt.lsns) {
+				t.Fatalf("lsns = %v, want %v", res.Lsns, tt.lsns)
+			}
+			if len(res.Boards) != 1 || !reflect.DeepEqual(res.Boards[0], tt.want) {
+				t.Fatalf("board = %+v, want %+v", res.Boards[0], tt.want)
+			}
+		})
+	}
+}
+
+// TestRdb1Migrate 旧版本快照读取后保存为 RDB2，数据不变
+func TestRdb1Migrate(t *testing.T) {
+	board := &RdbBoard{
+		Name:     "docs",
+		Files:    []*File{{Id: 1, FileName: "a.txt", Count: 5}},
+		Trending: []*TrendingEntry{{Id: 1, Score: 2.5, LastTs: 100}},
+		Events:   []*EventEntry{{Id: 1, Counts: EventCounts{4, 1}}},
+	}
+	old, err := decodeRdb("old.rdb", encodeRdb1(4, 1600000000, []uint64{3}, []*RdbBoard{board}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := (&Rdb{version: rdb2Version, compress: true}).encode(&RdbSnapshot{Lsns: old.Lsns, Boards: old.Boards}, old.SnapshotTs, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := decodeRdb("new.rdb", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := res.Boards[0]
+	if res.Format != 2 || !reflect.DeepEqual(res.Lsns, []uint64{3}) || got.Name != "docs" ||
+		!reflect.DeepEqual(got.Files, board.Files) || !reflect.DeepEqual(got.Trending, board.Trending) ||
+		!reflect.DeepEqual(got.Events, board.Events) {
+		t.Fatalf("migrated board = %+v", got)
+	}
+}
+
+// TestRdb2Truncated 任意位置截断的快照（CRC按截断后的内容重新计算）都必须解析失败
+func TestRdb2Truncated(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		data, err := (&Rdb{version: rdb2Version, compress: compress}).encode(sampleRdbSnapshot(), 1, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body := data[:len(data)-4]
+		for cut := len(rdb2Magic); cut < len(body); cut++ {
+			if _, err := decodeRdb("test.rdb", withCrc(append([]byte(nil), body[:cut]...))); err == nil {
+				t.Fatalf("compress=%v: body truncated at %d/%d decoded without error", compress, cut, len(body))
+			}
+		}
+	}
+}
+
+func TestRdb2Corrupt(t *testing.T) {
+	data, err := (&Rdb{version: rdb2Version}).encode(sampleRdbSnapshot(), 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, i := range []int{0, 5, len(data) / 2, len(data) - 5, len(data) - 1} {
+		bad := append([]byte(nil), data...)
+		bad[i] ^= 0x40
+		if _, err := decodeRdb("test.rdb", bad); err == nil {
+			t.Fatalf("corrupt byte at %d decoded without error", i)
+		}
+	}
+	if _, err := decodeRdb("test.rdb", data[:6]); err == nil {
+		t.Fatal("short file decoded without error")
+	}
+}
+
+// rdb2Body 构造只含一个数据块的 RDB2 文件
+func rdb2Body(typ, flags byte, rawLen uint64, data []byte) []byte {
+	var w rdbWriter
+	w.WriteString(rdb2Magic)
+	w.putUvarint(rdb2Version)
+	w.putVarint(1)
+	w.putUvarint(0) // lsnNum
+	w.putUvarint(0) // keyId
+	w.putUvarint(1) // blockNum
+	w.WriteByte(typ)
+	w.WriteByte(flags)
+	w.putUvarint(rawLen)
+	w.putBytes(data)
+	return withCrc(w.Bytes())
+}
+
+// rdb2BoardBlock 构造包含指定字段的命名空间数据块
+func rdb2BoardBlock(name string, fields ...rdb2Field) []byte {
+	var w rdbWriter
+	w.putString(name)
+	w.putUvarint(uint64(len(fields)))
+	for _, f := range fields {
+		w.WriteByte(f.tag)
+		w.putBytes(f.data)
+	}
+	return w.Bytes()
+}
+
+func deflate(raw []byte) []byte {
+	var buf bytes.Buffer
+	fw, _ := flate.NewWriter(&buf, flate.DefaultCompression)
+	_, _ = fw.Write(raw)
+	_ = fw.Close()
+	return buf.Bytes()
+}
+
+func TestRdb2BadLengths(t *testing.T) {
+	block := rdb2BoardBlock("b", rdb2Field{rdb2FieldFiles, encodeRdb2Files(&RdbBoard{Files: []*File{{Id: 1, Count: 2}}})})
+
+	// 文件条目数远超剩余数据
+	var hugeCount rdbWriter
+	hugeCount.putUvarint(1 << 40)
+	hugeBlock := rdb2BoardBlock("b", rdb2Field{rdb2FieldFiles, hugeCount.Bytes()})
+	// 数据长度字段超过剩余数据
+	var w rdbWriter
+	w.WriteString(rdb2Magic)
+	w.putUvarint(rdb2Version)
+	w.putVarint(1)
+	w.putUvarint(0)
+	w.putUvarint(0)
+	w.putUvarint(1)
+	w.WriteByte(rdb2BlockBoard)
+	w.WriteByte(0)
+	w.putUvarint(10)
+	w.putUvarint(1 << 30)
+	w.Write(make([]byte, 10))
+	// 超过上限的LSN个数
+	var lsns rdbWriter
+	lsns.WriteString(rdb2Magic)
+	lsns.putUvarint(rdb2Version)
+	lsns.putVarint(1)
+	lsns.putUvarint(1<<16 + 1)
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"raw length mismatch", rdb2Body(rdb2BlockBoard, 0, uint64(len(block))+1, block)},
+		{"inflated longer than raw length", rdb2Body(rdb2BlockBoard, rdb2FlagFlate, uint64(len(block))-1, deflate(block))},
+		{"inflated shorter than raw length", rdb2Body(rdb2BlockBoard, rdb2FlagFlate, uint64(len(block))+1, deflate(block))},
+		{"bad flate data", rdb2Body(rdb2BlockBoard, rdb2FlagFlate, uint64(len(block)), block)},
+		{"entry count too large", rdb2Body(rdb2BlockBoard, 0, uint64(len(hugeBlock)), hugeBlock)},
+		{"field count too large", rdb2Body(rdb2BlockBoard, 0, 4, []byte{1, 'b', 0x7f, 0})},
+		{"data length beyond body", withCrc(w.Bytes())},
+		{"lsn count too large", withCrc(lsns.Bytes())},
+		{"unsupported version", withCrc(append([]byte(rdb2Magic), rdb2Version+1, 0, 0))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := decodeRdb("test.rdb", tt.data); err == nil {
+				t.Fatal("decoded without error")
+			}
+		})
+	}
+}
+
+// TestRdb2SkipUnknown 未知的数据块和字段直接跳过
+func TestRdb2SkipUnknown(t *testing.T) {
+	block := rdb2BoardBlock("b",
+		rdb2Field{99, []byte("future field")},
+		rdb2Field{rdb2FieldFiles, encodeRdb2Files(&RdbBoard{Files: []*File{{Id: 1, FileName: "a", Count: 2}}})},
+	)
+	var w rdbWriter
+	w.WriteString(rdb2Magic)
+	w.putUvarint(rdb2Version)
+	w.putVarint(1)
+	w.putUvarint(0)
+	w.putUvarint(0)
+	w.putUvarint(2)
+	writeRdb2Block(&w, 42, []byte("future block"), false)
+	writeRdb2Block(&w, rdb2BlockBoard, block, true)
+
+	res, err := decodeRdb("test.rdb", withCrc(w.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Boards) != 1 || res.Boards[0].Name != "b" ||
+		!reflect.DeepEqual(res.Boards[0].Files, []*File{{Id: 1, FileName: "a", Count: 2}}) {
+		t.Fatalf("boards = %+v", res.Boards)
+	}
+}
@@ -0,0 +1,176 @@
+package system
+
+import (
+	"errors"
+	"fileClick/config"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 增量快照文件名为 delta-<基准快照时间戳>-<序号>.rdb，格式与 RDB2 相同，
+// 只包含上次快照之后变化的文件，删除的文件记入 Deleted；恢复时按序号依次合并到基准快照
+
+// SaveDelta 保存基于本进程最近一次基准快照的增量快照
+func (r *Rdb) SaveDelta(snap *RdbSnapshot) (string, error) {
+	if r.baseTs == 0 {
+		return "", errors.New("no base rdb for delta")
+	}
+	path := filepath.Join(r.dir, fmt.Sprintf("delta-%d-%06d.rdb", r.baseTs, r.deltaSeq+1))
+	if err := r.write(path, snap, time.Now().Unix()); err != nil {
+		return "", err
+	}
+	r.deltaSeq++
+	return path, nil
+}
+
+// Compact 将基准快照及其增量快照合并为新的基准快照，Save 会删除合并后不再需要的增量快照
+// 本进程保存过基准快照时合并该基准快照，其中任何一个文件损坏都返回错误；否则合并最新可用的基准快照
+func (r *Rdb) Compact() (string, error) {
+	var ld *RdbLoadResult
+	if r.baseTs != 0 {
+		var err error
+		if ld, err = ReadRdbFile(filepath.Join(r.dir, fmt.Sprintf("dump-%d.rdb", r.baseTs))); err != nil {
+			return "", err
+		}
+		r.applyDeltas(ld)
+		if len(ld.Skipped) > 0 {
+			return "", fmt.Errorf("bad delta rdb: %s", ld.Skipped[0].Error)
+		}
+	} else {
+		var err error
+		if ld, err = r.LoadLatest(); err != nil {
+			return "", err
+		}
+	}
+	if len(ld.Deltas) == 0 {
+		return ld.Path, nil
+	}
+	_, path, err := r.Save(&RdbSnapshot{Lsns: ld.Lsns, Boards: ld.Boards})
+	return path, err
+}
+
+// deltaFiles 列出基准快照的增量快照，按序号升序排列
+func (r *Rdb) deltaFiles(baseTs int64) []string {
+	matches, _ := filepath.Glob(filepath.Join(r.dir, fmt.Sprintf("delta-%d-*.rdb", baseTs)))
+	sort.Strings(matches)
+	return matches
+}
+
+// removeDeltas 删除基准快照时间戳满足match的增量快照
+func (r *Rdb) removeDeltas(match func(baseTs int64) bool) {
+	matches, _ := filepath.Glob(filepath.Join(r.dir, "delta-*.rdb"))
+	for _, path := range matches {
+		parts := strings.Split(strings.TrimSuffix(filepath.Base(path), ".rdb"), "-")
+		if len(parts) != 3 {
+			continue
+		}
+		baseTs, err := strconv.ParseInt(parts[1], 10, 64)
+		if err == nil && match(baseTs) {
+			_ = os.Remove(path)
+		}
+	}
+}
+
+// applyDeltas 依次将基准快照的增量快照合并到res，遇到损坏、序号不连续或早于当前检查点的增量快照时停止并记入Skipped
+func (r *Rdb) applyDeltas(res *RdbLoadResult) {
+	var baseTs int64
+	if _, err := fmt.Sscanf(filepath.Base(res.Path), "dump-%d.rdb", &baseTs); err != nil {
+		return
+	}
+	for i, path := range r.deltaFiles(baseTs) {
+		var seq int
+		_, err := fmt.Sscanf(filepath.Base(path), fmt.Sprintf("delta-%d-%%d.rdb", baseTs), &seq)
+		if err == nil && seq != i+1 {
+			// 缺少中间的增量快照时，合并之后的增量快照会使检查点越过缺失的变化
+			err = fmt.Errorf("missing delta rdb %d before %s", i+1, path)
+		}
+		var delta *RdbLoadResult
+		if err == nil {
+			delta, err = ReadRdbFile(path)
+		}
+		if err == nil && !lsnsNotBefore(delta.Lsns, res.Lsns) {
+			err = fmt.Errorf("delta rdb older than its base: %s", path)
+		}
+		if err != nil {
+			config.Error("增量快照不可用，之后的变化从WAL回放: " + err.Error())
+			res.Skipped = append(res.Skipped, &RdbSkipped{Path: path, Error: err.Error()})
+			return
+		}
+		mergeRdbDelta(res, delta)
+		res.Deltas = append(res.Deltas, path)
+	}
+}
+
+// lsnsNotBefore 判断检查点a的各线程LSN都不小于b
+func lsnsNotBefore(a, b []uint64) bool {
+	for i, lsn := range b {
+		if i >= len(a) || a[i] < lsn {
+			return false
+		}
+	}
+	return true
+}
+
+// mergeRdbDelta 将增量快照合并到res，增量快照中出现的文件整体替换基准中的数据
+func mergeRdbDelta(res *RdbLoadResult, delta *RdbLoadResult) {
+	boards := make(map[string]*RdbBoard, len(res.Boards))
+	for _, board := range res.Boards {
+		boards[board.Name] = board
+	}
+	for _, d := range delta.Boards {
+		board, exists := boards[d.Name]
+		if !exists {
+			board = &RdbBoard{Name: d.Name}
+			boards[d.Name] = board
+			res.Boards = append(res.Boards, board)
+		}
+		ids := make(map[uint64]struct{}, len(d.Files)+len(d.Deleted))
+		for _, f := range d.Files {
+			ids[f.Id] = struct{}{}
+		}
+		for _, id := range d.Deleted {
+			ids[id] = struct{}{}
+		}
+
+		board.Files = append(dropRdbEntries(board.Files, ids, func(f *File) uint64 { return f.Id }), d.Files...)
+		board.Windows = append(dropRdbEntries(board.Windows, ids, func(e *WindowEntry) uint64 { return e.Id }), d.Windows...)
+		board.Trending = append(dropRdbEntries(board.Trending, ids, func(e *TrendingEntry) uint64 { return e.Id }), d.Trending...)
+		board.Unique = append(dropRdbEntries(board.Unique, ids, func(e *UniqueEntry) uint64 { return e.Id }), d.Unique...)
+		board.Events = append(dropRdbEntries(board.Events, ids, func(e *EventEntry) uint64 { return e.Id }), d.Events...)
+		if board.Meta == nil {
+			board.Meta = make(map[uint64]*RdbFileMeta)
+		}
+		for id := range ids {
+			delete(board.Meta, id)
+		}
+		for id, meta := range d.Meta {
+			board.Meta[id] = meta
+		}
+
+		// 按count降序、ID升序排列，与全量快照一致，加载到链表时可直接追加
+		sort.Slice(board.Files, func(i, j int) bool {
+			if board.Files[i].Count != board.Files[j].Count {
+				return board.Files[i].Count > board.Files[j].Count
+			}
+			return board.Files[i].Id < board.Files[j].Id
+		})
+	}
+	res.SnapshotTs = delta.SnapshotTs
+	res.Lsns = delta.Lsns
+}
+
+// dropRdbEntries 原地移除ID在ids中的条目
+func dropRdbEntries[T any](entries []T, ids map[uint64]struct{}, id func(T) uint64) []T {
+	kept := entries[:0]
+	for _, entry := range entries {
+		if _, exists := ids[id(entry)]; !exists {
+			kept = append(kept, entry)
+		}
+	}
+	return kept
+}
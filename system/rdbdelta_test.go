@@ -0,0 +1,299 @@
+package system
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// rdbCounts 按排行榜汇总快照中各文件的点击数
+func rdbCounts(boards []*RdbBoard) map[string]map[uint64]uint64 {
+	counts := make(map[string]map[uint64]uint64, len(boards))
+	for _, board := range boards {
+		files := make(map[uint64]uint64, len(board.Files))
+		for _, f := range board.Files {
+			files[f.Id] = f.Count
+		}
+		counts[board.Name] = files
+	}
+	return counts
+}
+
+// rdbFiles 构造文件条目，参数为 id, count 交替
+func rdbFiles(pairs ...uint64) []*File {
+	files := make([]*File, 0, len(pairs)/2)
+	for i := 0; i+1 < len(pairs); i += 2 {
+		files = append(files, &File{Id: pairs[i], Count: pairs[i+1]})
+	}
+	return files
+}
+
+func TestMergeRdbDelta(t *testing.T) {
+	tests := []struct {
+		name   string
+		base   []*RdbBoard
+		deltas [][]*RdbBoard
+		want   map[string]map[uint64]uint64
+	}{
+		{
+			name:   "changed files replace base entries",
+			base:   []*RdbBoard{{Name: "a", Files: rdbFiles(1, 5, 2, 3)}},
+			deltas: [][]*RdbBoard{{{Name: "a", Files: rdbFiles(2, 7)}}},
+			want:   map[string]map[uint64]uint64{"a": {1: 5, 2: 7}},
+		},
+		{
+			name: "deltas apply in order",
+			base: []*RdbBoard{{Name: "a", Files: rdbFiles(1, 5)}},
+			deltas: [][]*RdbBoard{
+				{{Name: "a", Files: rdbFiles(1, 6, 3, 1)}},
+				{{Name: "a", Files: rdbFiles(1, 9)}},
+			},
+			want: map[string]map[uint64]uint64{"a": {1: 9, 3: 1}},
+		},
+		{
+			name: "deleted ids are dropped",
+			base: []*RdbBoard{{Name: "a", Files: rdbFiles(1, 5, 2, 3, 4, 1)}},
+			deltas: [][]*RdbBoard{
+				{{Name: "a", Deleted: []uint64{2}}},
+				{{Name: "a", Files: rdbFiles(5, 2), Deleted: []uint64{4, 100}}},
+			},
+			want: map[string]map[uint64]uint64{"a": {1: 5, 5: 2}},
+		},
+		{
+			name: "deleted then re-added",
+			base: []*RdbBoard{{Name: "a", Files: rdbFiles(1, 5)}},
+			deltas: [][]*RdbBoard{
+				{{Name: "a", Deleted: []uint64{1}}},
+				{{Name: "a", Files: rdbFiles(1, 1)}},
+			},
+			want: map[string]map[uint64]uint64{"a": {1: 1}},
+		},
+		{
+			name:   "new board",
+			base:   []*RdbBoard{{Name: "a", Files: rdbFiles(1, 5)}},
+			deltas: [][]*RdbBoard{{{Name: "b", Files: rdbFiles(2, 2)}}},
+			want:   map[string]map[uint64]uint64{"a": {1: 5}, "b": {2: 2}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := &RdbLoadResult{SnapshotTs: 100, Lsns: []uint64{1}, Boards: tt.base}
+			for i, boards := range tt.deltas {
+				mergeRdbDelta(res, &RdbLoadResult{SnapshotTs: int64(101 + i), Lsns: []uint64{uint64(2 + i)}, Boards: boards})
+			}
+			if got := rdbCounts(res.Boards); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("counts = %v, want %v", got, tt.want)
+			}
+			last := len(tt.deltas) - 1
+			if res.SnapshotTs != int64(101+last) || res.Lsns[0] != uint64(2+last) {
+				t.Fatalf("checkpoint = %d %v, want the last delta", res.SnapshotTs, res.Lsns)
+			}
+			for _, board := range res.Boards {
+				for i := 1; i < len(board.Files); i++ {
+					if board.Files[i-1].Count < board.Files[i].Count {
+						t.Fatalf("board %s not sorted by count", board.Name)
+					}
+				}
+			}
+		})
+	}
+}
+
+// TestMergeRdbDeltaSideData 增量快照中的文件同时替换时间窗口、热度、访客草图、事件次数和元数据
+func TestMergeRdbDeltaSideData(t *testing.T) {
+	res := &RdbLoadResult{Boards: []*RdbBoard{{
+		Name:     "a",
+		Files:    rdbFiles(1, 5, 2, 3),
+		Windows:  []*WindowEntry{{Id: 1}, {Id: 2}},
+		Trending: []*TrendingEntry{{Id: 1, Score: 1}, {Id: 2, Score: 2}},
+		Unique:   []*UniqueEntry{{Id: 1}, {Id: 2}},
+		Events:   []*EventEntry{{Id: 1, Counts: EventCounts{5}}, {Id: 2, Counts: EventCounts{3}}},
+		Meta:     map[uint64]*RdbFileMeta{1: {Size: 1}, 2: {Size: 2}},
+	}}}
+	mergeRdbDelta(res, &RdbLoadResult{Boards: []*RdbBoard{{
+		Name:     "a",
+		Files:    rdbFiles(1, 8),
+		Trending: []*TrendingEntry{{Id: 1, Score: 9}},
+		Events:   []*EventEntry{{Id: 1, Counts: EventCounts{8}}},
+		Meta:     map[uint64]*RdbFileMeta{1: {Size: 10}},
+		Deleted:  []uint64{2},
+	}}})
+	board := res.Boards[0]
+	if len(board.Windows) != 0 || len(board.Unique) != 0 {
+		t.Fatalf("stale side data kept: windows %d, unique %d", len(board.Windows), len(board.Unique))
+	}
+	if len(board.Trending) != 1 || board.Trending[0].Score != 9 {
+		t.Fatalf("trending = %+v", board.Trending)
+	}
+	if len(board.Events) != 1 || board.Events[0].Counts[0] != 8 {
+		t.Fatalf("events = %+v", board.Events)
+	}
+	if !reflect.DeepEqual(board.Meta, map[uint64]*RdbFileMeta{1: {Size: 10}}) {
+		t.Fatalf("meta = %+v", board.Meta)
+	}
+}
+
+// saveRdbChain 保存一个基准快照及其增量快照，返回增量快照路径
+func saveRdbChain(t *testing.T, r *Rdb, base *RdbSnapshot, deltas ...*RdbSnapshot) []string {
+	t.Helper()
+	if _, _, err := r.Save(base); err != nil {
+		t.Fatal(err)
+	}
+	paths := make([]string, 0, len(deltas))
+	for _, delta := range deltas {
+		path, err := r.SaveDelta(delta)
+		if err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+	}
+	return paths
+}
+
+func TestApplyDeltas(t *testing.T) {
+	base := &RdbSnapshot{Lsns: []uint64{10}, Boards: []*RdbBoard{{Name: "a", Files: rdbFiles(1, 5, 2, 3)}}}
+	deltas := []*RdbSnapshot{
+		{Lsns: []uint64{20}, Boards: []*RdbBoard{{Name: "a", Files: rdbFiles(1, 8)}}},
+		{Lsns: []uint64{30}, Boards: []*RdbBoard{{Name: "a", Deleted: []uint64{2}}}},
+		{Lsns: []uint64{40}, Boards: []*RdbBoard{{Name: "a", Files: rdbFiles(3, 1)}}},
+	}
+	tests := []struct {
+		name    string
+		damage  func(t *testing.T, paths []string)
+		want    map[uint64]uint64
+		lsn     uint64
+		merged  int
+		skipped int
+	}{
+		{
+			name:   "all deltas",
+			want:   map[uint64]uint64{1: 8, 3: 1},
+			lsn:    40,
+			merged: 3,
+		},
+		{
+			name: "corrupt delta stops the merge",
+			damage: func(t *testing.T, paths []string) {
+				corruptFile(t, paths[1])
+			},
+			want:    map[uint64]uint64{1: 8, 2: 3},
+			lsn:     20,
+			merged:  1,
+			skipped: 1,
+		},
+		{
+			name: "missing delta stops the merge",
+			damage: func(t *testing.T, paths []string) {
+				if err := os.Remove(paths[0]); err != nil {
+					t.Fatal(err)
+				}
+			},
+			want:    map[uint64]uint64{1: 5, 2: 3},
+			lsn:     10,
+			skipped: 1,
+		},
+		{
+			name: "delta older than base",
+			damage: func(t *testing.T, paths []string) {
+				older, err := (&Rdb{version: rdb2Version}).encode(&RdbSnapshot{Lsns: []uint64{5}}, 1, 0)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(paths[0], older, 0644); err != nil {
+					t.Fatal(err)
+				}
+			},
+			want:    map[uint64]uint64{1: 5, 2: 3},
+			lsn:     10,
+			skipped: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewRDBWithDir(t.TempDir())
+			paths := saveRdbChain(t, r, base, deltas...)
+			if tt.damage != nil {
+				tt.damage(t, paths)
+			}
+			res, err := r.LoadLatest()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := rdbCounts(res.Boards)["a"]; !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("counts = %v, want %v", got, tt.want)
+			}
+			if res.Lsns[0] != tt.lsn || len(res.Deltas) != tt.merged || len(res.Skipped) != tt.skipped {
+				t.Fatalf("lsn %d, merged %d, skipped %d, want %d %d %d",
+					res.Lsns[0], len(res.Deltas), len(res.Skipped), tt.lsn, tt.merged, tt.skipped)
+			}
+		})
+	}
+}
+
+// corruptFile 翻转文件中间的一个字节
+func corruptFile(t *testing.T, path string) {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)/2] ^= 0xff
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	r := NewRDBWithDir(t.TempDir())
+	saveRdbChain(t, r,
+		&RdbSnapshot{Lsns: []uint64{10}, Boards: []*RdbBoard{{Name: "a", Files: rdbFiles(1, 5, 2, 3)}}},
+		&RdbSnapshot{Lsns: []uint64{20}, Boards: []*RdbBoard{{Name: "a", Files: rdbFiles(1, 8)}}},
+		&RdbSnapshot{Lsns: []uint64{30}, Boards: []*RdbBoard{{Name: "b", Files: rdbFiles(4, 1)}, {Name: "a", Deleted: []uint64{2}}}},
+	)
+	path, err := r.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if remaining, _ := filepath.Glob(filepath.Join(r.dir, "delta-*.rdb")); len(remaining) != 0 {
+		t.Fatalf("deltas left after compact: %v", remaining)
+	}
+
+	// 合并后的基准快照单独读取即为完整数据
+	res, err := ReadRdbFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]map[uint64]uint64{"a": {1: 8}, "b": {4: 1}}
+	if got := rdbCounts(res.Boards); !reflect.DeepEqual(got, want) {
+		t.Fatalf("counts = %v, want %v", got, want)
+	}
+	if res.Lsns[0] != 30 {
+		t.Fatalf("lsn = %d, want 30", res.Lsns[0])
+	}
+
+	// 没有增量快照时不重写
+	again, err := r.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again != path {
+		t.Fatalf("compact without deltas = %s, want %s", again, path)
+	}
+}
+
+// TestCompactCorruptDelta 本进程的基准快照有损坏的增量快照时不合并，保留原文件
+func TestCompactCorruptDelta(t *testing.T) {
+	r := NewRDBWithDir(t.TempDir())
+	paths := saveRdbChain(t, r,
+		&RdbSnapshot{Lsns: []uint64{10}, Boards: []*RdbBoard{{Name: "a", Files: rdbFiles(1, 5)}}},
+		&RdbSnapshot{Lsns: []uint64{20}, Boards: []*RdbBoard{{Name: "a", Files: rdbFiles(1, 8)}}},
+	)
+	corruptFile(t, paths[0])
+	if _, err := r.Compact(); err == nil {
+		t.Fatal("compact with a corrupt delta succeeded")
+	}
+	if _, err := os.Stat(paths[0]); err != nil {
+		t.Fatalf("corrupt delta removed: %v", err)
+	}
+}
@@ -0,0 +1,240 @@
+package system
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fileClick/config"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 复制流由帧组成，每帧为 type(1) | uvarint长度 | 数据：
+// 连接后主节点先发送全部文件信息和当前状态的全量快照（RDB2 格式，快照的LSN检查点即复制起点），
+// 之后按投递顺序发送每条WAL记录，记录的文件首次出现时先发送其文件信息，并每隔 ReplHeartbeat 发送一次心跳
+
+const (
+	replFrameFiles     byte = 1 // 全部文件信息，JSON
+	replFrameSnapshot  byte = 2 // 全量快照
+	replFrameFile      byte = 3 // 单个文件信息: uvarint文件ID | JSON
+	replFrameRecord    byte = 4 // WAL记录负载，与段文件中的记录负载相同
+	replFrameHeartbeat byte = 5 // 心跳: varint主节点时间戳（毫秒） | uvarint线程数 | 各线程已投递的LSN
+)
+
+// replFrameMax 单帧的最大长度
+const replFrameMax = 1 << 30
+
+// ErrReplOverflow 从节点消费过慢，复制缓冲区已满，需要重新连接并全量同步
+var ErrReplOverflow = errors.New("replication buffer overflow")
+
+// replSub 一个复制流的订阅，接收快照检查点之后投递的WAL记录
+type replSub struct {
+	ch       chan *WalRecord
+	overflow atomic.Bool
+}
+
+// replHub 复制流订阅者
+type replHub struct {
+	mu   sync.RWMutex
+	subs map[*replSub]struct{}
+}
+
+// publish 将投递的记录发送给全部订阅者，订阅者缓冲区已满时标记溢出并不再发送
+func (h *replHub) publish(rec *WalRecord) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for sub := range h.subs {
+		if sub.overflow.Load() {
+			continue
+		}
+		select {
+		case sub.ch <- rec:
+		default:
+			sub.overflow.Store(true)
+		}
+	}
+}
+
+func (h *replHub) add(sub *replSub) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.subs == nil {
+		h.subs = make(map[*replSub]struct{})
+	}
+	h.subs[sub] = struct{}{}
+}
+
+func (h *replHub) remove(sub *replSub) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.subs, sub)
+}
+
+// Replicate 向w写入复制流，每写完一批帧调用flush，ctx取消、引擎关闭、写入失败或缓冲区溢出时返回
+// 全量快照通过快照屏障拷贝，不清空增量快照的变化集合，也不阻塞点击
+func (e *Engine) Replicate(ctx context.Context, w io.Writer, flush func()) error {
+	return e.replicate(ctx, w, flush, config.ReplBuffer)
+}
+
+// replicate 同 Replicate，buffer为缓冲的记录数
+func (e *Engine) replicate(ctx context.Context, w io.Writer, flush func(), buffer int) error {
+	sub := &replSub{ch: make(chan *WalRecord, buffer)}
+	data := &RdbSnapshot{}
+	var pending []<-chan *RdbBoard
+	e.snapMu.Lock()
+	if e.closed {
+		e.snapMu.Unlock()
+		return ErrEngineClosed
+	}
+	// 检查点之后投递的记录都会发送给订阅者，快照恰好包含检查点之前的记录
+	e.wal.Checkpoint(func(lsns []uint64) {
+		data.Lsns = lsns
+		e.repl.add(sub)
+		for _, rb := range e.allBoards() {
+			pending = append(pending, rb.requestCopy())
+		}
+	})
+	e.snapMu.Unlock()
+	defer e.repl.remove(sub)
+	for _, snap := range pending {
+		data.Boards = append(data.Boards, <-snap)
+	}
+
+	infos, err := GetAllFiles()
+	if err != nil {
+		return err
+	}
+	for _, board := range data.Boards {
+		board.Meta = fileMetas(board.Files, infos)
+	}
+	fileData, err := json.Marshal(infos)
+	if err != nil {
+		return err
+	}
+	// 复制流中的快照不加密，从节点按自己的密钥保存
+	snapData, err := e.rdb.encode(data, time.Now().Unix(), 0)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(w)
+	writeReplFrame(bw, replFrameFiles, fileData)
+	writeReplFrame(bw, replFrameSnapshot, snapData)
+	if err := e.flushRepl(bw, flush); err != nil {
+		return err
+	}
+
+	// 从节点已有的文件，之后的记录涉及其他文件时先发送文件信息
+	known := make(map[uint64]struct{}, len(infos))
+	for id := range infos {
+		known[id] = struct{}{}
+	}
+	heartbeat := time.NewTicker(config.ReplHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-e.ctx.Done():
+			return ErrEngineClosed
+		case rec := <-sub.ch:
+			e.writeReplRecord(bw, rec, known)
+			// 一次写出缓冲区中已有的记录
+			for drained := false; !drained; {
+				select {
+				case rec := <-sub.ch:
+					e.writeReplRecord(bw, rec, known)
+				default:
+					drained = true
+				}
+			}
+		case <-heartbeat.C:
+			var lsns []uint64
+			e.wal.Checkpoint(func(applied []uint64) {
+				lsns = applied
+			})
+			writeReplFrame(bw, replFrameHeartbeat, encodeReplHeartbeat(time.Now().UnixMilli(), lsns))
+		}
+		if err := e.flushRepl(bw, flush); err != nil {
+			return err
+		}
+		// 溢出之前的记录已全部写出，从节点重新连接后全量同步
+		if sub.overflow.Load() && len(sub.ch) == 0 {
+			return ErrReplOverflow
+		}
+	}
+}
+
+// writeReplRecord 写入一条WAL记录，文件首次出现时先写入其文件信息
+func (e *Engine) writeReplRecord(bw *bufio.Writer, rec *WalRecord, known map[uint64]struct{}) {
+	if _, exists := known[rec.FileId]; !exists && rec.Op == WalOpClick {
+		if info, err := GetFileByID(rec.FileId); err == nil {
+			if data, err := json.Marshal(info); err == nil {
+				writeReplFrame(bw, replFrameFile, append(binary.AppendUvarint(nil, rec.FileId), data...))
+				known[rec.FileId] = struct{}{}
+			}
+		}
+	}
+	writeReplFrame(bw, replFrameRecord, rec.encodePayload())
+}
+
+// flushRepl 将缓冲的帧写出到连接
+func (e *Engine) flushRepl(bw *bufio.Writer, flush func()) error {
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	flush()
+	return nil
+}
+
+// writeReplFrame 写入一帧，写入错误由之后的Flush返回
+func writeReplFrame(bw *bufio.Writer, typ byte, data []byte) {
+	var head [1 + binary.MaxVarintLen64]byte
+	head[0] = typ
+	n := binary.PutUvarint(head[1:], uint64(len(data)))
+	_, _ = bw.Write(head[:1+n])
+	_, _ = bw.Write(data)
+}
+
+// readReplFrame 读取一帧
+func readReplFrame(br *bufio.Reader) (byte, []byte, error) {
+	typ, err := br.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	length, err := binary.ReadUvarint(br)
+	if err != nil {
+		return 0, nil, err
+	}
+	if length > replFrameMax {
+		return 0, nil, fmt.Errorf("replication frame too large: %d", length)
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(br, data); err != nil {
+		return 0, nil, err
+	}
+	return typ, data, nil
+}
+
+func encodeReplHeartbeat(tsMs int64, lsns []uint64) []byte {
+	b := binary.AppendVarint(nil, tsMs)
+	b = binary.AppendUvarint(b, uint64(len(lsns)))
+	for _, lsn := range lsns {
+		b = binary.AppendUvarint(b, lsn)
+	}
+	return b
+}
+
+func decodeReplHeartbeat(data []byte) (int64, []uint64, error) {
+	d := newRdbReader(data)
+	tsMs := d.varint()
+	lsns := make([]uint64, d.count())
+	for i := range lsns {
+		lsns[i] = d.uvarint()
+	}
+	return tsMs, lsns, d.err
+}
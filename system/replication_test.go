@@ -0,0 +1,338 @@
+package system
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fileClick/config"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// addTestFile 保存文件内容和文件信息
+func addTestFile(t *testing.T, id uint64, content string) *FileInfo {
+	t.Helper()
+	sum := sha256.Sum256([]byte(content))
+	info := &FileInfo{
+		Name:   strconv.FormatUint(id, 10) + ".txt",
+		Path:   config.FilePath + strconv.FormatUint(id, 10) + ".txt",
+		Size:   int64(len(content)),
+		Sha256: hex.EncodeToString(sum[:]),
+	}
+	if err := os.WriteFile(info.Path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := AddFile(id, info); err != nil {
+		t.Fatal(err)
+	}
+	return info
+}
+
+// expectReplFrame 读取帧直到typ类型的帧，跳过中间的心跳
+func expectReplFrame(t *testing.T, br *bufio.Reader, typ byte) []byte {
+	t.Helper()
+	for {
+		got, data, err := readReplFrame(br)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got == typ {
+			return data
+		}
+		if got != replFrameHeartbeat {
+			t.Fatalf("frame type = %d, want %d", got, typ)
+		}
+	}
+}
+
+// TestReplicateStream 连接后先收到全部文件信息和全量快照，之后是新文件的信息、投递的记录和心跳
+func TestReplicateStream(t *testing.T) {
+	useTempData(t)
+	e, err := NewEngine()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+	addTestFile(t, 1, "one")
+	for i := 0; i < 2; i++ {
+		if err := e.Click(config.DefaultBoard, 1, HitEvent, "v", false); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = e.Replicate(r.Context(), w, w.(http.Flusher).Flush)
+	}))
+	defer srv.Close()
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	br := bufio.NewReader(resp.Body)
+
+	var files map[uint64]FileInfo
+	if err := json.Unmarshal(expectReplFrame(t, br, replFrameFiles), &files); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := files[1]; !ok || len(files) != 1 {
+		t.Fatalf("files frame = %v", files)
+	}
+	ld, err := decodeRdb("replication", expectReplFrame(t, br, replFrameSnapshot))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counts := rdbCounts(ld.Boards); counts[config.DefaultBoard][1] != 2 {
+		t.Fatalf("snapshot counts = %v, want file 1 clicked twice", counts)
+	}
+	thread := walThreadOf(1)
+	if ld.Lsns[thread] != 2 {
+		t.Fatalf("snapshot lsn = %d, want 2", ld.Lsns[thread])
+	}
+
+	// 快照之后上传的文件先发送文件信息，再发送记录
+	addTestFile(t, 2, "two")
+	if err := e.Click("docs", 2, DownloadEvent, "v", false); err != nil {
+		t.Fatal(err)
+	}
+	data := expectReplFrame(t, br, replFrameFile)
+	var info FileInfo
+	if id, n := binary.Uvarint(data); id != 2 || json.Unmarshal(data[n:], &info) != nil || info.Name != "2.txt" {
+		t.Fatalf("file frame = %q", data)
+	}
+	rec, err := decodeWalPayload(expectReplFrame(t, br, replFrameRecord), walVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.FileId != 2 || rec.Board != "docs" || rec.Type != DownloadEvent {
+		t.Fatalf("record frame = %+v", rec)
+	}
+
+	_, lsns, err := decodeReplHeartbeat(expectReplFrame(t, br, replFrameHeartbeat))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lsns) != config.WalThreads || lsns[thread] < 2 {
+		t.Fatalf("heartbeat lsns = %v", lsns)
+	}
+}
+
+// blockingWriter armed后第一次写入时通知entered并等待release
+type blockingWriter struct {
+	mu      sync.Mutex
+	armed   bool
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (w *blockingWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	armed := w.armed
+	w.armed = false
+	w.mu.Unlock()
+	if armed {
+		close(w.entered)
+		<-w.release
+	}
+	return len(p), nil
+}
+
+// TestReplicateOverflow 订阅者的缓冲区满后不再接收记录，已缓冲的记录写出后断开，并取消订阅
+func TestReplicateOverflow(t *testing.T) {
+	useTempData(t)
+	e, err := NewEngine()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+
+	w := &blockingWriter{entered: make(chan struct{}), release: make(chan struct{})}
+	flushed := make(chan struct{}, 16)
+	done := make(chan error, 1)
+	go func() {
+		done <- e.replicate(context.Background(), w, func() {
+			select {
+			case flushed <- struct{}{}:
+			default:
+			}
+		}, 1)
+	}()
+	<-flushed
+
+	// 复制流阻塞在写入时，一条记录进入缓冲区，之后的记录溢出
+	w.mu.Lock()
+	w.armed = true
+	w.mu.Unlock()
+	click := func() {
+		if err := e.Click(config.DefaultBoard, 1, HitEvent, "", false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	click()
+	<-w.entered
+	click()
+	click()
+	var sub *replSub
+	e.repl.mu.RLock()
+	for s := range e.repl.subs {
+		sub = s
+	}
+	e.repl.mu.RUnlock()
+	if sub == nil || !sub.overflow.Load() {
+		t.Fatal("subscriber not marked overflow")
+	}
+	close(w.release)
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrReplOverflow) {
+			t.Fatalf("replicate = %v, want ErrReplOverflow", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("replicate did not return after overflow")
+	}
+	e.repl.mu.RLock()
+	defer e.repl.mu.RUnlock()
+	if len(e.repl.subs) != 0 {
+		t.Fatalf("%d subscribers left after overflow", len(e.repl.subs))
+	}
+}
+
+// fakePrimary 按连接序号生成复制流的主节点，每次连接模拟主节点重启后的全量同步
+type fakePrimary struct {
+	mu    sync.Mutex
+	conns int
+	blobs map[uint64]string
+	// stream 写入第n次连接的复制流，flush写出已写入的帧，返回后断开连接
+	stream func(n int, bw *bufio.Writer, flush func(), r *http.Request)
+}
+
+func (p *fakePrimary) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/replication/file" {
+		id, _ := strconv.ParseUint(r.URL.Query().Get("id"), 10, 64)
+		content, ok := p.blobs[id]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write([]byte(content))
+		return
+	}
+	p.mu.Lock()
+	p.conns++
+	n := p.conns
+	p.mu.Unlock()
+	bw := bufio.NewWriter(w)
+	p.stream(n, bw, func() {
+		_ = bw.Flush()
+		w.(http.Flusher).Flush()
+	}, r)
+	_ = bw.Flush()
+}
+
+// writeSync 写入全量同步的文件信息和快照
+func writeSync(t *testing.T, bw *bufio.Writer, files map[uint64]FileInfo, snap *RdbSnapshot) {
+	data, err := json.Marshal(files)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	writeReplFrame(bw, replFrameFiles, data)
+	snapData, err := (&Rdb{version: rdb2Version}).encode(snap, time.Now().Unix(), 0)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	writeReplFrame(bw, replFrameSnapshot, snapData)
+}
+
+// TestFollowReconnect 从节点应用全量快照、之后的记录和心跳，主节点重启断开后重新连接并全量同步，
+// 并从主节点拉取缺少的文件内容
+func TestFollowReconnect(t *testing.T) {
+	useTempData(t)
+	sum := sha256.Sum256([]byte("one"))
+	fileInfo := FileInfo{Name: "1.txt", Path: config.FilePath + "1.txt", Size: 3, Sha256: hex.EncodeToString(sum[:])}
+	files := map[uint64]FileInfo{1: fileInfo}
+	thread := walThreadOf(1)
+	lsns := func(lsn uint64) []uint64 {
+		l := make([]uint64, config.WalThreads)
+		l[thread] = lsn
+		return l
+	}
+	p := &fakePrimary{blobs: map[uint64]string{1: "one"}}
+	p.stream = func(n int, bw *bufio.Writer, flush func(), r *http.Request) {
+		switch n {
+		case 1:
+			// 重启前: 快照中点击3次，之后又点击1次
+			writeSync(t, bw, files, &RdbSnapshot{Lsns: lsns(3), Boards: []*RdbBoard{
+				{Name: config.DefaultBoard, Files: []*File{{Id: 1, FileName: "1.txt", Count: 3}}},
+			}})
+			rec := &WalRecord{Op: WalOpClick, Lsn: 4, FileId: 1, Ts: time.Now().Unix(), Board: config.DefaultBoard, Count: 1}
+			writeReplFrame(bw, replFrameRecord, rec.encodePayload())
+			writeReplFrame(bw, replFrameHeartbeat, encodeReplHeartbeat(1234, lsns(4)))
+		default:
+			// 重启后的主节点只恢复到快照中的10次点击
+			writeSync(t, bw, files, &RdbSnapshot{Lsns: lsns(10), Boards: []*RdbBoard{
+				{Name: config.DefaultBoard, Files: []*File{{Id: 1, FileName: "1.txt", Count: 10}}},
+			}})
+			writeReplFrame(bw, replFrameHeartbeat, encodeReplHeartbeat(5678, lsns(10)))
+			flush()
+			<-r.Context().Done()
+		}
+	}
+	srv := httptest.NewServer(p)
+	defer srv.Close()
+
+	e, err := NewEngine()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+	e.Follow(srv.URL, "")
+
+	// 等待第一次同步的记录和心跳生效
+	waitFor(t, func() bool {
+		s := e.Status().Replication
+		top := e.TopN(config.DefaultBoard, 1)
+		return s.Syncs >= 1 && s.LastHeartbeat == 1234 && len(top) == 1 && top[0].Count == 4
+	})
+	if err := e.Click(config.DefaultBoard, 1, HitEvent, "", false); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("click on follower = %v, want ErrReadOnly", err)
+	}
+
+	// 断开后重新连接，以重启后主节点的全量快照为准
+	waitFor(t, func() bool {
+		s := e.Status().Replication
+		top := e.TopN(config.DefaultBoard, 1)
+		return s.Syncs == 2 && s.Connected && s.LastHeartbeat == 5678 && len(top) == 1 && top[0].Count == 10
+	})
+	if s := e.Status().Replication; s.LagRecords != 0 || s.AppliedLsns[thread] != 10 {
+		t.Fatalf("replication status after resync = %+v", s)
+	}
+
+	waitFor(t, func() bool {
+		data, err := os.ReadFile(fileInfo.Path)
+		return err == nil && string(data) == "one"
+	})
+}
+
+// waitFor 等待cond成立，最多5秒
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met before deadline")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
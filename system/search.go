@@ -0,0 +1,157 @@
+package system
+
+import (
+	"container/heap"
+	"math"
+	"sort"
+)
+
+// FileSearch 文件查询条件和分页
+type FileSearch struct {
+	FileQuery
+	Board     string
+	MinClicks uint64 // 只返回排行榜中点击次数不少于MinClicks的文件
+	Sort      string // name、clicks、uploadTs 或 size
+	Offset    int
+	Limit     int
+}
+
+// FileMatch 文件查询结果，Count为文件在排行榜中的点击次数
+type FileMatch struct {
+	*FileEntry
+	Count uint64 `json:"count"`
+}
+
+// FilePage 文件查询的一页结果，Total为匹配的文件总数
+type FilePage struct {
+	Files []*FileMatch `json:"files"`
+	Total int          `json:"total"`
+}
+
+// FileSorts 文件查询支持的排序方式，除名称升序外均为降序，相同时按名称排列
+var FileSorts = map[string]func(a, b *FileMatch) bool{
+	"name":     nil,
+	"clicks":   func(a, b *FileMatch) bool { return a.Count > b.Count },
+	"uploadTs": func(a, b *FileMatch) bool { return a.UploadTs > b.UploadTs },
+	"size":     func(a, b *FileMatch) bool { return a.Size > b.Size },
+}
+
+// searchItem 候选结果，seq为按名称顺序的序号
+type searchItem struct {
+	match *FileMatch
+	seq   int
+}
+
+// searchHeap 保留最靠前的若干个候选，堆顶是其中排在最后的一个
+type searchHeap struct {
+	items []searchItem
+	less  func(a, b *FileMatch) bool
+}
+
+// before 判断a是否排在b之前，排序键相同时按名称顺序
+func (h *searchHeap) before(a, b *searchItem) bool {
+	if h.less(a.match, b.match) {
+		return true
+	}
+	if h.less(b.match, a.match) {
+		return false
+	}
+	return a.seq < b.seq
+}
+
+func (h *searchHeap) Len() int           { return len(h.items) }
+func (h *searchHeap) Less(i, j int) bool { return h.before(&h.items[j], &h.items[i]) }
+func (h *searchHeap) Swap(i, j int)      { h.items[i], h.items[j] = h.items[j], h.items[i] }
+func (h *searchHeap) Push(x any)         { h.items = append(h.items, x.(searchItem)) }
+func (h *searchHeap) Pop() any {
+	item := h.items[len(h.items)-1]
+	h.items = h.items[:len(h.items)-1]
+	return item
+}
+
+// SearchFiles 按名称查询文件并分页
+// 按名称排序时顺序遍历名称索引，只保留当前页；其余排序只保留前offset+limit个候选，调用方需保证不超过 config.FileSearchWindow。
+// 点击次数只在按点击次数排序或过滤时逐个查询，否则只为当前页查询
+func (e *Engine) SearchFiles(s *FileSearch) (*FilePage, error) {
+	var index *SkipList
+	if rb := e.lookup(s.Board); rb != nil {
+		index = rb.index
+	}
+	less := FileSorts[s.Sort]
+	needCounts := index != nil && (s.MinClicks > 0 || s.Sort == "clicks")
+	if needCounts {
+		index.mu.RLock()
+	}
+	countOf := func(id uint64) uint64 {
+		if !needCounts {
+			return 0
+		}
+		if node, ok := index.nodes[id]; ok {
+			return node.count
+		}
+		return 0
+	}
+
+	page := &FilePage{Files: []*FileMatch{}}
+	h := &searchHeap{less: less}
+	window := s.Offset + s.Limit
+	if window < s.Offset {
+		window = math.MaxInt
+	}
+	var scratch FileEntry
+	var probe FileMatch
+	err := ScanFiles(&s.FileQuery, func(id uint64, info *FileInfo) bool {
+		count := countOf(id)
+		if count < s.MinClicks {
+			return true
+		}
+		seq := page.Total
+		page.Total++
+		if less == nil {
+			if seq >= s.Offset && seq < window {
+				page.Files = append(page.Files, &FileMatch{FileEntry: &FileEntry{Id: id, FileInfo: *info}, Count: count})
+			}
+			return true
+		}
+		// 先用临时结果比较，进入候选时才分配
+		scratch = FileEntry{Id: id, FileInfo: *info}
+		probe = FileMatch{FileEntry: &scratch, Count: count}
+		item := searchItem{match: &probe, seq: seq}
+		if h.Len() == window && !h.before(&item, &h.items[0]) {
+			return true
+		}
+		entry := scratch
+		item.match = &FileMatch{FileEntry: &entry, Count: count}
+		if h.Len() < window {
+			heap.Push(h, item)
+		} else {
+			h.items[0] = item
+			heap.Fix(h, 0)
+		}
+		return true
+	})
+	if needCounts {
+		index.mu.RUnlock()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if less != nil {
+		sort.Slice(h.items, func(i, j int) bool { return h.before(&h.items[i], &h.items[j]) })
+		for i := s.Offset; i < len(h.items); i++ {
+			page.Files = append(page.Files, h.items[i].match)
+		}
+	}
+	if !needCounts && index != nil {
+		files := make([]*File, len(page.Files))
+		for i, m := range page.Files {
+			files[i] = &File{Id: m.Id}
+		}
+		index.fillCounts(files)
+		for i, m := range page.Files {
+			m.Count = files[i].Count
+		}
+	}
+	return page, nil
+}
@@ -0,0 +1,131 @@
+package system
+
+import (
+	"fileClick/config"
+	"math/rand"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// TestNameIndexOrder 增删改之后名称索引的遍历顺序与按 (小写名称, id) 排序的结果一致
+func TestNameIndexOrder(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	x := newNameIndex(map[uint64]FileInfo{})
+	names := make(map[uint64]string)
+	for i := 0; i < 2000; i++ {
+		id := uint64(r.Intn(300))
+		if r.Intn(4) == 0 {
+			x.remove(id)
+			delete(names, id)
+			continue
+		}
+		name := string(rune('a'+r.Intn(3))) + string(rune('A'+r.Intn(3))) + ".txt"
+		x.put(id, name)
+		names[id] = strings.ToLower(name)
+	}
+
+	var want []uint64
+	for id := range names {
+		want = append(want, id)
+	}
+	sort.Slice(want, func(i, j int) bool { return nameLess(names[want[i]], want[i], names[want[j]], want[j]) })
+	var got []uint64
+	x.each(&FileQuery{}, func(id uint64) bool {
+		got = append(got, id)
+		return true
+	})
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("index order = %v, want %v", got, want)
+	}
+}
+
+// TestSearchFiles 按名称、扩展名和点击次数过滤，按各种方式排序并分页
+func TestSearchFiles(t *testing.T) {
+	useTempData(t)
+	e, err := NewEngine()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+
+	files := []struct {
+		id       uint64
+		name     string
+		size     int64
+		uploadTs int64
+		clicks   uint64
+	}{
+		{1, "Report.pdf", 300, 10, 5},
+		{2, "report-draft.txt", 100, 40, 0},
+		{3, "notes.TXT", 200, 30, 2},
+		{4, "annual report.pdf", 400, 20, 2},
+		{5, "image.png", 50, 50, 9},
+	}
+	var clicks []*BatchClick
+	for _, f := range files {
+		if err := AddFile(f.id, &FileInfo{Name: f.name, Size: f.size, UploadTs: f.uploadTs}); err != nil {
+			t.Fatal(err)
+		}
+		if f.clicks > 0 {
+			clicks = append(clicks, &BatchClick{Id: f.id, Count: f.clicks})
+		}
+	}
+	if err := e.ClickBatch(config.DefaultBoard, clicks); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool {
+		page, _ := e.Page(config.DefaultBoard, 0, 10)
+		return len(page) == len(clicks)
+	})
+
+	tests := []struct {
+		name      string
+		search    FileSearch
+		wantIds   []uint64
+		wantTotal int
+	}{
+		{name: "全部按名称", search: FileSearch{}, wantIds: []uint64{4, 5, 3, 2, 1}, wantTotal: 5},
+		{name: "子串不区分大小写", search: FileSearch{FileQuery: FileQuery{Q: "REPORT"}}, wantIds: []uint64{4, 2, 1}, wantTotal: 3},
+		{name: "前缀", search: FileSearch{FileQuery: FileQuery{Q: "rep", Prefix: true}}, wantIds: []uint64{2, 1}, wantTotal: 2},
+		{name: "扩展名", search: FileSearch{FileQuery: FileQuery{Ext: "txt"}}, wantIds: []uint64{3, 2}, wantTotal: 2},
+		{name: "最少点击次数", search: FileSearch{MinClicks: 3}, wantIds: []uint64{5, 1}, wantTotal: 2},
+		{name: "按名称分页", search: FileSearch{Offset: 1, Limit: 2}, wantIds: []uint64{5, 3}, wantTotal: 5},
+		{name: "分页超出范围", search: FileSearch{Offset: 5}, wantIds: []uint64{}, wantTotal: 5},
+		{name: "按点击次数，相同时按名称", search: FileSearch{Sort: "clicks"}, wantIds: []uint64{5, 1, 4, 3, 2}, wantTotal: 5},
+		{name: "按点击次数分页", search: FileSearch{Sort: "clicks", Offset: 2, Limit: 2}, wantIds: []uint64{4, 3}, wantTotal: 5},
+		{name: "按上传时间", search: FileSearch{Sort: "uploadTs", Limit: 3}, wantIds: []uint64{5, 2, 3}, wantTotal: 5},
+		{name: "按大小并过滤", search: FileSearch{FileQuery: FileQuery{Ext: ".pdf"}, Sort: "size"}, wantIds: []uint64{4, 1}, wantTotal: 2},
+		{name: "不存在的排行榜", search: FileSearch{Board: "missing", MinClicks: 1}, wantIds: []uint64{}, wantTotal: 0},
+	}
+	counts := make(map[uint64]uint64)
+	for _, f := range files {
+		counts[f.id] = f.clicks
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := tt.search
+			if s.Sort == "" {
+				s.Sort = "name"
+			}
+			if s.Limit == 0 {
+				s.Limit = 10
+			}
+			page, err := e.SearchFiles(&s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids := []uint64{}
+			for _, m := range page.Files {
+				ids = append(ids, m.Id)
+				if s.Board == "" && m.Count != counts[m.Id] {
+					t.Fatalf("file %d count = %d, want %d", m.Id, m.Count, counts[m.Id])
+				}
+			}
+			if !reflect.DeepEqual(ids, tt.wantIds) || page.Total != tt.wantTotal {
+				t.Fatalf("search = %v total %d, want %v total %d", ids, page.Total, tt.wantIds, tt.wantTotal)
+			}
+		})
+	}
+}
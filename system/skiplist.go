@@ -0,0 +1,367 @@
+package system
+
+import (
+	"math/rand"
+	"sync"
+)
+
+const (
+	skipListMaxLevel = 32
+	skipListP        = 0.25
+)
+
+// skipListLevel 跳表节点的一层索引，span为到forward节点跨越的元素个数
+type skipListLevel struct {
+	forward *skipListNode
+	span    int
+}
+
+// skipListNode 跳表节点，保存排序键的拷贝，避免与排行榜共享的File被原地修改后失序
+type skipListNode struct {
+	id       uint64
+	count    uint64
+	fileName string
+	backward *skipListNode
+	level    []skipListLevel
+}
+
+// SkipList 带跨度的跳表（顺序统计跳表），按count降序、ID升序排列，支持O(logN)查询排名
+type SkipList struct {
+	mu     sync.RWMutex
+	header *skipListNode
+	tail   *skipListNode
+	length int
+	level  int
+	nodes  map[uint64]*skipListNode
+	rnd    *rand.Rand
+}
+
+// RankResult 文件排名查询结果
+type RankResult struct {
+	Rank  int     `json:"rank"`  // 从1开始的排名
+	File  *File   `json:"file"`  // 文件本身
+	Above []*File `json:"above"` // 排名在前的k个文件，按排名升序
+	Below []*File `json:"below"` // 排名在后的k个文件，按排名升序
+}
+
+// RankPage 排行榜分页查询结果
+type RankPage struct {
+	Files      []*File `json:"files"`
+	NextCursor string  `json:"nextCursor"` // 下一页游标，没有下一页时为空
+	Total      int     `json:"total"`      // 文件总数
+}
+
+// NewSkipList 创建跳表
+func NewSkipList() *SkipList {
+	return &SkipList{
+		header: &skipListNode{level: make([]skipListLevel, skipListMaxLevel)},
+		level:  1,
+		nodes:  make(map[uint64]*skipListNode),
+		rnd:    rand.New(rand.NewSource(rand.Int63())),
+	}
+}
+
+// less 判断 (count, id) 是否排在node之前
+func (n *skipListNode) less(count, id uint64) bool {
+	return n.count > count || (n.count == count && n.id < id)
+}
+
+func (sl *SkipList) randomLevel() int {
+	level := 1
+	for level < skipListMaxLevel && sl.rnd.Float64() < skipListP {
+		level++
+	}
+	return level
+}
+
+// update 同步文件的最新点击数，文件不存在时插入
+func (sl *SkipList) update(file *File) {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+
+	if node, exists := sl.nodes[file.Id]; exists {
+		sl.updateLocked(node, file.Count)
+		return
+	}
+	sl.insertLocked(file.Id, file.FileName, file.Count)
+}
+
+// Incr 增加已存在文件的分值并更新位置，文件不存在时返回nil
+func (sl *SkipList) Incr(id uint64, delta uint64) *File {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+
+	node, exists := sl.nodes[id]
+	if !exists {
+		return nil
+	}
+	return sl.updateLocked(node, addSat(node.count, delta)).file()
+}
+
+// Insert 按点击数插入新文件，文件已存在时忽略
+func (sl *SkipList) Insert(file *File) {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+
+	if _, exists := sl.nodes[file.Id]; exists {
+		return
+	}
+	sl.insertLocked(file.Id, file.FileName, file.Count)
+}
+
+// Delete 移除文件
+func (sl *SkipList) Delete(id uint64) {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+
+	if node, exists := sl.nodes[id]; exists {
+		sl.removeLocked(node)
+	}
+}
+
+// updateLocked 更新节点的点击数，点击数增加后仍排在前驱之后时原地修改，否则重新插入
+func (sl *SkipList) updateLocked(node *skipListNode, count uint64) *skipListNode {
+	if count >= node.count && (node.backward == nil || node.backward.less(count, node.id)) {
+		node.count = count
+		return node
+	}
+	sl.removeLocked(node)
+	return sl.insertLocked(node.id, node.fileName, count)
+}
+
+func (sl *SkipList) insertLocked(id uint64, fileName string, count uint64) *skipListNode {
+	var update [skipListMaxLevel]*skipListNode
+	var rank [skipListMaxLevel]int
+
+	x := sl.header
+	for i := sl.level - 1; i >= 0; i-- {
+		if i < sl.level-1 {
+			rank[i] = rank[i+1]
+		}
+		for x.level[i].forward != nil && x.level[i].forward.less(count, id) {
+			rank[i] += x.level[i].span
+			x = x.level[i].forward
+		}
+		update[i] = x
+	}
+
+	level := sl.randomLevel()
+	if level > sl.level {
+		for i := sl.level; i < level; i++ {
+			rank[i] = 0
+			update[i] = sl.header
+			update[i].level[i].span = sl.length
+		}
+		sl.level = level
+	}
+
+	x = &skipListNode{id: id, count: count, fileName: fileName, level: make([]skipListLevel, level)}
+	for i := 0; i < level; i++ {
+		x.level[i].forward = update[i].level[i].forward
+		update[i].level[i].forward = x
+		x.level[i].span = update[i].level[i].span - (rank[0] - rank[i])
+		update[i].level[i].span = rank[0] - rank[i] + 1
+	}
+	// 未触及的高层索引跨度加一
+	for i := level; i < sl.level; i++ {
+		update[i].level[i].span++
+	}
+
+	if update[0] != sl.header {
+		x.backward = update[0]
+	}
+	if x.level[0].forward != nil {
+		x.level[0].forward.backward = x
+	} else {
+		sl.tail = x
+	}
+	sl.length++
+	sl.nodes[id] = x
+	return x
+}
+
+func (sl *SkipList) removeLocked(node *skipListNode) {
+	var update [skipListMaxLevel]*skipListNode
+
+	x := sl.header
+	for i := sl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && x.level[i].forward.less(node.count, node.id) {
+			x = x.level[i].forward
+		}
+		update[i] = x
+	}
+
+	for i := 0; i < sl.level; i++ {
+		if update[i].level[i].forward == node {
+			update[i].level[i].span += node.level[i].span - 1
+			update[i].level[i].forward = node.level[i].forward
+		} else {
+			update[i].level[i].span--
+		}
+	}
+	if node.level[0].forward != nil {
+		node.level[0].forward.backward = node.backward
+	} else {
+		sl.tail = node.backward
+	}
+	for sl.level > 1 && sl.header.level[sl.level-1].forward == nil {
+		sl.level--
+	}
+	sl.length--
+	delete(sl.nodes, node.id)
+}
+
+// rankLocked 计算节点从1开始的排名
+func (sl *SkipList) rankLocked(node *skipListNode) int {
+	rank := 0
+	x := sl.header
+	for i := sl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil &&
+			(x.level[i].forward == node || x.level[i].forward.less(node.count, node.id)) {
+			rank += x.level[i].span
+			x = x.level[i].forward
+		}
+		if x == node {
+			return rank
+		}
+	}
+	return 0
+}
+
+// nodeByRankLocked 获取指定排名（从1开始）的节点
+func (sl *SkipList) nodeByRankLocked(rank int) *skipListNode {
+	traversed := 0
+	x := sl.header
+	for i := sl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && traversed+x.level[i].span <= rank {
+			traversed += x.level[i].span
+			x = x.level[i].forward
+		}
+		if traversed == rank {
+			return x
+		}
+	}
+	return nil
+}
+
+// rangeLocked 获取排名在 [start, end] 之间的文件
+func (sl *SkipList) rangeLocked(start, end int) []*File {
+	if start < 1 {
+		start = 1
+	}
+	if end > sl.length {
+		end = sl.length
+	}
+	if start > end {
+		return []*File{}
+	}
+	result := make([]*File, 0, end-start+1)
+	x := sl.nodeByRankLocked(start)
+	for i := start; i <= end && x != nil; i++ {
+		result = append(result, x.file())
+		x = x.level[0].forward
+	}
+	return result
+}
+
+func (n *skipListNode) file() *File {
+	return &File{Id: n.id, FileName: n.fileName, Count: n.count}
+}
+
+// Around 查询文件的排名及其前后各k个文件，k超过文件总数时按文件总数处理
+func (sl *SkipList) Around(id uint64, k int) (*RankResult, bool) {
+	sl.mu.RLock()
+	defer sl.mu.RUnlock()
+
+	node, exists := sl.nodes[id]
+	if !exists {
+		return nil, false
+	}
+	k = max(0, min(k, sl.length))
+	rank := sl.rankLocked(node)
+	return &RankResult{
+		Rank:  rank,
+		File:  node.file(),
+		Above: sl.rangeLocked(rank-k, rank-1),
+		Below: sl.rangeLocked(rank+1, rank+k),
+	}, true
+}
+
+// Page 按偏移量分页获取文件，同时返回文件总数
+func (sl *SkipList) Page(offset, limit int) ([]*File, int) {
+	sl.mu.RLock()
+	defer sl.mu.RUnlock()
+	if offset >= sl.length {
+		return []*File{}, sl.length
+	}
+	return sl.rangeLocked(offset+1, offset+min(limit, sl.length-offset)), sl.length
+}
+
+// PageAfter 获取排在 (count, id) 之后的limit个文件，同时返回文件总数
+// 游标只依赖排序键，点击持续到达时翻页也不会重复或跳过未变化的文件
+func (sl *SkipList) PageAfter(count, id uint64, limit int) ([]*File, int) {
+	sl.mu.RLock()
+	defer sl.mu.RUnlock()
+
+	x := sl.header
+	for i := sl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && !x.level[i].forward.after(count, id) {
+			x = x.level[i].forward
+		}
+	}
+	result := make([]*File, 0, limit)
+	for x = x.level[0].forward; x != nil && len(result) < limit; x = x.level[0].forward {
+		result = append(result, x.file())
+	}
+	return result, sl.length
+}
+
+// after 判断node是否排在 (count, id) 之后
+func (n *skipListNode) after(count, id uint64) bool {
+	return n.count < count || (n.count == count && n.id > id)
+}
+
+// TopN 获取点击次数前N的文件
+func (sl *SkipList) TopN(n int) []*File {
+	sl.mu.RLock()
+	defer sl.mu.RUnlock()
+	return sl.rangeLocked(1, n)
+}
+
+// TopAll 获取所有文件，按点击次数降序排列
+func (sl *SkipList) TopAll() []*File {
+	sl.mu.RLock()
+	defer sl.mu.RUnlock()
+	return sl.rangeLocked(1, sl.length)
+}
+
+// fillCounts 填充文件的点击次数
+func (sl *SkipList) fillCounts(files []*File) {
+	sl.mu.RLock()
+	defer sl.mu.RUnlock()
+	for _, f := range files {
+		if node, exists := sl.nodes[f.Id]; exists {
+			f.Count = node.count
+		}
+	}
+}
+
+// lookup 获取ids中仍在跳表里的文件
+func (sl *SkipList) lookup(ids map[uint64]struct{}) []*File {
+	sl.mu.RLock()
+	defer sl.mu.RUnlock()
+	files := make([]*File, 0, len(ids))
+	for id := range ids {
+		if node, exists := sl.nodes[id]; exists {
+			files = append(files, node.file())
+		}
+	}
+	return files
+}
+
+// Len 获取跳表中的文件数
+func (sl *SkipList) Len() int {
+	sl.mu.RLock()
+	defer sl.mu.RUnlock()
+	return sl.length
+}
@@ -0,0 +1,177 @@
+package system
+
+import (
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// newTestSkipList 按counts创建跳表，排序为 6(9) 1(5) 2(3) 3(3) 4(3) 5(1)
+func newTestSkipList() *SkipList {
+	sl := NewSkipList()
+	counts := map[uint64]uint64{1: 5, 2: 3, 3: 3, 4: 3, 5: 1, 6: 9}
+	for id, count := range counts {
+		sl.Insert(&File{Id: id, Count: count})
+	}
+	return sl
+}
+
+func fileIds(files []*File) []uint64 {
+	ids := []uint64{}
+	for _, f := range files {
+		ids = append(ids, f.Id)
+	}
+	return ids
+}
+
+// TestSkipListAround 查询排名及前后各k个文件，同分时按ID排名，首尾处截断
+func TestSkipListAround(t *testing.T) {
+	tests := []struct {
+		name      string
+		id        uint64
+		k         int
+		incr      map[uint64]uint64 // 查询前增加的点击数
+		wantRank  int
+		wantAbove []uint64
+		wantBelow []uint64
+	}{
+		{name: "第一名", id: 6, k: 2, wantRank: 1, wantAbove: []uint64{}, wantBelow: []uint64{1, 2}},
+		{name: "同分文件按ID排名", id: 3, k: 1, wantRank: 4, wantAbove: []uint64{2}, wantBelow: []uint64{4}},
+		{name: "最后一名且k超过总数", id: 5, k: 100, wantRank: 6, wantAbove: []uint64{6, 1, 2, 3, 4}, wantBelow: []uint64{}},
+		{name: "k为0", id: 1, k: 0, wantRank: 2, wantAbove: []uint64{}, wantBelow: []uint64{}},
+		{name: "追平后排在ID更小的文件之后", id: 3, k: 1, incr: map[uint64]uint64{3: 2}, wantRank: 3, wantAbove: []uint64{1}, wantBelow: []uint64{2}},
+		{name: "超过后排名上升", id: 5, k: 1, incr: map[uint64]uint64{5: 9}, wantRank: 1, wantAbove: []uint64{}, wantBelow: []uint64{6}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sl := newTestSkipList()
+			for id, delta := range tt.incr {
+				sl.Incr(id, delta)
+			}
+			res, ok := sl.Around(tt.id, tt.k)
+			if !ok {
+				t.Fatalf("file %d not found", tt.id)
+			}
+			if res.Rank != tt.wantRank || res.File.Id != tt.id {
+				t.Fatalf("rank = %d file %d, want %d", res.Rank, res.File.Id, tt.wantRank)
+			}
+			if above, below := fileIds(res.Above), fileIds(res.Below); !reflect.DeepEqual(above, tt.wantAbove) || !reflect.DeepEqual(below, tt.wantBelow) {
+				t.Fatalf("around = %v %v, want %v %v", above, below, tt.wantAbove, tt.wantBelow)
+			}
+		})
+	}
+	if _, ok := newTestSkipList().Around(7, 1); ok {
+		t.Fatal("missing file found")
+	}
+}
+
+// TestSkipListRankRandom 随机插入、增加和删除之后，每个文件的排名与排序结果一致
+func TestSkipListRankRandom(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	sl := NewSkipList()
+	counts := make(map[uint64]uint64)
+	for i := 0; i < 5000; i++ {
+		id := uint64(r.Intn(200))
+		switch _, exists := counts[id]; {
+		case !exists:
+			counts[id] = uint64(r.Intn(5))
+			sl.Insert(&File{Id: id, Count: counts[id]})
+		case r.Intn(5) == 0:
+			delete(counts, id)
+			sl.Delete(id)
+		default:
+			delta := uint64(r.Intn(3))
+			counts[id] += delta
+			sl.Incr(id, delta)
+		}
+	}
+
+	var want []uint64
+	for id := range counts {
+		want = append(want, id)
+	}
+	sort.Slice(want, func(i, j int) bool {
+		a, b := want[i], want[j]
+		return counts[a] > counts[b] || (counts[a] == counts[b] && a < b)
+	})
+	if got := fileIds(sl.TopAll()); !reflect.DeepEqual(got, want) {
+		t.Fatalf("order = %v, want %v", got, want)
+	}
+	for i, id := range want {
+		if res, ok := sl.Around(id, 0); !ok || res.Rank != i+1 || res.File.Count != counts[id] {
+			t.Fatalf("file %d: around = %+v, want rank %d", id, res, i+1)
+		}
+	}
+}
+
+// TestSkipListPage 按偏移量分页，偏移量超出总数时返回空页
+func TestSkipListPage(t *testing.T) {
+	tests := []struct {
+		name   string
+		offset int
+		limit  int
+		want   []uint64
+	}{
+		{name: "第一页", offset: 0, limit: 2, want: []uint64{6, 1}},
+		{name: "跨过同分文件", offset: 2, limit: 3, want: []uint64{2, 3, 4}},
+		{name: "最后一页不足limit", offset: 4, limit: 10, want: []uint64{4, 5}},
+		{name: "偏移量等于总数", offset: 6, limit: 2, want: []uint64{}},
+		{name: "偏移量超出总数", offset: 100, limit: 2, want: []uint64{}},
+	}
+	sl := newTestSkipList()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			files, total := sl.Page(tt.offset, tt.limit)
+			if got := fileIds(files); !reflect.DeepEqual(got, tt.want) || total != 6 {
+				t.Fatalf("page = %v total %d, want %v total 6", got, total, tt.want)
+			}
+		})
+	}
+}
+
+// TestSkipListPageAfter 游标翻页不重复也不遗漏，翻页期间其他文件的点击数变化不影响未变化的文件
+func TestSkipListPageAfter(t *testing.T) {
+	tests := []struct {
+		name  string
+		limit int
+		// between 在读取第一页之后修改点击数
+		between map[uint64]uint64
+		want    []uint64
+	}{
+		{name: "逐个翻页", limit: 1, want: []uint64{6, 1, 2, 3, 4, 5}},
+		{name: "每页两个", limit: 2, want: []uint64{6, 1, 2, 3, 4, 5}},
+		{name: "每页超过总数", limit: 10, want: []uint64{6, 1, 2, 3, 4, 5}},
+		// 4追平6后排到游标之前，不再出现；其余文件照常返回
+		{name: "未读取的文件排到游标之前", limit: 2, between: map[uint64]uint64{4: 9}, want: []uint64{6, 1, 2, 3, 5}},
+		// 6降到末尾之后再次出现
+		{name: "已读取的文件排到后面", limit: 2, between: map[uint64]uint64{6: 0}, want: []uint64{6, 1, 2, 3, 4, 5, 6}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sl := newTestSkipList()
+			var got []uint64
+			count, id := ^uint64(0), uint64(0)
+			for page := 0; page < 10; page++ {
+				files, total := sl.PageAfter(count, id, tt.limit)
+				if total != sl.Len() {
+					t.Fatalf("total = %d, want %d", total, sl.Len())
+				}
+				if len(files) == 0 {
+					break
+				}
+				got = append(got, fileIds(files)...)
+				last := files[len(files)-1]
+				count, id = last.Count, last.Id
+				if page == 0 {
+					for fid, c := range tt.between {
+						sl.update(&File{Id: fid, Count: c})
+					}
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("pages = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
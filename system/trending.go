@@ -0,0 +1,157 @@
+package system
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// trendingMinScore 快照时丢弃衰减到该值以下的分数
+const trendingMinScore = 1e-6
+
+// TrendingFile 热度排行榜条目
+type TrendingFile struct {
+	Id       uint64  `json:"id"`
+	FileName string  `json:"fileName"`
+	Score    float64 `json:"score"`
+}
+
+// TrendingEntry 单个文件的衰减分数，用于快照持久化
+type TrendingEntry struct {
+	Id     uint64
+	Score  float64 // LastTs 时刻的分数
+	LastTs int64
+}
+
+// trendingScore 单个文件的衰减分数
+type trendingScore struct {
+	fileName string
+	score    float64 // lastTs 时刻的分数
+	lastTs   int64
+}
+
+// TrendingBoard 指数衰减热度排行榜，每次点击的权重按半衰期减半，由RankBoard工作线程写入
+type TrendingBoard struct {
+	mu       sync.RWMutex
+	halfLife float64 // 半衰期（秒）
+	scores   map[uint64]*trendingScore
+}
+
+// NewTrendingBoard 创建热度排行榜
+func NewTrendingBoard(halfLife time.Duration) *TrendingBoard {
+	return &TrendingBoard{
+		halfLife: halfLife.Seconds(),
+		scores:   make(map[uint64]*trendingScore),
+	}
+}
+
+// decay 计算经过dt秒后的衰减系数
+func (tb *TrendingBoard) decay(dt int64) float64 {
+	return math.Exp2(-float64(dt) / tb.halfLife)
+}
+
+// hit 按事件时间戳累加衰减分数，weight为事件分值
+func (tb *TrendingBoard) hit(file *File, ts int64, weight uint64) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	w := float64(weight)
+	s, exists := tb.scores[file.Id]
+	if !exists {
+		tb.scores[file.Id] = &trendingScore{fileName: file.FileName, score: w, lastTs: ts}
+		return
+	}
+	if ts >= s.lastTs {
+		s.score = s.score*tb.decay(ts-s.lastTs) + w
+		s.lastTs = ts
+	} else {
+		// WAL回放时点击可能乱序到达，折算到lastTs时刻
+		s.score += w * tb.decay(s.lastTs-ts)
+	}
+}
+
+// delete 移除文件的热度分数
+func (tb *TrendingBoard) delete(id uint64) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	delete(tb.scores, id)
+}
+
+// current 计算分数在now时刻的值
+func (tb *TrendingBoard) current(s *trendingScore, now int64) float64 {
+	if now <= s.lastTs {
+		return s.score
+	}
+	return s.score * tb.decay(now-s.lastTs)
+}
+
+// TopN 获取当前热度前N的文件
+func (tb *TrendingBoard) TopN(n int) []*TrendingFile {
+	now := time.Now().Unix()
+
+	tb.mu.RLock()
+	result := make([]*TrendingFile, 0, len(tb.scores))
+	for id, s := range tb.scores {
+		result = append(result, &TrendingFile{Id: id, FileName: s.fileName, Score: tb.current(s, now)})
+	}
+	tb.mu.RUnlock()
+
+	// 按score降序排序，score相同时按ID升序排序
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Score != result[j].Score {
+			return result[i].Score > result[j].Score
+		}
+		return result[i].Id < result[j].Id
+	})
+	if len(result) > n {
+		result = result[:n]
+	}
+	return result
+}
+
+// snapshot 丢弃已衰减殆尽的分数并拷贝分数，ids不为nil时只拷贝其中的文件
+func (tb *TrendingBoard) snapshot(ids map[uint64]struct{}) []*TrendingEntry {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	now := time.Now().Unix()
+	var entries []*TrendingEntry
+	visit := func(id uint64, s *trendingScore) {
+		if tb.current(s, now) < trendingMinScore {
+			delete(tb.scores, id)
+			return
+		}
+		entries = append(entries, &TrendingEntry{Id: id, Score: s.score, LastTs: s.lastTs})
+	}
+	if ids == nil {
+		for id, s := range tb.scores {
+			visit(id, s)
+		}
+		return entries
+	}
+	for id := range ids {
+		if s, exists := tb.scores[id]; exists {
+			visit(id, s)
+		}
+	}
+	return entries
+}
+
+// load 从快照恢复衰减分数，fileMap用于补全文件名
+func (tb *TrendingBoard) load(entries []*TrendingEntry, fileMap map[uint64]*File) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	for _, entry := range entries {
+		file, exists := fileMap[entry.Id]
+		if !exists {
+			continue
+		}
+		tb.scores[entry.Id] = &trendingScore{
+			fileName: file.FileName,
+			score:    entry.Score,
+			lastTs:   entry.LastTs,
+		}
+	}
+}
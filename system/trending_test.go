@@ -0,0 +1,70 @@
+package system
+
+import (
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// TestTrendingDecay 较早的点击按半衰期衰减，热度排序由衰减后的分数决定，乱序到达的点击与顺序到达的结果一致
+func TestTrendingDecay(t *testing.T) {
+	const halfLife = int64(3600)
+	now := time.Now().Unix()
+	type hit struct {
+		id     uint64
+		ago    int64
+		weight uint64
+	}
+	tests := []struct {
+		name   string
+		hits   []hit
+		want   []uint64
+		scores map[uint64]float64 // 期望的当前分数
+	}{
+		{
+			name:   "较早的点击衰减后被新点击超过",
+			hits:   []hit{{1, 2 * halfLife, 3}, {2, 0, 1}},
+			want:   []uint64{2, 1},
+			scores: map[uint64]float64{1: 0.75, 2: 1},
+		},
+		{
+			name:   "多次点击按各自的时间衰减后累加",
+			hits:   []hit{{1, halfLife, 2}, {1, 0, 1}, {2, 0, 1}},
+			want:   []uint64{1, 2},
+			scores: map[uint64]float64{1: 2, 2: 1},
+		},
+		{
+			name:   "乱序到达",
+			hits:   []hit{{1, 0, 1}, {1, halfLife, 2}, {2, 0, 2}},
+			want:   []uint64{1, 2},
+			scores: map[uint64]float64{1: 2, 2: 2},
+		},
+		{
+			name:   "分数相同时按ID升序",
+			hits:   []hit{{3, 0, 1}, {2, 0, 1}},
+			want:   []uint64{2, 3},
+			scores: map[uint64]float64{2: 1, 3: 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tb := NewTrendingBoard(time.Duration(halfLife) * time.Second)
+			for _, h := range tt.hits {
+				tb.hit(&File{Id: h.id}, now-h.ago, h.weight)
+			}
+			files := tb.TopN(10)
+			var ids []uint64
+			for _, f := range files {
+				ids = append(ids, f.Id)
+				// 查询时刻可能比now晚1秒
+				if want := tt.scores[f.Id]; math.Abs(f.Score-want) > want*0.001 {
+					t.Fatalf("file %d score = %v, want %v", f.Id, f.Score, want)
+				}
+			}
+			if !reflect.DeepEqual(ids, tt.want) {
+				t.Fatalf("order = %v, want %v", ids, tt.want)
+			}
+		})
+	}
+}
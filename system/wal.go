@@ -7,20 +7,145 @@ import (
 	"fileClick/config"
 	"fmt"
 	"hash/crc32"
-	"io"
 	"os"
 	"path/filepath"
-	"sort"
-	"strconv"
-	"strings"
 	"sync"
-	"sync/atomic"
+	"time"
 )
 
+// WalOp WAL记录类型
+type WalOp byte
+
+const (
+	WalOpClick    WalOp = 1 // 计分事件
+	WalOpDelete   WalOp = 2 // 删除文件，作用于所有排行榜
+	WalOpSetCount WalOp = 3 // 预留：管理员直接设置分值
+)
+
+// String 返回记录类型名称
+func (op WalOp) String() string {
+	switch op {
+	case WalOpClick:
+		return "click"
+	case WalOpDelete:
+		return "delete"
+	case WalOpSetCount:
+		return "setCount"
+	}
+	return "unknown"
+}
+
 // WalRecord 表示一条WAL记录
 type WalRecord struct {
-	FileId uint64
-	Ts     int64
+	Op      WalOp
+	Lsn     uint64 // 日志序列号，同一WAL线程内单调递增，版本3之前的记录为0
+	FileId  uint64
+	Ts      int64
+	Board   string    // 排行榜命名空间，默认排行榜为空
+	Visitor uint64    // 访客哈希，0表示未知访客
+	Type    EventType // 事件类型，默认为点击
+	Count   uint64    // 事件次数，默认为1
+}
+
+// WAL段文件头: magic(4) + version(2) + baseLsn(8) + keyId(4)，版本1的段文件没有文件头，版本2没有baseLsn，版本3没有keyId
+// keyId不为0时段文件中每条记录的负载都经过AES-GCM加密，版本5起以段文件头和记录偏移作为附加认证数据，
+// 加密记录被移到其他段文件或其他偏移时解密失败
+const (
+	walMagic        = "FCWL"
+	walVersion      = 5
+	walHeaderSizeV2 = 6
+	walHeaderSizeV3 = 14
+	walHeaderSize   = 18
+)
+
+// WAL记录的扩展字段，位于 fileId + ts 之后: [tag(1) | len(1) | data(len)]
+const (
+	walFieldBoard   byte = 1 // 排行榜命名空间
+	walFieldVisitor byte = 2 // 访客哈希
+	walFieldType    byte = 3 // 事件类型
+	walFieldCount   byte = 4 // 事件次数
+)
+
+// walMaxPayload 单条WAL记录负载的最大长度
+const walMaxPayload = 1 << 12
+
+// ErrWalClosed WAL已关闭，不再接受写入
+var ErrWalClosed = errors.New("wal closed")
+
+// encodePayload 编码记录负载 op(1) + lsn(8) + fileId(8) + ts(8) + 扩展字段
+func (rec *WalRecord) encodePayload() []byte {
+	payload := make([]byte, 25, 25+2+len(rec.Board)+2+8+2+1+2+8)
+	payload[0] = byte(rec.Op)
+	binary.LittleEndian.PutUint64(payload[1:9], rec.Lsn)
+	binary.LittleEndian.PutUint64(payload[9:17], rec.FileId)
+	binary.LittleEndian.PutUint64(payload[17:25], uint64(rec.Ts))
+	// 默认排行榜不写入命名空间，与旧格式保持一致
+	if rec.Board != "" && rec.Board != config.DefaultBoard {
+		payload = append(payload, walFieldBoard, byte(len(rec.Board)))
+		payload = append(payload, rec.Board...)
+	}
+	if rec.Visitor != 0 {
+		payload = append(payload, walFieldVisitor, 8)
+		payload = binary.LittleEndian.AppendUint64(payload, rec.Visitor)
+	}
+	// 点击事件不写入类型，与旧格式保持一致
+	if rec.Type != HitEvent {
+		payload = append(payload, walFieldType, 1, byte(rec.Type))
+	}
+	// 单次事件不写入次数
+	if rec.Count > 1 {
+		payload = append(payload, walFieldCount, 8)
+		payload = binary.LittleEndian.AppendUint64(payload, rec.Count)
+	}
+	return payload
+}
+
+// decodeWalPayload 按段文件版本解码记录负载，版本1的记录都是点击，未知的扩展字段直接跳过
+func decodeWalPayload(data []byte, version uint16) (*WalRecord, error) {
+	rec := &WalRecord{Op: WalOpClick, Count: 1}
+	if version >= 2 {
+		if len(data) < 1 {
+			return nil, fmt.Errorf("wal payload too short: %d", len(data))
+		}
+		rec.Op = WalOp(data[0])
+		data = data[1:]
+	}
+	if version >= 3 {
+		if len(data) < 8 {
+			return nil, fmt.Errorf("wal payload too short: %d", len(data))
+		}
+		rec.Lsn = binary.LittleEndian.Uint64(data[0:8])
+		data = data[8:]
+	}
+	if len(data) < 16 {
+		return nil, fmt.Errorf("wal payload too short: %d", len(data))
+	}
+	rec.FileId = binary.LittleEndian.Uint64(data[0:8])
+	rec.Ts = int64(binary.LittleEndian.Uint64(data[8:16]))
+	for rest := data[16:]; len(rest) > 0; {
+		if len(rest) < 2 || len(rest) < 2+int(rest[1]) {
+			return nil, fmt.Errorf("bad wal field")
+		}
+		tag, value := rest[0], rest[2:2+int(rest[1])]
+		switch tag {
+		case walFieldBoard:
+			rec.Board = string(value)
+		case walFieldVisitor:
+			if len(value) == 8 {
+				rec.Visitor = binary.LittleEndian.Uint64(value)
+			}
+		case walFieldType:
+			if len(value) == 1 {
+				rec.Type = EventType(value[0])
+			}
+		case walFieldCount:
+			if len(value) == 8 {
+				rec.Count = binary.LittleEndian.Uint64(value)
+			}
+		}
+		rest = rest[2+len(value):]
+	}
+	return rec, nil
 }
 
 // WalThread 单个WAL线程，负责写入一个WAL文件
@@ -33,23 +158,56 @@ type WalThread struct {
 	writer  *bufio.Writer
 	curSize int64
 	seq     int
-	reqCh   chan *WalRecord
+	reqCh   chan *walRequest
+	lsn     uint64 // 最后分配的LSN
+	applied uint64 // 最后投递到排行榜的LSN，受wal.applyMu保护
+	keyId   uint32 // 当前段文件的加密密钥，0表示不加密
+	header  []byte // 当前段文件头
+
+	wal  *Wal
+	opts WalOptions
+	hist *walSyncHist
+}
+
+// walRequest 一次写入请求，同一批记录一次写入、一次fsync
+type walRequest struct {
+	recs []*WalRecord
+	done chan error // 刷盘后回传写入结果，为nil表示异步写入
+}
+
+// reply 回传写入结果
+func (req *walRequest) reply(err error) {
+	if req.done != nil {
+		req.done <- err
+	}
 }
 
 // Wal 多线程WAL管理器
 type Wal struct {
-	dir        string
-	maxSize    int64
-	threads    [config.WalThreads]*WalThread
-	shutdown   chan struct{}
-	wg         sync.WaitGroup
-	randomSeed uint64
+	dir      string
+	maxSize  int64
+	threads  [config.WalThreads]*WalThread
+	opts     WalOptions
+	hist     *walSyncHist
+	mu       sync.RWMutex // 保护closed，避免关闭后继续向reqCh发送
+	closed   bool
+	applyMu  sync.RWMutex // 投递记录时持读锁，Checkpoint持写锁暂停投递
+	apply    func(rec *WalRecord)
+	shutdown chan struct{}
+	wg       sync.WaitGroup
 }
 
 func NewWAL() (*Wal, error) {
+	return NewWALWithOptions(DefaultWalOptions())
+}
+
+// NewWALWithOptions 按指定刷盘参数创建WAL
+func NewWALWithOptions(opts WalOptions) (*Wal, error) {
 	w := &Wal{
 		dir:      config.WalPath,
 		maxSize:  config.WalMaxSize,
+		opts:     opts.normalize(),
+		hist:     &walSyncHist{},
 		shutdown: make(chan struct{}),
 	}
 
@@ -70,7 +228,10 @@ func (w *Wal) newWalThread(threadId int) (*WalThread, error) {
 		threadId: threadId,
 		dir:      w.dir,
 		maxSize:  w.maxSize,
-		reqCh:    make(chan *WalRecord),
+		reqCh:    make(chan *walRequest),
+		wal:      w,
+		opts:     w.opts,
+		hist:     w.hist,
 	}
 	if err := wt.initFromExisting(); err != nil {
 		return nil, err
@@ -83,42 +244,134 @@ func (w *Wal) newWalThread(threadId int) (*WalThread, error) {
 	return wt, nil
 }
 
+// run 按刷盘策略处理写入请求
+// always: 每个请求写入后立即刷盘；batch: 累计BatchRecords条记录或等待BatchInterval后统一刷盘（组提交）；
+// everysec: 写入操作系统后立即返回，每秒刷盘一次，宕机最多丢失1秒数据
 func (wt *WalThread) run() {
-	for req := range wt.reqCh {
-		if err := wt.appendRecord(req.FileId, req.Ts); err != nil {
-			panic(fmt.Sprintf("wal write failed (thread %d): %v", wt.threadId, err))
+	var (
+		pending  []*walRequest // batch策略下等待刷盘的请求
+		unsynced int           // 未刷盘的记录数
+		timer    *time.Timer
+		timerC   <-chan time.Time
+		tickC    <-chan time.Time
+	)
+	if wt.opts.Fsync == config.WalFsyncEverySec {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		tickC = ticker.C
+	}
+	// syncPending 刷盘并回传等待中的请求
+	syncPending := func() {
+		wt.deliver(pending, wt.sync(unsynced))
+		pending, unsynced = nil, 0
+		if timer != nil {
+			timer.Stop()
+			timerC = nil
 		}
 	}
+
+	for {
+		select {
+		case req, ok := <-wt.reqCh:
+			if !ok {
+				if unsynced > 0 {
+					syncPending()
+				}
+				return
+			}
+			if err := wt.write(req.recs); err != nil {
+				// 缓冲区中尚未刷盘的记录一并失败
+				wt.deliver(append(pending, req), err)
+				pending, unsynced = nil, 0
+				continue
+			}
+			unsynced += len(req.recs)
+			switch wt.opts.Fsync {
+			case config.WalFsyncEverySec:
+				wt.deliver([]*walRequest{req}, nil)
+			case config.WalFsyncBatch:
+				pending = append(pending, req)
+				if unsynced >= wt.opts.BatchRecords {
+					syncPending()
+				} else if timerC == nil {
+					timer = time.NewTimer(wt.opts.BatchInterval)
+					timerC = timer.C
+				}
+			default:
+				pending = append(pending, req)
+				syncPending()
+			}
+		case <-timerC:
+			timerC = nil
+			syncPending()
+		case <-tickC:
+			if unsynced > 0 {
+				syncPending()
+			}
+		}
+	}
+}
+
+// deliver 写入成功时按LSN顺序将记录投递到排行榜，然后回传写入结果
+// 同一线程的记录按LSN顺序投递，快照时各线程已投递的最大LSN即为快照包含的记录范围
+func (wt *WalThread) deliver(reqs []*walRequest, err error) {
+	if err == nil {
+		wt.wal.applyMu.RLock()
+		for _, req := range reqs {
+			for _, rec := range req.recs {
+				if wt.wal.apply != nil {
+					wt.wal.apply(rec)
+				}
+				wt.applied = rec.Lsn
+			}
+		}
+		wt.wal.applyMu.RUnlock()
+	}
+	for _, req := range reqs {
+		req.reply(err)
+	}
+}
+
+// fail 记录写入错误，bufio.Writer出错后不可再用，滚动到新文件继续服务后续请求
+func (wt *WalThread) fail(err error) error {
+	err = fmt.Errorf("wal write failed (thread %d): %w", wt.threadId, err)
+	config.Error(err.Error())
+	if rerr := wt.rotateLocked(); rerr != nil {
+		config.Error(fmt.Sprintf("wal rotate failed (thread %d): %v", wt.threadId, rerr))
+	}
+	return err
 }
 
 func (wt *WalThread) initFromExisting() error {
-	// 查找该线程对应的WAL文件，格式: wal-{threadId}-*.log
-	pattern := fmt.Sprintf("wal-%d-*.log", wt.threadId)
-	matches, _ := filepath.Glob(filepath.Join(wt.dir, pattern))
-	if len(matches) == 0 {
-		return wt.rotateLocked()
-	}
-	sort.Strings(matches)
-	last := matches[len(matches)-1]
-	base := filepath.Base(last)
-	// 解析文件名 wal-{threadId}-{seq}.log
-	parts := strings.Split(strings.TrimSuffix(base, ".log"), "-")
-	if len(parts) != 3 {
-		return fmt.Errorf("invalid WAL filename format: %s", base)
-	}
-	seqStr := parts[2]
-	seq, _ := strconv.Atoi(seqStr)
-	wt.seq = seq
-
-	f, err := os.OpenFile(last, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	segments, err := listWalSegments(wt.dir, wt.threadId)
 	if err != nil {
 		return err
 	}
-	wt.curFile = f
-	wt.writer = bufio.NewWriter(f)
-	fi, _ := f.Stat()
-	wt.curSize = fi.Size()
-	return nil
+	if len(segments) > 0 {
+		wt.seq = segments[len(segments)-1].Seq
+		// 从最后一个段文件向前查找已分配的最大LSN，空段文件和旧版本段文件没有LSN
+		for i := len(segments) - 1; i >= 0; i-- {
+			lsn, ok, err := lastWalLsn(segments[i].Path)
+			if err != nil {
+				return err
+			}
+			if ok {
+				wt.lsn = lsn
+				break
+			}
+		}
+	}
+	// 快照检查点可能超过WAL中留存的LSN：everysec策略下未刷盘的记录已投递并写入快照后掉电、
+	// 段文件中间损坏或被截断；从检查点之后继续分配，否则新记录会被当作已包含在快照中而在回放时跳过
+	if wt.threadId < len(wt.opts.MinLsns) && wt.opts.MinLsns[wt.threadId] > wt.lsn {
+		config.Warn(fmt.Sprintf("WAL线程%d的最大LSN %d 小于快照检查点 %d，从检查点之后继续分配",
+			wt.threadId, wt.lsn, wt.opts.MinLsns[wt.threadId]))
+		wt.lsn = wt.opts.MinLsns[wt.threadId]
+	}
+	// 启动时回放会应用全部记录
+	wt.applied = wt.lsn
+	// 总是写入新的段文件，避免追加在旧版本段文件或损坏的尾部之后
+	return wt.rotateLocked()
 }
 
 func (wt *WalThread) rotateLocked() error {
@@ -126,6 +379,7 @@ func (wt *WalThread) rotateLocked() error {
 		_ = wt.writer.Flush()
 		_ = wt.curFile.Sync()
 		_ = wt.curFile.Close()
+		wt.curFile = nil
 	}
 	wt.seq++
 	name := fmt.Sprintf("wal-%d-%06d.log", wt.threadId, wt.seq)
@@ -137,21 +391,75 @@ func (wt *WalThread) rotateLocked() error {
 	wt.curFile = f
 	wt.writer = bufio.NewWriter(f)
 	wt.curSize = 0
+	wt.keyId = activeKey()
+	if err := wt.writeHeader(); err != nil {
+		return err
+	}
+	// 文件头立即写入操作系统，进程崩溃时不会留下空的段文件
+	return wt.writer.Flush()
+}
+
+// writeHeader 写入段文件头，baseLsn为该段文件第一条记录的LSN
+func (wt *WalThread) writeHeader() error {
+	wt.header = encodeWalHeader(wt.lsn+1, wt.keyId)
+	if _, err := wt.writer.Write(wt.header); err != nil {
+		return err
+	}
+	wt.curSize = walHeaderSize
 	return nil
 }
 
-func (wt *WalThread) appendRecord(fileId uint64, ts int64) error {
-	// payload = fileId(8) + ts(8)
-	payload := make([]byte, 16)
-	binary.LittleEndian.PutUint64(payload[0:8], fileId)
-	binary.LittleEndian.PutUint64(payload[8:16], uint64(ts))
+// encodeWalHeader 编码当前版本的段文件头
+func encodeWalHeader(baseLsn uint64, keyId uint32) []byte {
+	header := make([]byte, walHeaderSize)
+	copy(header, walMagic)
+	binary.LittleEndian.PutUint16(header[4:6], walVersion)
+	binary.LittleEndian.PutUint64(header[6:14], baseLsn)
+	binary.LittleEndian.PutUint32(header[14:18], keyId)
+	return header
+}
 
-	crc := crc32.ChecksumIEEE(payload)
-	var header [8]byte
-	binary.LittleEndian.PutUint32(header[0:4], uint32(len(payload)))
-	binary.LittleEndian.PutUint32(header[4:8], crc)
+// walRecordAad 加密记录的附加认证数据: 段文件头 | 记录在文件中的偏移(8)
+func walRecordAad(header []byte, offset int64) []byte {
+	aad := make([]byte, len(header)+8)
+	copy(aad, header)
+	binary.LittleEndian.PutUint64(aad[len(header):], uint64(offset))
+	return aad
+}
+
+// write 顺序写入一批记录，everysec策略下同时写入操作系统
+func (wt *WalThread) write(recs []*WalRecord) error {
+	for _, rec := range recs {
+		if err := wt.appendRecord(rec); err != nil {
+			return wt.fail(err)
+		}
+	}
+	if wt.opts.Fsync == config.WalFsyncEverySec {
+		if err := wt.writer.Flush(); err != nil {
+			return wt.fail(err)
+		}
+	}
+	return nil
+}
+
+// sync 刷盘并记录fsync耗时，records为本次刷盘的记录数
+func (wt *WalThread) sync(records int) error {
+	if err := wt.writer.Flush(); err != nil {
+		return wt.fail(err)
+	}
+	start := time.Now()
+	if err := wt.curFile.Sync(); err != nil {
+		return wt.fail(err)
+	}
+	wt.hist.observe(time.Since(start), records)
+	return nil
+}
 
-	recordSize := int64(len(payload) + len(header))
+// appendRecord 分配LSN并写入单条记录，不刷盘
+func (wt *WalThread) appendRecord(rec *WalRecord) error {
+	payload := rec.encodePayload()
+	var header [8]byte
+	recordSize := int64(len(payload) + len(header) + sealOverhead)
 
 	if wt.curFile == nil {
 		if err := wt.rotateLocked(); err != nil {
@@ -164,7 +472,21 @@ func (wt *WalThread) appendRecord(fileId uint64, ts int64) error {
 			return err
 		}
 	}
-	// 顺序写入 + always fsync
+	// 滚动后再分配LSN，保证段文件头中的baseLsn是该段第一条记录的LSN
+	wt.lsn++
+	rec.Lsn = wt.lsn
+	payload = rec.encodePayload()
+	if wt.keyId != 0 {
+		var err error
+		if payload, err = sealWithKey(wt.keyId, payload, walRecordAad(wt.header, wt.curSize)); err != nil {
+			return err
+		}
+	}
+	recordSize = int64(len(payload) + len(header))
+	binary.LittleEndian.PutUint32(header[0:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(header[4:8], crc32.ChecksumIEEE(payload))
+
+	// 顺序写入
 	if _, err := wt.writer.Write(header[:]); err != nil {
 		return err
 	}
@@ -172,11 +494,7 @@ func (wt *WalThread) appendRecord(fileId uint64, ts int64) error {
 		return err
 	}
 	wt.curSize += recordSize
-
-	if err := wt.writer.Flush(); err != nil {
-		return err
-	}
-	return wt.curFile.Sync()
+	return nil
 }
 
 func (wt *WalThread) close() {
@@ -188,20 +506,87 @@ func (wt *WalThread) close() {
 	_ = wt.curFile.Close()
 }
 
-// Append 使用随机分配方式选择线程进行写入，实现负载均衡
-func (w *Wal) Append(fileId uint64, ts int64) {
-	// 使用随机分配方式选择线程，实现更好的负载均衡
-	// 由于WAL只保存ID和时间戳，同一ID放到不同文件无所谓
-	seed := atomic.AddUint64(&w.randomSeed, 1)
-	threadId := int(seed % config.WalThreads)
-	w.threads[threadId].reqCh <- &WalRecord{FileId: fileId, Ts: ts}
+// Append 写入一条记录，刷盘完成后返回
+func (w *Wal) Append(rec *WalRecord) error {
+	return w.submit([]*WalRecord{rec}, false)
+}
+
+// Stats 获取刷盘策略及fsync耗时分布
+func (w *Wal) Stats() *WalStats {
+	return w.hist.stats(w.opts)
+}
+
+// AppendAsync 写入一条记录，交给WAL线程后立即返回，写入失败只记录日志
+func (w *Wal) AppendAsync(rec *WalRecord) error {
+	return w.submit([]*WalRecord{rec}, true)
+}
+
+// AppendBatch 写入一批记录，每个WAL线程分到的记录只刷盘一次，全部刷盘完成后返回
+func (w *Wal) AppendBatch(recs []*WalRecord) error {
+	if len(recs) == 0 {
+		return nil
+	}
+	return w.submit(recs, false)
+}
+
+// walThreadOf 按文件ID选择WAL线程，同一文件的记录总在同一个线程中按写入顺序排列
+func walThreadOf(fileId uint64) int {
+	return int((fileId * 0x9E3779B97F4A7C15 >> 32) % config.WalThreads)
+}
+
+// submit 按文件ID将记录分配给WAL线程写入
+// 回放时删除和点击的先后顺序依赖同一文件的记录落在同一线程
+// 写入失败时部分记录可能已落盘，调用方应按至少一次语义处理
+func (w *Wal) submit(recs []*WalRecord, async bool) error {
+	var groups [config.WalThreads][]*WalRecord
+	for _, rec := range recs {
+		threadId := walThreadOf(rec.FileId)
+		groups[threadId] = append(groups[threadId], rec)
+	}
+
+	reqs := make([]*walRequest, 0, 1)
+	w.mu.RLock()
+	if w.closed {
+		w.mu.RUnlock()
+		return ErrWalClosed
+	}
+	for threadId, group := range groups {
+		if len(group) == 0 {
+			continue
+		}
+		req := &walRequest{recs: group}
+		if !async {
+			req.done = make(chan error, 1)
+		}
+		w.threads[threadId].reqCh <- req
+		reqs = append(reqs, req)
+	}
+	w.mu.RUnlock()
+
+	if async {
+		return nil
+	}
+	var firstErr error
+	for _, req := range reqs {
+		if err := <-req.done; err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
 }
 
 func (w *Wal) Close() {
 	// 1. 关闭所有 reqCh，通知线程退出
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return
+	}
+	w.closed = true
 	for _, thread := range w.threads {
 		close(thread.reqCh)
 	}
+	w.mu.Unlock()
 
 	// 2. 等待线程安全退出
 	w.wg.Wait()
@@ -212,42 +597,71 @@ func (w *Wal) Close() {
 	}
 }
 
-// ReplayAll 多线程回放所有WAL文件
-func (w *Wal) ReplayAll(minTs int64, apply func(fileId uint64, ts int64) error) error {
-	// 收集所有WAL文件
-	var allFiles []string
-	for i := 0; i < config.WalThreads; i++ {
-		pattern := fmt.Sprintf("wal-%d-*.log", i)
-		matches, _ := filepath.Glob(filepath.Join(w.dir, pattern))
-		allFiles = append(allFiles, matches...)
+// ReplayAll 多线程回放所有WAL文件，每个WAL线程的段文件按序号顺序回放，保证同一文件的记录按写入顺序应用
+// lsns为快照中各WAL线程已应用的最大LSN，不为nil时按LSN精确跳过已应用的记录，没有LSN的旧版本记录都已包含在快照中；
+// lsns为nil（旧版本快照）时按时间戳跳过不晚于快照的记录
+// apply 会收到记录原始的时间戳，时间窗口和热度衰减都依赖它按点击发生时刻重建
+func (w *Wal) ReplayAll(minTs int64, lsns []uint64, apply func(rec *WalRecord) error) error {
+	segments, err := w.segments()
+	if err != nil {
+		return err
 	}
-	sort.Strings(allFiles)
+	return w.replaySegments(segments, minTs, lsns, apply)
+}
 
-	// 使用工作池进行并发回放
-	fileChan := make(chan string, len(allFiles))
-	errorChan := make(chan error, config.WalThreads)
+// errReplayStop apply返回该错误时停止回放当前WAL线程之后的记录，不作为回放失败
+var errReplayStop = errors.New("stop replay")
+
+// segments 列出各WAL线程的段文件
+func (w *Wal) segments() ([][]*WalSegment, error) {
+	segments := make([][]*WalSegment, config.WalThreads)
+	for i := range segments {
+		var err error
+		if segments[i], err = listWalSegments(w.dir, i); err != nil {
+			return nil, err
+		}
+	}
+	return segments, nil
+}
+
+// replaySegments 回放给定的各WAL线程段文件，参数同 ReplayAll
+// 有lsns时跳过已全部包含在快照中的段文件，不再逐条读取
+func (w *Wal) replaySegments(threads [][]*WalSegment, minTs int64, lsns []uint64, apply func(rec *WalRecord) error) error {
+	errorChan := make(chan error, len(threads))
 	var wg sync.WaitGroup
 
-	// 启动工作协程
-	for i := 0; i < config.WalThreads; i++ {
+	// 每个WAL线程的段文件由一个协程顺序回放
+	for i, segments := range threads {
+		applied := func(rec *WalRecord) bool {
+			return rec.Ts <= minTs
+		}
+		if lsns != nil {
+			var ckpt uint64
+			if i < len(lsns) {
+				ckpt = lsns[i]
+			}
+			applied = func(rec *WalRecord) bool {
+				return rec.Lsn == 0 || rec.Lsn <= ckpt
+			}
+			segments = skipCovered(segments, ckpt)
+		}
+
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			for filePath := range fileChan {
-				if err := w.replayOne(filePath, minTs, apply); err != nil {
-					errorChan <- fmt.Errorf("failed to replay %s: %w", filePath, err)
+			for _, seg := range segments {
+				err := w.replayOne(seg.Path, applied, apply)
+				if errors.Is(err, errReplayStop) {
+					return
+				}
+				if err != nil {
+					errorChan <- fmt.Errorf("failed to replay %s: %w", seg.Path, err)
 					return
 				}
 			}
 		}()
 	}
 
-	// 发送文件到工作协程
-	for _, filePath := range allFiles {
-		fileChan <- filePath
-	}
-	close(fileChan)
-
 	// 等待所有工作协程完成
 	wg.Wait()
 	close(errorChan)
@@ -260,46 +674,104 @@ func (w *Wal) ReplayAll(minTs int64, apply func(fileId uint64, ts int64) error)
 	return nil
 }
 
-func (w *Wal) replayOne(path string, minTs int64, apply func(fileId uint64, ts int64) error) error {
-	f, err := os.Open(path)
+// skipCovered 跳过下一个段文件的baseLsn减一不大于ckpt的段文件，这些段文件的记录都已包含在快照中
+// 下一个段文件没有LSN（旧版本或空文件）时无法得出上界，从该段文件开始回放
+func skipCovered(segments []*WalSegment, ckpt uint64) []*WalSegment {
+	for len(segments) > 1 {
+		_, base, err := readWalBase(segments[1].Path)
+		if err != nil || base == 0 || base-1 > ckpt {
+			break
+		}
+		segments = segments[1:]
+	}
+	return segments
+}
+
+// replayOne 回放单个段文件，跳过applied返回true的记录
+func (w *Wal) replayOne(path string, applied func(rec *WalRecord) bool, apply func(rec *WalRecord) error) error {
+	res, err := ScanWalSegment(path, func(offset int64, rec *WalRecord) error {
+		if applied(rec) {
+			return nil
+		}
+		return apply(rec)
+	})
 	if err != nil {
 		return err
 	}
-	defer f.Close()
+	// 尾部半条记录是写入时崩溃留下的，忽略；数据损坏时停止回放该文件，之后的记录需要用 fileclick-tool 检查
+	switch {
+	case errors.Is(res.Err, ErrWalTruncated):
+		config.Warn(fmt.Sprintf("WAL段文件尾部不完整: %s, 偏移: %d", path, res.ValidSize))
+	case res.Err != nil:
+		config.Error(fmt.Sprintf("WAL段文件损坏: %s, 偏移: %d, %v, 之后的%d字节不再回放",
+			path, res.ValidSize, res.Err, res.Size-res.ValidSize))
+	}
+	return nil
+}
 
-	r := bufio.NewReader(f)
-	for {
-		var header [8]byte
-		if _, err := io.ReadFull(r, header[:]); err != nil {
-			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
-				return nil
-			}
-			return err
-		}
-		length := binary.LittleEndian.Uint32(header[0:4])
-		sum := binary.LittleEndian.Uint32(header[4:8])
+// Checkpoint 暂停所有WAL线程向排行榜投递记录并执行fn，lsns为各线程已投递的最大LSN
+// fn执行期间排行榜收到的记录恰好是各线程LSN不大于lsns的全部记录，fn应尽快返回
+func (w *Wal) Checkpoint(fn func(lsns []uint64)) {
+	w.applyMu.Lock()
+	defer w.applyMu.Unlock()
+	lsns := make([]uint64, config.WalThreads)
+	for i, thread := range w.threads {
+		lsns[i] = thread.applied
+	}
+	fn(lsns)
+}
 
-		if length != 16 {
-			return fmt.Errorf("bad wal record length in %s", path)
+// SetApplier 设置记录写入成功后的投递函数，同一线程的记录按LSN顺序投递
+func (w *Wal) SetApplier(apply func(rec *WalRecord)) {
+	w.apply = apply
+}
+
+// walComplete 各WAL线程的第一个段文件是否都是序号为1的段文件，即从未清理过段文件
+func walComplete(threads [][]*WalSegment) bool {
+	for _, segments := range threads {
+		if len(segments) > 0 && segments[0].Seq != 1 {
+			return false
 		}
-		data := make([]byte, length)
-		if _, err := io.ReadFull(r, data); err != nil {
-			if errors.Is(err, io.ErrUnexpectedEOF) {
-				return nil // 尾部半条忽略
-			}
+	}
+	return true
+}
+
+// Prune 删除已全部包含在快照中的段文件，lsns为快照中各WAL线程已应用的最大LSN
+// 段文件的最大LSN由下一个段文件头中的baseLsn得出，各线程正在写入的最后一个段文件不删除
+func (w *Wal) Prune(lsns []uint64) error {
+	for i := 0; i < config.WalThreads && i < len(lsns); i++ {
+		segments, err := listWalSegments(w.dir, i)
+		if err != nil {
 			return err
 		}
-		if crc32.ChecksumIEEE(data) != sum {
-			return nil // 数据损坏，停止回放该文件
+		versions := make([]uint16, len(segments))
+		bases := make([]uint64, len(segments))
+		for j, seg := range segments {
+			if versions[j], bases[j], err = readWalBase(seg.Path); err != nil {
+				return err
+			}
 		}
-
-		fileId := binary.LittleEndian.Uint64(data[0:8])
-		ts := int64(binary.LittleEndian.Uint64(data[8:16]))
-
-		if ts > minTs {
-			if err := apply(fileId, ts); err != nil {
+		for j := 0; j+1 < len(segments); j++ {
+			// 之后第一个带LSN的段文件的baseLsn减一即为该段文件LSN的上界
+			var nextBase uint64
+			for k := j + 1; k < len(segments); k++ {
+				if bases[k] > 0 {
+					nextBase = bases[k]
+					break
+				}
+			}
+			covered := nextBase > 0 && nextBase-1 <= lsns[i]
+			if nextBase == 0 {
+				// 之后没有带LSN的段文件时，只有旧版本或空的段文件可以删除
+				covered = versions[j] > 0 && versions[j] < 3
+			}
+			if !covered {
+				break
+			}
+			if err := os.Remove(segments[j].Path); err != nil {
 				return err
 			}
 		}
 	}
+	return nil
 }
@@ -0,0 +1,261 @@
+package system
+
+import (
+	"fileClick/config"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// useTempData 切换到临时目录并创建数据目录，配置中的数据路径都是相对路径
+// 服务使用的文件信息存储在切换前后都重新打开
+func useTempData(t *testing.T) {
+	t.Helper()
+	resetFileStore()
+	t.Cleanup(resetFileStore)
+	t.Chdir(t.TempDir())
+	for _, dir := range []string{config.WalPath, config.RdbPath, config.FilePath} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// resetFileStore 关闭服务使用的文件信息存储，下次使用时按当前目录重新打开
+func resetFileStore() {
+	metaMu.Lock()
+	defer metaMu.Unlock()
+	if metaStore != nil {
+		metaStore.Close()
+		metaStore = nil
+	}
+}
+
+// TestWalLsnAfterCheckpoint 快照检查点之后WAL中的记录丢失（everysec掉电、截断损坏的段文件）时，
+// 重启后分配的LSN必须大于检查点，否则新记录在之后的恢复中被当作已包含在快照中跳过
+func TestWalLsnAfterCheckpoint(t *testing.T) {
+	useTempData(t)
+	const fileId = 1
+	thread := walThreadOf(fileId)
+
+	e, err := NewEngine()
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.wal.SetApplier(func(rec *WalRecord) {})
+	for i := 0; i < 5; i++ {
+		if err := e.wal.Append(&WalRecord{Op: WalOpClick, FileId: fileId, Ts: 1, Board: config.DefaultBoard, Count: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var ckpt []uint64
+	e.wal.Checkpoint(func(lsns []uint64) { ckpt = lsns })
+	if ckpt[thread] != 5 {
+		t.Fatalf("checkpoint lsn = %d, want 5", ckpt[thread])
+	}
+	if _, _, err := e.rdb.Save(&RdbSnapshot{Lsns: ckpt}); err != nil {
+		t.Fatal(err)
+	}
+	e.wal.Close()
+
+	// 已写入快照的记录从WAL中丢失，只剩文件头
+	segments, err := listWalSegments(config.WalPath, thread)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, seg := range segments {
+		if err := os.Truncate(seg.Path, walHeaderSize); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	e, err = NewEngine()
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.wal.SetApplier(func(rec *WalRecord) {})
+	rec := &WalRecord{Op: WalOpClick, FileId: fileId, Ts: 2, Board: config.DefaultBoard, Count: 1}
+	if err := e.wal.Append(rec); err != nil {
+		t.Fatal(err)
+	}
+	e.wal.Close()
+	if rec.Lsn <= ckpt[thread] {
+		t.Fatalf("lsn after restart = %d, want > checkpoint %d", rec.Lsn, ckpt[thread])
+	}
+
+	ld, err := e.rdb.LoadLatest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var replayed int
+	err = e.wal.ReplayAll(ld.SnapshotTs, ld.Lsns, func(rec *WalRecord) error {
+		replayed++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replayed != 1 {
+		t.Fatalf("replayed %d records, want 1", replayed)
+	}
+}
+
+// TestReplaySkipsCoveredSegments 下一个段文件的baseLsn减一不大于检查点的段文件不再读取，
+// apply返回errReplayStop时停止回放该线程且不报错
+func TestReplaySkipsCoveredSegments(t *testing.T) {
+	useTempData(t)
+	const fileId = 1
+	thread := walThreadOf(fileId)
+
+	w, err := NewWAL()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.SetApplier(func(rec *WalRecord) {})
+	// 每条记录写入单独的段文件
+	w.threads[thread].maxSize = 1
+	for i := 1; i <= 5; i++ {
+		if err := w.Append(&WalRecord{Op: WalOpClick, FileId: fileId, Ts: int64(i), Board: config.DefaultBoard, Count: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.Close()
+
+	// 只含检查点之前记录的段文件被跳过，从LSN 4所在的段文件开始回放
+	const ckpt = 3
+	segments, err := listWalSegments(config.WalPath, thread)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rest := skipCovered(segments, ckpt)
+	if len(rest) != 2 {
+		t.Fatalf("%d segments left after skip, want 2", len(rest))
+	}
+	if _, base, err := readWalBase(rest[0].Path); err != nil || base != ckpt+1 {
+		t.Fatalf("first segment base = %d (%v), want %d", base, err, ckpt+1)
+	}
+
+	lsns := make([]uint64, config.WalThreads)
+	lsns[thread] = ckpt
+	var replayed []uint64
+	err = w.ReplayAll(0, lsns, func(rec *WalRecord) error {
+		replayed = append(replayed, rec.Lsn)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(replayed) != 2 || replayed[0] != 4 || replayed[1] != 5 {
+		t.Fatalf("replayed lsns %v, want [4 5]", replayed)
+	}
+
+	replayed = nil
+	err = w.ReplayAll(0, lsns, func(rec *WalRecord) error {
+		if rec.Ts > 4 {
+			return errReplayStop
+		}
+		replayed = append(replayed, rec.Lsn)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(replayed) != 1 || replayed[0] != 4 {
+		t.Fatalf("replayed lsns %v, want [4]", replayed)
+	}
+}
+
+// TestWalAppendWaitsForSync 同步写入在记录刷盘并投递到排行榜之后才返回，异步写入放入队列后立即返回
+func TestWalAppendWaitsForSync(t *testing.T) {
+	const interval = 200 * time.Millisecond
+	tests := []struct {
+		name  string
+		async bool
+	}{
+		{name: "sync", async: false},
+		{name: "async", async: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTempData(t)
+			// 记录数达不到组提交条数，只能等待定时器刷盘
+			w, err := NewWALWithOptions(WalOptions{Fsync: config.WalFsyncBatch, BatchRecords: 100, BatchInterval: interval})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer w.Close()
+			var applied atomic.Int32
+			w.SetApplier(func(rec *WalRecord) { applied.Add(1) })
+
+			start := time.Now()
+			rec := &WalRecord{Op: WalOpClick, FileId: 1, Ts: 1, Board: config.DefaultBoard, Count: 1}
+			if tt.async {
+				err = w.AppendAsync(rec)
+			} else {
+				err = w.Append(rec)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			elapsed, syncs := time.Since(start), w.Stats().Syncs
+			if tt.async {
+				if elapsed >= interval || syncs != 0 {
+					t.Fatalf("async append returned after %v with %d syncs", elapsed, syncs)
+				}
+				waitFor(t, func() bool { return w.Stats().Syncs == 1 && applied.Load() == 1 })
+				return
+			}
+			if elapsed < interval || syncs != 1 || applied.Load() != 1 {
+				t.Fatalf("sync append returned after %v with %d syncs, %d applied", elapsed, syncs, applied.Load())
+			}
+		})
+	}
+}
+
+// TestWalFsyncPolicies always每次写入刷盘；batch累计到组提交条数时一次刷盘；everysec写入后立即返回，由定时器刷盘
+func TestWalFsyncPolicies(t *testing.T) {
+	tests := []struct {
+		name       string
+		opts       WalOptions
+		appends    int
+		wantSyncs  uint64 // 全部写入返回时的刷盘次数
+		eventually uint64 // 之后等待达到的刷盘次数
+	}{
+		{name: "always", opts: WalOptions{Fsync: config.WalFsyncAlways}, appends: 5, wantSyncs: 5, eventually: 5},
+		{name: "batch", opts: WalOptions{Fsync: config.WalFsyncBatch, BatchRecords: 5, BatchInterval: time.Hour}, appends: 5, wantSyncs: 1, eventually: 1},
+		{name: "everysec", opts: WalOptions{Fsync: config.WalFsyncEverySec}, appends: 5, wantSyncs: 0, eventually: 1},
+		{name: "未知策略按always处理", opts: WalOptions{Fsync: "never"}, appends: 2, wantSyncs: 2, eventually: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTempData(t)
+			w, err := NewWALWithOptions(tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer w.Close()
+			w.SetApplier(func(rec *WalRecord) {})
+
+			// 同一文件的记录落在同一WAL线程，并发写入才能凑成一批
+			errs := make(chan error, tt.appends)
+			for i := 0; i < tt.appends; i++ {
+				go func() {
+					errs <- w.Append(&WalRecord{Op: WalOpClick, FileId: 1, Ts: 1, Board: config.DefaultBoard, Count: 1})
+				}()
+			}
+			for i := 0; i < tt.appends; i++ {
+				if err := <-errs; err != nil {
+					t.Fatal(err)
+				}
+			}
+			if s := w.Stats(); s.Syncs != tt.wantSyncs {
+				t.Fatalf("syncs = %d after appends, want %d", s.Syncs, tt.wantSyncs)
+			}
+			waitFor(t, func() bool { return w.Stats().Syncs == tt.eventually })
+			if s := w.Stats(); s.Records != uint64(tt.appends) {
+				t.Fatalf("synced records = %d, want %d", s.Records, tt.appends)
+			}
+		})
+	}
+}
@@ -0,0 +1,302 @@
+package system
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	// ErrWalTruncated 段文件尾部的记录不完整，通常是写入时崩溃留下的
+	ErrWalTruncated = errors.New("truncated wal record")
+	// ErrWalCorrupt 记录长度非法、CRC不匹配或无法解码
+	ErrWalCorrupt = errors.New("corrupt wal record")
+)
+
+// WalSegment WAL段文件
+type WalSegment struct {
+	Path   string
+	Thread int
+	Seq    int
+}
+
+// ListWalSegments 列出目录中全部WAL线程的段文件，按线程号和序号升序排列
+func ListWalSegments(dir string) ([]*WalSegment, error) {
+	matches, _ := filepath.Glob(filepath.Join(dir, "wal-*-*.log"))
+	segments := make([]*WalSegment, 0, len(matches))
+	for _, path := range matches {
+		seg, err := parseWalSegment(path)
+		if err != nil {
+			return nil, err
+		}
+		segments = append(segments, seg)
+	}
+	sortWalSegments(segments)
+	return segments, nil
+}
+
+// listWalSegments 列出指定WAL线程的段文件，按序号升序排列
+func listWalSegments(dir string, threadId int) ([]*WalSegment, error) {
+	pattern := fmt.Sprintf("wal-%d-*.log", threadId)
+	matches, _ := filepath.Glob(filepath.Join(dir, pattern))
+	segments := make([]*WalSegment, 0, len(matches))
+	for _, path := range matches {
+		seg, err := parseWalSegment(path)
+		if err != nil {
+			return nil, err
+		}
+		segments = append(segments, seg)
+	}
+	sortWalSegments(segments)
+	return segments, nil
+}
+
+// parseWalSegment 解析文件名 wal-{threadId}-{seq}.log
+func parseWalSegment(path string) (*WalSegment, error) {
+	base := filepath.Base(path)
+	parts := strings.Split(strings.TrimSuffix(base, ".log"), "-")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("invalid WAL filename format: %s", base)
+	}
+	thread, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid WAL filename format: %s", base)
+	}
+	seq, err := strconv.Atoi(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid WAL filename format: %s", base)
+	}
+	return &WalSegment{Path: path, Thread: thread, Seq: seq}, nil
+}
+
+func sortWalSegments(segments []*WalSegment) {
+	sort.Slice(segments, func(i, j int) bool {
+		if segments[i].Thread != segments[j].Thread {
+			return segments[i].Thread < segments[j].Thread
+		}
+		return segments[i].Seq < segments[j].Seq
+	})
+}
+
+// walReader 顺序读取单个段文件的记录
+type walReader struct {
+	r       *bufio.Reader
+	version uint16
+	baseLsn uint64 // 版本3起段文件头中记录的第一条记录的LSN
+	keyId   uint32 // 版本4起记录负载的加密密钥，0表示未加密
+	header  []byte // 版本5起的段文件头，加密记录的附加认证数据
+	offset  int64  // 下一条记录在文件中的偏移
+}
+
+// newWalReader 读取段文件头，没有文件头的是版本1
+// 文件头不完整时返回 ErrWalTruncated
+func newWalReader(r io.Reader) (*walReader, error) {
+	wr := &walReader{r: bufio.NewReader(r), version: 1}
+	header, err := wr.r.Peek(walHeaderSizeV2)
+	if err != nil {
+		if len(header) == 0 {
+			return wr, nil
+		}
+		// 不足一个文件头或一条记录头
+		return nil, ErrWalTruncated
+	}
+	if string(header[:len(walMagic)]) != walMagic {
+		return wr, nil
+	}
+	wr.version = binary.LittleEndian.Uint16(header[4:6])
+	if wr.version > walVersion {
+		return nil, fmt.Errorf("unsupported wal version: %d", wr.version)
+	}
+	size := walHeaderSizeV2
+	if wr.version >= 3 {
+		size = walHeaderSizeV3
+		if wr.version >= 4 {
+			size = walHeaderSize
+		}
+		if header, err = wr.r.Peek(size); err != nil {
+			return nil, ErrWalTruncated
+		}
+		wr.baseLsn = binary.LittleEndian.Uint64(header[6:14])
+		if wr.version >= 4 {
+			wr.keyId = binary.LittleEndian.Uint32(header[14:18])
+		}
+		if wr.version >= 5 {
+			wr.header = append([]byte(nil), header...)
+		}
+	}
+	_, _ = wr.r.Discard(size)
+	wr.offset = int64(size)
+	return wr, nil
+}
+
+// next 读取下一条记录，读完时返回 io.EOF
+// 尾部半条记录返回 ErrWalTruncated，长度非法、CRC不匹配或无法解码返回 ErrWalCorrupt
+func (wr *walReader) next() (*WalRecord, error) {
+	var header [8]byte
+	if n, err := io.ReadFull(wr.r, header[:]); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, io.EOF
+		}
+		if errors.Is(err, io.ErrUnexpectedEOF) && n > 0 {
+			return nil, ErrWalTruncated
+		}
+		return nil, err
+	}
+	length := binary.LittleEndian.Uint32(header[0:4])
+	sum := binary.LittleEndian.Uint32(header[4:8])
+	if length < 16 || length > walMaxPayload {
+		return nil, fmt.Errorf("%w: bad length %d", ErrWalCorrupt, length)
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(wr.r, data); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) {
+			return nil, ErrWalTruncated
+		}
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(data) != sum {
+		return nil, fmt.Errorf("%w: crc mismatch", ErrWalCorrupt)
+	}
+	if wr.keyId != 0 {
+		// 版本4的加密记录没有附加认证数据
+		var aad []byte
+		if wr.header != nil {
+			aad = walRecordAad(wr.header, wr.offset)
+		}
+		var err error
+		if data, err = openWithKey(wr.keyId, data, aad); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrWalCorrupt, err)
+		}
+	}
+	rec, err := decodeWalPayload(data, wr.version)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrWalCorrupt, err)
+	}
+	wr.offset += int64(len(header)) + int64(length)
+	return rec, nil
+}
+
+// WalScanResult 段文件扫描结果
+type WalScanResult struct {
+	Path      string
+	Version   uint16
+	BaseLsn   uint64 // 版本3起段文件第一条记录的LSN
+	KeyId     uint32 // 加密密钥，0表示未加密
+	Records   int    // 完整记录数
+	Size      int64  // 文件大小
+	ValidSize int64  // 最后一条完整记录的结束偏移，损坏时即第一条坏记录的偏移
+	Err       error  // 扫描停止的原因，ErrWalTruncated 或 ErrWalCorrupt，读到文件结尾时为nil
+}
+
+// ScanWalSegment 顺序读取段文件中的全部记录，fn收到每条记录及其在文件中的偏移
+// 遇到半条记录或损坏的记录时停止并记录在结果中，fn返回错误或读取文件失败时返回错误
+func ScanWalSegment(path string, fn func(offset int64, rec *WalRecord) error) (*WalScanResult, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	res := &WalScanResult{Path: path, Size: fi.Size()}
+	wr, err := newWalReader(f)
+	if err != nil {
+		if errors.Is(err, ErrWalTruncated) {
+			res.Err = err
+			return res, nil
+		}
+		return nil, err
+	}
+	// 缺少密钥时无法区分记录是否损坏，直接返回错误，避免被当作损坏截断
+	if wr.keyId != 0 {
+		if _, err := lookupKey(wr.keyId); err != nil {
+			return nil, err
+		}
+	}
+	res.Version, res.BaseLsn, res.KeyId, res.ValidSize = wr.version, wr.baseLsn, wr.keyId, wr.offset
+	for {
+		offset := wr.offset
+		rec, err := wr.next()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return res, nil
+			}
+			if errors.Is(err, ErrWalTruncated) || errors.Is(err, ErrWalCorrupt) {
+				res.Err = err
+				return res, nil
+			}
+			return nil, err
+		}
+		res.Records++
+		res.ValidSize = wr.offset
+		if fn != nil {
+			if err := fn(offset, rec); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// TruncateWalSegment 将段文件截断到最后一条完整记录之后，返回截掉的字节数
+// 损坏位置之后的记录会一并丢弃，段文件没有问题时不做修改
+func TruncateWalSegment(path string) (int64, error) {
+	res, err := ScanWalSegment(path, nil)
+	if err != nil {
+		return 0, err
+	}
+	if res.Err == nil {
+		return 0, nil
+	}
+	if err := os.Truncate(path, res.ValidSize); err != nil {
+		return 0, err
+	}
+	return res.Size - res.ValidSize, nil
+}
+
+// lastWalLsn 获取段文件中最后一条完整记录的LSN，空段文件返回baseLsn-1
+// 段文件没有LSN（旧版本或文件头不完整）时ok为false
+func lastWalLsn(path string) (lsn uint64, ok bool, err error) {
+	res, err := ScanWalSegment(path, func(offset int64, rec *WalRecord) error {
+		lsn = rec.Lsn
+		return nil
+	})
+	if err != nil {
+		return 0, false, err
+	}
+	if res.Version < 3 || res.BaseLsn == 0 {
+		return 0, false, nil
+	}
+	// 读到结尾或损坏处为止
+	if res.Records == 0 {
+		lsn = res.BaseLsn - 1
+	}
+	return lsn, true, nil
+}
+
+// readWalBase 读取段文件的版本和baseLsn，文件头不完整时版本为0
+func readWalBase(path string) (version uint16, baseLsn uint64, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+	wr, err := newWalReader(f)
+	if err != nil {
+		if errors.Is(err, ErrWalTruncated) {
+			return 0, 0, nil
+		}
+		return 0, 0, err
+	}
+	return wr.version, wr.baseLsn, nil
+}
@@ -0,0 +1,157 @@
+package system
+
+import (
+	"fileClick/config"
+	"sync/atomic"
+	"time"
+)
+
+// WalOptions WAL刷盘参数
+type WalOptions struct {
+	Fsync         string        // 刷盘策略: always、batch 或 everysec
+	BatchRecords  int           // batch策略下累计多少条记录刷盘一次
+	BatchInterval time.Duration // batch策略下未刷盘记录的最长等待时间
+	MinLsns       []uint64      // 各WAL线程已分配LSN的下限，取自快照检查点
+}
+
+// DefaultWalOptions 使用配置文件中的刷盘参数
+func DefaultWalOptions() WalOptions {
+	return WalOptions{
+		Fsync:         config.WalFsync,
+		BatchRecords:  config.WalBatchRecords,
+		BatchInterval: config.WalBatchInterval,
+	}
+}
+
+// normalize 补全非法参数，未知策略按always处理
+func (o WalOptions) normalize() WalOptions {
+	switch o.Fsync {
+	case config.WalFsyncAlways, config.WalFsyncBatch, config.WalFsyncEverySec:
+	default:
+		config.Warn("未知的WAL刷盘策略: " + o.Fsync + ", 使用always")
+		o.Fsync = config.WalFsyncAlways
+	}
+	if o.BatchRecords < 1 {
+		o.BatchRecords = 1
+	}
+	if o.BatchInterval <= 0 {
+		o.BatchInterval = time.Millisecond
+	}
+	return o
+}
+
+// walSyncBounds fsync耗时直方图各分桶的上界
+var walSyncBounds = []time.Duration{
+	100 * time.Microsecond,
+	250 * time.Microsecond,
+	500 * time.Microsecond,
+	time.Millisecond,
+	2500 * time.Microsecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+}
+
+// walSyncHist fsync耗时直方图，所有WAL线程共用，最后一个分桶统计超过最大上界的次数
+type walSyncHist struct {
+	buckets [14]atomic.Uint64
+	syncs   atomic.Uint64
+	records atomic.Uint64 // 已刷盘的记录数
+	totalNs atomic.Uint64
+	maxNs   atomic.Uint64
+}
+
+// observe 记录一次fsync的耗时及本次刷盘的记录数
+func (h *walSyncHist) observe(d time.Duration, records int) {
+	i := 0
+	for i < len(walSyncBounds) && d > walSyncBounds[i] {
+		i++
+	}
+	h.buckets[i].Add(1)
+	h.syncs.Add(1)
+	h.records.Add(uint64(records))
+	h.totalNs.Add(uint64(d))
+	for {
+		old := h.maxNs.Load()
+		if uint64(d) <= old || h.maxNs.CompareAndSwap(old, uint64(d)) {
+			break
+		}
+	}
+}
+
+// WalSyncBucket fsync耗时直方图分桶
+type WalSyncBucket struct {
+	Le    string `json:"le"` // 分桶上界，+Inf 表示超过最大上界
+	Count uint64 `json:"count"`
+}
+
+// WalStats WAL刷盘统计
+type WalStats struct {
+	Fsync         string           `json:"fsync"`
+	BatchRecords  int              `json:"batchRecords"`
+	BatchInterval string           `json:"batchInterval"`
+	Syncs         uint64           `json:"syncs"`
+	Records       uint64           `json:"records"`
+	AvgUs         float64          `json:"avgUs"`
+	MaxUs         float64          `json:"maxUs"`
+	P50Us         float64          `json:"p50Us"` // 分位数按分桶上界估算
+	P99Us         float64          `json:"p99Us"`
+	Buckets       []*WalSyncBucket `json:"buckets"`
+}
+
+// stats 导出直方图
+func (h *walSyncHist) stats(opts WalOptions) *WalStats {
+	s := &WalStats{
+		Fsync:         opts.Fsync,
+		BatchRecords:  opts.BatchRecords,
+		BatchInterval: opts.BatchInterval.String(),
+		Syncs:         h.syncs.Load(),
+		Records:       h.records.Load(),
+		MaxUs:         float64(h.maxNs.Load()) / 1e3,
+		Buckets:       make([]*WalSyncBucket, len(h.buckets)),
+	}
+	counts := make([]uint64, len(h.buckets))
+	var total uint64
+	for i := range h.buckets {
+		counts[i] = h.buckets[i].Load()
+		total += counts[i]
+		le := "+Inf"
+		if i < len(walSyncBounds) {
+			le = walSyncBounds[i].String()
+		}
+		s.Buckets[i] = &WalSyncBucket{Le: le, Count: counts[i]}
+	}
+	if s.Syncs > 0 {
+		s.AvgUs = float64(h.totalNs.Load()) / float64(s.Syncs) / 1e3
+	}
+	s.P50Us = h.quantile(counts, total, 0.5, s.MaxUs)
+	s.P99Us = h.quantile(counts, total, 0.99, s.MaxUs)
+	return s
+}
+
+// quantile 返回第一个累计次数达到q的分桶上界，落在最后一个分桶时返回最大耗时
+func (h *walSyncHist) quantile(counts []uint64, total uint64, q float64, maxUs float64) float64 {
+	if total == 0 {
+		return 0
+	}
+	target := uint64(q*float64(total) + 0.5)
+	if target < 1 {
+		target = 1
+	}
+	var acc uint64
+	for i, c := range counts {
+		acc += c
+		if acc >= target {
+			if i < len(walSyncBounds) {
+				return float64(walSyncBounds[i]) / 1e3
+			}
+			break
+		}
+	}
+	return maxUs
+}
@@ -0,0 +1,216 @@
+package system
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	windowMinute = int64(60)
+	windowHour   = int64(3600)
+	windowKeep   = 7 * 24 * windowHour // 小时桶最多保留7天
+)
+
+// windowSpec 时间窗口定义
+type windowSpec struct {
+	span   int64 // 窗口跨度（秒）
+	bucket int64 // 统计时使用的分桶粒度（秒）
+}
+
+// windowSpecs 支持的时间窗口
+var windowSpecs = map[string]windowSpec{
+	"1h":  {span: windowHour, bucket: windowMinute},
+	"24h": {span: 24 * windowHour, bucket: windowHour},
+	"7d":  {span: windowKeep, bucket: windowHour},
+}
+
+// WindowBucket 时间分桶
+type WindowBucket struct {
+	Start int64  // 分桶起始时间戳（秒）
+	Count uint64 // 分桶内按权重累加的分值
+}
+
+// WindowEntry 单个文件的分桶数据，用于快照持久化
+type WindowEntry struct {
+	Id      uint64
+	Minutes []WindowBucket
+	Hours   []WindowBucket
+}
+
+// windowCounter 单个文件的分桶计数
+type windowCounter struct {
+	fileName string
+	minutes  []WindowBucket // 分钟桶，保留最近1小时
+	hours    []WindowBucket // 小时桶，保留最近7天
+}
+
+// WindowBoard 滑动时间窗口排行榜，由RankBoard工作线程写入
+type WindowBoard struct {
+	mu       sync.RWMutex
+	counters map[uint64]*windowCounter
+}
+
+// NewWindowBoard 创建滑动窗口排行榜
+func NewWindowBoard() *WindowBoard {
+	return &WindowBoard{
+		counters: make(map[uint64]*windowCounter),
+	}
+}
+
+// hit 按事件时间戳将分值计入对应的分钟桶和小时桶
+func (wb *WindowBoard) hit(file *File, ts int64, weight uint64) {
+	wb.mu.Lock()
+	defer wb.mu.Unlock()
+
+	c, exists := wb.counters[file.Id]
+	if !exists {
+		c = &windowCounter{fileName: file.FileName}
+		wb.counters[file.Id] = c
+	}
+	c.minutes = addBucket(c.minutes, ts-ts%windowMinute, weight)
+	c.hours = addBucket(c.hours, ts-ts%windowHour, weight)
+	c.prune(time.Now().Unix())
+}
+
+// delete 移除文件的分桶数据
+func (wb *WindowBoard) delete(id uint64) {
+	wb.mu.Lock()
+	defer wb.mu.Unlock()
+	delete(wb.counters, id)
+}
+
+// TopN 获取指定时间窗口内点击次数前N的文件
+func (wb *WindowBoard) TopN(n int, window string) ([]*File, error) {
+	spec, ok := windowSpecs[window]
+	if !ok {
+		return nil, fmt.Errorf("不支持的时间窗口: %s", window)
+	}
+	now := time.Now().Unix()
+
+	wb.mu.RLock()
+	result := make([]*File, 0, len(wb.counters))
+	for id, c := range wb.counters {
+		buckets := c.hours
+		if spec.bucket == windowMinute {
+			buckets = c.minutes
+		}
+		count := sumBuckets(buckets, spec.bucket, spec.span, now)
+		if count == 0 {
+			continue
+		}
+		result = append(result, &File{Id: id, FileName: c.fileName, Count: count})
+	}
+	wb.mu.RUnlock()
+
+	// 按count降序排序，count相同时按ID升序排序
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Count != result[j].Count {
+			return result[i].Count > result[j].Count
+		}
+		return result[i].Id < result[j].Id
+	})
+	if len(result) > n {
+		result = result[:n]
+	}
+	return result, nil
+}
+
+// snapshot 清理过期分桶并拷贝分桶数据，ids不为nil时只拷贝其中的文件
+func (wb *WindowBoard) snapshot(ids map[uint64]struct{}) []*WindowEntry {
+	wb.mu.Lock()
+	defer wb.mu.Unlock()
+
+	now := time.Now().Unix()
+	var entries []*WindowEntry
+	visit := func(id uint64, c *windowCounter) {
+		c.prune(now)
+		if len(c.hours) == 0 {
+			delete(wb.counters, id)
+			return
+		}
+		entries = append(entries, &WindowEntry{
+			Id:      id,
+			Minutes: append([]WindowBucket(nil), c.minutes...),
+			Hours:   append([]WindowBucket(nil), c.hours...),
+		})
+	}
+	if ids == nil {
+		for id, c := range wb.counters {
+			visit(id, c)
+		}
+		return entries
+	}
+	for id := range ids {
+		if c, exists := wb.counters[id]; exists {
+			visit(id, c)
+		}
+	}
+	return entries
+}
+
+// load 从快照恢复分桶数据，fileMap用于补全文件名
+func (wb *WindowBoard) load(entries []*WindowEntry, fileMap map[uint64]*File) {
+	wb.mu.Lock()
+	defer wb.mu.Unlock()
+
+	for _, entry := range entries {
+		file, exists := fileMap[entry.Id]
+		if !exists {
+			continue
+		}
+		wb.counters[entry.Id] = &windowCounter{
+			fileName: file.FileName,
+			minutes:  entry.Minutes,
+			hours:    entry.Hours,
+		}
+	}
+}
+
+// prune 丢弃已滑出窗口的分桶
+func (c *windowCounter) prune(now int64) {
+	c.minutes = pruneBuckets(c.minutes, windowMinute, windowHour, now)
+	c.hours = pruneBuckets(c.hours, windowHour, windowKeep, now)
+}
+
+// addBucket 将点击计入起始时间为start的分桶，分桶按起始时间升序排列
+func addBucket(buckets []WindowBucket, start int64, n uint64) []WindowBucket {
+	// WAL回放时点击可能乱序到达，从尾部向前查找插入位置
+	i := len(buckets)
+	for i > 0 && buckets[i-1].Start >= start {
+		if buckets[i-1].Start == start {
+			buckets[i-1].Count = addSat(buckets[i-1].Count, n)
+			return buckets
+		}
+		i--
+	}
+	buckets = append(buckets, WindowBucket{})
+	copy(buckets[i+1:], buckets[i:])
+	buckets[i] = WindowBucket{Start: start, Count: n}
+	return buckets
+}
+
+// pruneBuckets 丢弃结束时间早于 now-span 的分桶
+func pruneBuckets(buckets []WindowBucket, width, span, now int64) []WindowBucket {
+	cut := 0
+	for cut < len(buckets) && buckets[cut].Start+width <= now-span {
+		cut++
+	}
+	if cut == 0 {
+		return buckets
+	}
+	return append(buckets[:0], buckets[cut:]...)
+}
+
+// sumBuckets 统计与窗口 (now-span, now] 有交集的分桶点击数
+func sumBuckets(buckets []WindowBucket, width, span, now int64) uint64 {
+	var total uint64
+	for i := len(buckets) - 1; i >= 0; i-- {
+		if buckets[i].Start+width <= now-span {
+			break
+		}
+		total = addSat(total, buckets[i].Count)
+	}
+	return total
+}
@@ -0,0 +1,119 @@
+package system
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// TestAddBucket 同一分桶内累加，跨过分桶边界时新建分桶，乱序到达的点击插入到正确位置
+func TestAddBucket(t *testing.T) {
+	tests := []struct {
+		name string
+		hits []int64 // 点击时间戳
+		want []WindowBucket
+	}{
+		{name: "同一分钟", hits: []int64{120, 150, 179}, want: []WindowBucket{{Start: 120, Count: 3}}},
+		{name: "跨过分钟边界", hits: []int64{179, 180, 181}, want: []WindowBucket{{Start: 120, Count: 1}, {Start: 180, Count: 2}}},
+		{name: "乱序到达", hits: []int64{300, 60, 200, 70}, want: []WindowBucket{{Start: 60, Count: 2}, {Start: 180, Count: 1}, {Start: 300, Count: 1}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buckets []WindowBucket
+			for _, ts := range tt.hits {
+				buckets = addBucket(buckets, ts-ts%windowMinute, 1)
+			}
+			if !reflect.DeepEqual(buckets, tt.want) {
+				t.Fatalf("buckets = %v, want %v", buckets, tt.want)
+			}
+		})
+	}
+}
+
+// TestWindowExpiry 分桶与窗口 (now-span, now] 有交集时计入，完全滑出窗口后不再计入并被清理
+func TestWindowExpiry(t *testing.T) {
+	const now = int64(100 * 3600)
+	buckets := []WindowBucket{
+		{Start: now - windowHour - windowMinute, Count: 1}, // 结束于窗口起点，已滑出
+		{Start: now - windowHour - 30, Count: 2},           // 跨过窗口起点，仍计入
+		{Start: now - windowMinute, Count: 4},
+		{Start: now - now%windowMinute, Count: 8},
+	}
+	tests := []struct {
+		name string
+		now  int64
+		want uint64
+	}{
+		{name: "当前", now: now, want: 14},
+		{name: "30秒后", now: now + 30, want: 12},
+		{name: "一小时后", now: now + windowHour, want: 8},
+		{name: "全部过期", now: now + 2*windowHour, want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sumBuckets(buckets, windowMinute, windowHour, tt.now); got != tt.want {
+				t.Fatalf("sum = %d, want %d", got, tt.want)
+			}
+			pruned := pruneBuckets(append([]WindowBucket(nil), buckets...), windowMinute, windowHour, tt.now)
+			if got := sumBuckets(pruned, windowMinute, windowHour, tt.now); got != tt.want {
+				t.Fatalf("sum after prune = %d, want %d", got, tt.want)
+			}
+			var total uint64
+			for _, b := range pruned {
+				total += b.Count
+			}
+			if total != tt.want {
+				t.Fatalf("pruned buckets = %v, want total %d", pruned, tt.want)
+			}
+		})
+	}
+}
+
+// TestWindowBoardTopN 各时间窗口只统计窗口内的点击，超过7天的点击被丢弃
+func TestWindowBoardTopN(t *testing.T) {
+	now := time.Now().Unix()
+	wb := NewWindowBoard()
+	hits := []struct {
+		id  uint64
+		ago int64
+		n   uint64
+	}{
+		{id: 1, ago: 0, n: 1},
+		{id: 2, ago: 2 * windowHour, n: 2},
+		{id: 3, ago: 3 * 24 * windowHour, n: 3},
+		{id: 4, ago: 8 * 24 * windowHour, n: 4},
+	}
+	for _, h := range hits {
+		wb.hit(&File{Id: h.id}, now-h.ago, h.n)
+	}
+
+	tests := []struct {
+		window string
+		want   []uint64
+	}{
+		{window: "1h", want: []uint64{1}},
+		{window: "24h", want: []uint64{2, 1}},
+		{window: "7d", want: []uint64{3, 2, 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.window, func(t *testing.T) {
+			files, err := wb.TopN(10, tt.window)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var ids []uint64
+			for _, f := range files {
+				ids = append(ids, f.Id)
+			}
+			if !reflect.DeepEqual(ids, tt.want) {
+				t.Fatalf("top = %v, want %v", ids, tt.want)
+			}
+		})
+	}
+	if _, err := wb.TopN(10, "30d"); err == nil {
+		t.Fatal("unsupported window accepted")
+	}
+	if entries := wb.snapshot(nil); len(entries) != 3 {
+		t.Fatalf("snapshot kept %d files, want 3 after expiry", len(entries))
+	}
+}
@@ -0,0 +1,201 @@
+// 崩溃恢复测试：点击与快照并发进行时 kill -9 进程，验证恢复后的点击数在快照边界上不丢失也不重复
+//
+// 每一轮启动一个子进程持续点击并频繁保存快照，子进程每收到一次点击确认就输出一行，
+// 随机时间后 kill -9 子进程，再启动一个子进程恢复数据并输出各文件的点击数。
+// 每个点击协程同一时刻最多只有一个未确认的点击，因此本轮新增的点击数应在 [确认数, 确认数+1] 之间。
+// 子进程是以环境变量指定模式重新执行的测试二进制。
+//
+// 运行: go test ./test/recovery -v
+package recovery
+
+import (
+	"bufio"
+	"encoding/json"
+	"fileClick/config"
+	"fileClick/system"
+	"fmt"
+	"math/rand"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	rounds       = 10                   // 崩溃恢复轮数
+	clickers     = 4                    // 并发点击协程数，每个协程点击一个文件
+	snapEvery    = 3 * time.Millisecond // 快照间隔，远小于1秒以覆盖同一秒内的快照边界
+	minRunTime   = 200 * time.Millisecond
+	maxRunTime   = 800 * time.Millisecond
+	baseFileId   = 1000
+	childClick   = "click"
+	childRecover = "recover"
+	childModeEnv = "FILECLICK_RECOVERY_MODE" // 子进程模式，设置时测试二进制作为子进程运行
+	childDirEnv  = "FILECLICK_RECOVERY_DIR"  // 子进程的数据目录
+)
+
+func TestMain(m *testing.M) {
+	if mode := os.Getenv(childModeEnv); mode != "" {
+		runChild(mode, os.Getenv(childDirEnv))
+		return
+	}
+	os.Exit(m.Run())
+}
+
+func TestCrashRecovery(t *testing.T) {
+	if testing.Short() {
+		t.Skip("crash recovery test kills child processes for several seconds")
+	}
+	dir := t.TempDir()
+
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	baseline := make(map[uint64]uint64)
+	for round := 1; round <= rounds; round++ {
+		acked := crashRound(t, dir, minRunTime+time.Duration(r.Int63n(int64(maxRunTime-minRunTime))))
+		counts := recoverCounts(t, dir)
+
+		for i := 0; i < clickers; i++ {
+			id := uint64(baseFileId + i)
+			added := counts[id] - baseline[id]
+			t.Logf("round %2d file %d: acked %6d, recovered +%6d", round, id, acked[id], added)
+			switch {
+			case counts[id] < baseline[id] || added < acked[id]:
+				t.Fatalf("round %d file %d: clicks lost", round, id)
+			case added > acked[id]+1:
+				t.Fatalf("round %d file %d: clicks duplicated", round, id)
+			}
+		}
+		baseline = counts
+	}
+}
+
+// childCommand 创建以指定模式运行的子进程
+func childCommand(t *testing.T, mode, dir string) *exec.Cmd {
+	path, err := os.Executable()
+	if err != nil {
+		t.Fatalf("executable: %v", err)
+	}
+	cmd := exec.Command(path)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), childModeEnv+"="+mode, childDirEnv+"="+dir)
+	cmd.Stderr = os.Stderr
+	return cmd
+}
+
+// crashRound 启动点击子进程，运行指定时间后 kill -9，返回各文件已确认的点击数
+func crashRound(t *testing.T, dir string, runTime time.Duration) map[uint64]uint64 {
+	cmd := childCommand(t, childClick, dir)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatalf("stdout pipe: %v", err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("start child: %v", err)
+	}
+
+	acked := make(map[uint64]uint64)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		scanner := bufio.NewScanner(stdout)
+		for scanner.Scan() {
+			id, err := strconv.ParseUint(scanner.Text(), 10, 64)
+			if err == nil {
+				acked[id]++
+			}
+		}
+	}()
+
+	time.Sleep(runTime)
+	_ = cmd.Process.Kill()
+	<-done
+	_ = cmd.Wait()
+	return acked
+}
+
+// recoverCounts 启动恢复子进程，返回恢复后各文件的点击数
+func recoverCounts(t *testing.T, dir string) map[uint64]uint64 {
+	out, err := childCommand(t, childRecover, dir).Output()
+	if err != nil {
+		t.Fatalf("recover child: %v", err)
+	}
+	counts := make(map[uint64]uint64)
+	if err := json.Unmarshal(out, &counts); err != nil {
+		t.Fatalf("parse recover output: %v", err)
+	}
+	return counts
+}
+
+// runChild 子进程入口，工作目录为测试数据目录
+func runChild(mode, dir string) {
+	if err := os.Chdir(dir); err != nil {
+		fail("chdir: %v", err)
+	}
+	if err := config.Init(); err != nil {
+		fail("init: %v", err)
+	}
+
+	engine, err := system.NewEngine()
+	if err != nil {
+		fail("new engine: %v", err)
+	}
+	if err := engine.Recover(); err != nil {
+		fail("recover: %v", err)
+	}
+
+	if mode == childRecover {
+		// 快照屏障排在回放的事件之后，快照返回时回放的事件已全部处理完，同时覆盖恢复后立即快照的场景
+		if err := engine.Snapshot(); err != nil {
+			fail("snapshot: %v", err)
+		}
+		counts := make(map[uint64]uint64)
+		for _, f := range engine.TopAll(config.DefaultBoard) {
+			counts[f.Id] = f.Count
+		}
+		_ = json.NewEncoder(os.Stdout).Encode(counts)
+		os.Exit(0)
+	}
+
+	for i := 0; i < clickers; i++ {
+		id := uint64(baseFileId + i)
+		name := "file-" + strconv.FormatUint(id, 10)
+		if err := system.AddFile(id, &system.FileInfo{Name: name, Path: config.FilePath + name}); err != nil {
+			fail("add file: %v", err)
+		}
+	}
+
+	// 频繁保存快照
+	go func() {
+		for {
+			if err := engine.Snapshot(); err != nil {
+				fail("snapshot: %v", err)
+			}
+			time.Sleep(snapEvery)
+		}
+	}()
+
+	var mu sync.Mutex
+	for i := 0; i < clickers; i++ {
+		go func(id uint64) {
+			line := []byte(strconv.FormatUint(id, 10) + "\n")
+			for {
+				if err := engine.Click(config.DefaultBoard, id, system.HitEvent, "", false); err != nil {
+					fail("click: %v", err)
+				}
+				// 点击确认后立即输出，进程被杀死前输出的行都是已确认的点击
+				mu.Lock()
+				_, _ = os.Stdout.Write(line)
+				mu.Unlock()
+			}
+		}(uint64(baseFileId + i))
+	}
+	select {}
+}
+
+// fail 子进程出错时输出到标准错误并退出，父进程据退出码判定失败
+func fail(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
+	os.Exit(1)
+}